@@ -4,10 +4,14 @@ import (
 	"context"
 	"github.com/gdcorp-infosec/hashserve/pkg/cmd/hashserve"
 	"log"
+	"os"
 )
 
+// Version is set at build time with -ldflags '-X main.Version=...'.
+var Version = "dev"
+
 func main() {
-	if err := hashserve.Run(context.Background()); err != nil {
+	if err := hashserve.Execute(context.Background(), Version, os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,228 @@
+package adaptive
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// decreaseFactor is the multiplicative decrease applied when the hasher is
+// slower than the target latency or fails too often.
+const decreaseFactor = 0.7
+
+var limitGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "hashserve_image_worker_limit",
+	Help: "Number of image workers currently allowed to call the hasher.",
+})
+
+// Controller is an AIMD concurrency limiter. Callers Acquire a slot before
+// doing work, Release it afterwards and Observe the latency and outcome of
+// each hasher call. Every window the limit grows by one while the hasher is
+// healthy and the limit is in use, and shrinks multiplicatively when the
+// 90th percentile latency exceeds the target or too many calls fail.
+type Controller struct {
+	min int
+	max int
+
+	// Latency above which the hasher is considered overloaded.
+	targetLatency time.Duration
+
+	// Fraction of failed calls above which the hasher is considered overloaded.
+	maxErrorRate float64
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	inFlight  int
+	peak      int
+	closed    bool
+	latencies []time.Duration
+	failures  int
+	onChange  []func(limit int)
+}
+
+// New creates a Controller starting at initial, bounded by min and max.
+func New(initial, min, max int, targetLatency time.Duration, maxErrorRate float64) *Controller {
+	initial, min, max = bounds(initial, min, max)
+	c := &Controller{
+		min:           min,
+		max:           max,
+		targetLatency: targetLatency,
+		maxErrorRate:  maxErrorRate,
+		limit:         initial,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	limitGauge.Set(float64(initial))
+	return c
+}
+
+// bounds clamps min to at least one, max to at least min and initial between them.
+func bounds(initial, min, max int) (int, int, int) {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if initial < min {
+		initial = min
+	}
+	if initial > max {
+		initial = max
+	}
+	return initial, min, max
+}
+
+// Max returns the upper bound of the limit, i.e. the number of workers to start.
+func (c *Controller) Max() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max
+}
+
+// SetBounds resets the limit to initial and changes its bounds, clamped as by
+// New. Callers start more workers when Max grows.
+func (c *Controller) SetBounds(initial, min, max int) {
+	initial, min, max = bounds(initial, min, max)
+	c.mu.Lock()
+	c.min = min
+	c.max = max
+	changed := initial != c.limit
+	c.limit = initial
+	callbacks := c.onChange
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if changed {
+		limitGauge.Set(float64(initial))
+		for _, fn := range callbacks {
+			fn(initial)
+		}
+	}
+}
+
+// SetTargets changes the latency and error rate above which the hasher is
+// considered overloaded.
+func (c *Controller) SetTargets(targetLatency time.Duration, maxErrorRate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.targetLatency = targetLatency
+	c.maxErrorRate = maxErrorRate
+}
+
+// Limit returns the current concurrency limit.
+func (c *Controller) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// OnChange registers fn to be called with the new limit whenever it changes.
+func (c *Controller) OnChange(fn func(limit int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = append(c.onChange, fn)
+}
+
+// Acquire blocks until a slot is free. It returns false once the controller is closed.
+func (c *Controller) Acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.inFlight >= c.limit && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return false
+	}
+	c.inFlight++
+	if c.inFlight > c.peak {
+		c.peak = c.inFlight
+	}
+	return true
+}
+
+// Release frees a slot obtained by Acquire.
+func (c *Controller) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	c.cond.Signal()
+}
+
+// Observe records the latency and outcome of a single hasher call.
+func (c *Controller) Observe(latency time.Duration, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latencies = append(c.latencies, latency)
+	if failed {
+		c.failures++
+	}
+}
+
+// Close wakes every blocked Acquire.
+func (c *Controller) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+// Run adjusts the limit every window until ctx is done.
+func (c *Controller) Run(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.adjust()
+		}
+	}
+}
+
+// adjust applies one AIMD step based on the observations since the last step.
+func (c *Controller) adjust() {
+	c.mu.Lock()
+	samples := c.latencies
+	failures := c.failures
+	peak := c.peak
+	c.latencies = nil
+	c.failures = 0
+	c.peak = c.inFlight
+
+	limit := c.limit
+	if len(samples) > 0 {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		p90 := samples[(len(samples)*9)/10]
+		errorRate := float64(failures) / float64(len(samples))
+		if p90 > c.targetLatency || errorRate > c.maxErrorRate {
+			limit = int(float64(limit) * decreaseFactor)
+		} else if peak >= limit {
+			// Only grow while the current limit is actually in use.
+			limit++
+		}
+	}
+	if limit < c.min {
+		limit = c.min
+	}
+	if limit > c.max {
+		limit = c.max
+	}
+	changed := limit != c.limit
+	c.limit = limit
+	callbacks := c.onChange
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if changed {
+		limitGauge.Set(float64(limit))
+		for _, fn := range callbacks {
+			fn(limit)
+		}
+	}
+}
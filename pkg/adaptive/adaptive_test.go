@@ -0,0 +1,95 @@
+package adaptive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdjust(t *testing.T) {
+	c := New(4, 2, 6, time.Second, 0.1)
+	var changes []int
+	c.OnChange(func(limit int) { changes = append(changes, limit) })
+
+	// Healthy and fully used: additive increase.
+	for i := 0; i < 4; i++ {
+		c.Acquire()
+	}
+	c.Observe(100*time.Millisecond, false)
+	c.adjust()
+	if c.Limit() != 5 {
+		t.Errorf("Expected limit 5 after healthy window. Obtained %d", c.Limit())
+	}
+
+	// Healthy but under used: no change.
+	for i := 0; i < 4; i++ {
+		c.Release()
+	}
+	c.Observe(100*time.Millisecond, false)
+	c.adjust()
+	if c.Limit() != 5 {
+		t.Errorf("Expected limit to stay 5 while under used. Obtained %d", c.Limit())
+	}
+
+	// Slow hasher: multiplicative decrease.
+	c.Observe(5*time.Second, false)
+	c.adjust()
+	if c.Limit() != 3 {
+		t.Errorf("Expected limit 3 after slow window. Obtained %d", c.Limit())
+	}
+
+	// Failing hasher: decrease bounded by min.
+	c.Observe(10*time.Millisecond, true)
+	c.adjust()
+	if c.Limit() != 2 {
+		t.Errorf("Expected limit bounded at 2. Obtained %d", c.Limit())
+	}
+
+	if len(changes) != 3 {
+		t.Errorf("Expected 3 limit changes. Obtained %v", changes)
+	}
+}
+
+func TestAcquireBlocksAtLimit(t *testing.T) {
+	c := New(1, 1, 1, time.Second, 0.1)
+	if !c.Acquire() {
+		t.Fatal("Expected first acquire to succeed")
+	}
+	acquired := make(chan bool)
+	go func() { acquired <- c.Acquire() }()
+	select {
+	case <-acquired:
+		t.Fatal("Expected acquire above the limit to block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Close()
+	if <-acquired {
+		t.Error("Expected acquire to fail after close")
+	}
+}
+
+func TestSetBounds(t *testing.T) {
+	c := New(2, 1, 2, time.Second, 0.1)
+	var changes []int
+	c.OnChange(func(limit int) { changes = append(changes, limit) })
+
+	c.SetBounds(6, 2, 8)
+	if c.Limit() != 6 || c.Max() != 8 {
+		t.Errorf("Expected limit 6 bounded by 8. Obtained %d bounded by %d", c.Limit(), c.Max())
+	}
+	c.SetBounds(10, 4, 3)
+	if c.Limit() != 4 || c.Max() != 4 {
+		t.Errorf("Expected limit and max clamped to 4. Obtained %d and %d", c.Limit(), c.Max())
+	}
+
+	// A tighter target latency makes the same observation slow.
+	c.SetTargets(10*time.Millisecond, 0.1)
+	c.SetBounds(4, 1, 4)
+	c.Observe(100*time.Millisecond, false)
+	c.adjust()
+	if c.Limit() != 2 {
+		t.Errorf("Expected limit 2 after slow window. Obtained %d", c.Limit())
+	}
+	if len(changes) != 3 {
+		t.Errorf("Expected 3 limit changes. Obtained %v", changes)
+	}
+}
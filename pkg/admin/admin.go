@@ -0,0 +1,84 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// Server is a small HTTP server exposing operational endpoints of the
+// application such as metrics, list reloads and scheduler state.
+//
+// Read only (GET) endpoints are open. Every other method requires the
+// configured token as a bearer token and is refused when no token is set.
+type Server struct {
+	addr  string
+	token string
+	mux   *http.ServeMux
+}
+
+// NewServer creates an admin Server listening on addr.
+func NewServer(addr string, token string) *Server {
+	s := &Server{
+		addr:  addr,
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+	s.mux.Handle("/metrics", promhttp.Handler())
+	return s
+}
+
+// Handle registers handler for the given pattern.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, s.authorize(handler))
+}
+
+// HandleFunc registers handler for the given pattern.
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// Serve implements serve.Server. It listens until ctx is cancelled.
+func (s *Server) Serve(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	logger.Info(ctx, "admin server listening", zap.String("addr", s.addr))
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if s.token == "" {
+			http.Error(rw, "admin token not configured", http.StatusForbidden)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,301 @@
+package allowlist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Rule kinds reported when a scan matches the allowlist.
+const (
+	RuleURLPrefix = "url_prefix"
+	RuleHost      = "host"
+	RuleAssetID   = "asset_id"
+	RuleMD5       = "md5"
+	RuleSHA1      = "sha1"
+)
+
+var (
+	skipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hashserve_allowlist_skipped_total",
+		Help: "Number of scans not hashed because their request matched the known-benign allowlist.",
+	}, []string{"rule", "product"})
+	matchedAfterHash = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hashserve_allowlist_matched_after_hash_total",
+		Help: "Number of hashed scans not published because their digest matched the known-benign allowlist.",
+	}, []string{"rule", "product"})
+	entries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hashserve_allowlist_entries",
+		Help: "Number of entries in the loaded known-benign allowlist.",
+	}, []string{"rule"})
+)
+
+// Rules is the on-disk representation of the allowlist.
+type Rules struct {
+	// URL prefixes e.g. https://img1.wsimg.com/isteam/stock/, matched on
+	// their scheme, host and whole path segments.
+	URLPrefixes []string `json:"urlPrefixes"`
+
+	// Host names or glob patterns e.g. *.wsimg.com
+	Hosts []string `json:"hosts"`
+
+	// Hex encoded digests of known-benign content, only known once the hasher
+	// has been called.
+	MD5  []string `json:"md5"`
+	SHA1 []string `json:"sha1"`
+
+	// Product asset identifiers of stock and theme assets.
+	AssetIDs []string `json:"assetIDs"`
+}
+
+// compiled is an immutable, lookup friendly form of Rules.
+type compiled struct {
+	urlPrefixes []prefix
+	hosts       []string
+	md5         map[string]struct{}
+	sha1        map[string]struct{}
+	assetIDs    map[string]struct{}
+}
+
+// List is a reloadable known-benign allowlist. It is safe for concurrent use.
+type List struct {
+	path string
+
+	mu    sync.RWMutex
+	rules *compiled
+}
+
+// Load reads the allowlist file at path.
+func Load(path string) (*List, error) {
+	l := &List{path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// New creates a List from rules that is not backed by a file.
+func New(rules Rules) (*List, error) {
+	l := &List{}
+	if err := l.Set(rules); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload re-reads the allowlist file. The current rules are kept if the file
+// cannot be read or parsed.
+func (l *List) Reload() error {
+	if l.path == "" {
+		return errors.New("allowlist is not backed by a file")
+	}
+	rules, err := ReadRules(l.path)
+	if err != nil {
+		return err
+	}
+	return l.Set(rules)
+}
+
+// ReadRules reads the allowlist file at path without validating its rules.
+func ReadRules(path string) (Rules, error) {
+	var rules Rules
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return rules, errors.Wrapf(err, "unable to parse allowlist %s", path)
+	}
+	return rules, nil
+}
+
+// Validate reports the first invalid URL prefix or host pattern of the rules.
+func (r Rules) Validate() error {
+	_, err := compile(r)
+	return err
+}
+
+// Set validates rules and atomically replaces the current rules with them.
+func (l *List) Set(rules Rules) error {
+	c, err := compile(rules)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.rules = c
+	l.mu.Unlock()
+
+	entries.WithLabelValues(RuleURLPrefix).Set(float64(len(c.urlPrefixes)))
+	entries.WithLabelValues(RuleHost).Set(float64(len(c.hosts)))
+	entries.WithLabelValues(RuleMD5).Set(float64(len(c.md5)))
+	entries.WithLabelValues(RuleSHA1).Set(float64(len(c.sha1)))
+	entries.WithLabelValues(RuleAssetID).Set(float64(len(c.assetIDs)))
+	return nil
+}
+
+func compile(rules Rules) (*compiled, error) {
+	c := &compiled{
+		md5:      toSet(rules.MD5),
+		sha1:     toSet(rules.SHA1),
+		assetIDs: toSet(rules.AssetIDs),
+	}
+	for _, p := range rules.URLPrefixes {
+		u, err := url.Parse(strings.TrimSpace(p))
+		if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return nil, errors.Errorf("invalid URL prefix %q", p)
+		}
+		c.urlPrefixes = append(c.urlPrefixes, prefix{
+			scheme: strings.ToLower(u.Scheme),
+			host:   hostPort(u),
+			path:   strings.TrimSuffix(cleanPath(u.EscapedPath()), "/"),
+		})
+	}
+	for _, h := range rules.Hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if _, err := path.Match(h, ""); err != nil || h == "" {
+			return nil, errors.Errorf("invalid host pattern %q", h)
+		}
+		c.hosts = append(c.hosts, h)
+	}
+	return c, nil
+}
+
+func (l *List) current() *compiled {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.rules
+}
+
+// MatchRequest reports whether the scan request can be skipped before hashing
+// based on its URL, host or product asset ID, and which rule kind matched. Only
+// these rules save the hasher call.
+func (l *List) MatchRequest(req *types.ScanRequest) (string, bool) {
+	c := l.current()
+	if _, ok := c.assetIDs[strings.ToLower(req.AssetID)]; ok && req.AssetID != "" {
+		return l.skip(RuleAssetID, req.Product)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.User != nil {
+		return "", false
+	}
+	for _, p := range c.urlPrefixes {
+		if p.match(u) {
+			return l.skip(RuleURLPrefix, req.Product)
+		}
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range c.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return l.skip(RuleHost, req.Product)
+		}
+	}
+	return "", false
+}
+
+// MatchHashes reports whether hashed content is known-benign by digest,
+// and which rule kind matched. The hasher has already been called, so matches
+// are counted apart from the skipped scans.
+func (l *List) MatchHashes(product string, hashes types.Hashes) (string, bool) {
+	c := l.current()
+	if _, ok := c.md5[strings.ToLower(hashes.MD5)]; ok && hashes.MD5 != "" {
+		matchedAfterHash.WithLabelValues(RuleMD5, product).Inc()
+		return RuleMD5, true
+	}
+	if _, ok := c.sha1[strings.ToLower(hashes.SHA1)]; ok && hashes.SHA1 != "" {
+		matchedAfterHash.WithLabelValues(RuleSHA1, product).Inc()
+		return RuleSHA1, true
+	}
+	return "", false
+}
+
+func (l *List) skip(rule string, product string) (string, bool) {
+	skipped.WithLabelValues(rule, product).Inc()
+	return rule, true
+}
+
+// ServeHTTP reports the number of loaded entries on GET and reloads the
+// allowlist file on POST.
+func (l *List) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := l.Reload(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := l.current()
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int{
+		RuleURLPrefix: len(c.urlPrefixes),
+		RuleHost:      len(c.hosts),
+		RuleMD5:       len(c.md5),
+		RuleSHA1:      len(c.sha1),
+		RuleAssetID:   len(c.assetIDs),
+	})
+}
+
+// prefix is a parsed URL prefix rule. Its path has no trailing slash and only
+// matches whole path segments.
+type prefix struct {
+	scheme string
+	host   string
+	path   string
+}
+
+// match reports whether u is under the prefix. The scheme and host must be
+// equal and the path, with dot segments resolved both as sent and decoded,
+// must be the prefix path or below it.
+func (p prefix) match(u *url.URL) bool {
+	if strings.ToLower(u.Scheme) != p.scheme || hostPort(u) != p.host {
+		return false
+	}
+	for _, s := range []string{u.EscapedPath(), u.Path} {
+		s = cleanPath(s)
+		if s != p.path && !strings.HasPrefix(s, p.path+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// hostPort returns the lower-cased host of u, with its port unless it is the
+// default port of the scheme.
+func hostPort(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	switch {
+	case port == "",
+		port == "80" && strings.EqualFold(u.Scheme, "http"),
+		port == "443" && strings.EqualFold(u.Scheme, "https"):
+		return host
+	}
+	return host + ":" + port
+}
+
+// cleanPath returns the absolute form of the URL path p with dot segments
+// resolved.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[strings.ToLower(strings.TrimSpace(v))] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,72 @@
+package allowlist
+
+import (
+	"testing"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+func TestMatchRequest(t *testing.T) {
+	l, err := New(Rules{
+		URLPrefixes: []string{"https://img1.wsimg.com/isteam/stock/", "https://cdn.example.com"},
+		Hosts:       []string{"*.themes.example.com"},
+		AssetIDs:    []string{"Stock-123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		Request types.ScanRequest
+		Rule    string
+		Match   bool
+	}{
+		{types.ScanRequest{URL: "https://img1.wsimg.com/isteam/stock/abc.jpg"}, RuleURLPrefix, true},
+		{types.ScanRequest{URL: "https://img1.wsimg.com/isteam/ip/abc.jpg"}, "", false},
+		{types.ScanRequest{URL: "HTTPS://IMG1.wsimg.com:443/isteam/stock/abc.jpg"}, RuleURLPrefix, true},
+		{types.ScanRequest{URL: "https://img1.wsimg.com/isteam/stockpile/abc.jpg"}, "", false},
+		{types.ScanRequest{URL: "https://img1.wsimg.com/isteam/stock/../ip/abc.jpg"}, "", false},
+		{types.ScanRequest{URL: "https://img1.wsimg.com/isteam/stock/%2e%2e/ip/abc.jpg"}, "", false},
+		{types.ScanRequest{URL: "http://img1.wsimg.com/isteam/stock/abc.jpg"}, "", false},
+		{types.ScanRequest{URL: "https://img1.wsimg.com:8443/isteam/stock/abc.jpg"}, "", false},
+		{types.ScanRequest{URL: "https://cdn.example.com/x.jpg"}, RuleURLPrefix, true},
+		{types.ScanRequest{URL: "https://cdn.example.com.attacker.net/x.jpg"}, "", false},
+		{types.ScanRequest{URL: "https://cdn.example.com@attacker.net/x.jpg"}, "", false},
+		{types.ScanRequest{URL: "https://user@cdn.example.com/x.jpg"}, "", false},
+		{types.ScanRequest{URL: "https://cdn.THEMES.example.com/a.png"}, RuleHost, true},
+		{types.ScanRequest{URL: "https://themes.example.com/a.png"}, "", false},
+		{types.ScanRequest{URL: "https://example.org/a.png", AssetID: "stock-123"}, RuleAssetID, true},
+	}
+	for _, tc := range testCases {
+		rule, ok := l.MatchRequest(&tc.Request)
+		if ok != tc.Match || rule != tc.Rule {
+			t.Errorf("%s: expected (%q, %t). Obtained (%q, %t)", tc.Request.URL, tc.Rule, tc.Match, rule, ok)
+		}
+	}
+}
+
+func TestMatchHashes(t *testing.T) {
+	l, err := New(Rules{MD5: []string{"D41D8CD98F00B204E9800998ECF8427E"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule, ok := l.MatchHashes("websites", types.Hashes{MD5: "d41d8cd98f00b204e9800998ecf8427e"}); !ok || rule != RuleMD5 {
+		t.Errorf("Expected MD5 match. Obtained (%q, %t)", rule, ok)
+	}
+	if _, ok := l.MatchHashes("websites", types.Hashes{}); ok {
+		t.Error("Expected empty hashes not to match")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (Rules{Hosts: []string{"[a-"}}).Validate(); err == nil {
+		t.Error("Expected an error for an invalid host pattern")
+	}
+	for _, p := range []string{"img1.wsimg.com/stock/", "https://user@img1.wsimg.com/", "https://img1.wsimg.com/?a=1"} {
+		if err := (Rules{URLPrefixes: []string{p}}).Validate(); err == nil {
+			t.Errorf("Expected an error for URL prefix %q", p)
+		}
+	}
+	if err := (Rules{URLPrefixes: []string{"https://img1.wsimg.com/"}, Hosts: []string{"*.wsimg.com"}}).Validate(); err != nil {
+		t.Errorf("Expected valid rules. Obtained %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package amqptest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"#.dev", "scan.dev", true},
+		{"#.dev", "dev", true},
+		{"#.dev", "a.b.dev", true},
+		{"#.dev", "scan.prod", false},
+		{"#.dev-v2", "#.dev-v2", true},
+		{"*.dev", "scan.dev", true},
+		{"*.dev", "dev", false},
+		{"*.dev", "a.b.dev", false},
+		{"#", "", true},
+		{"#", "a.b", true},
+		{"a.#.b", "a.b", true},
+		{"a.#.b", "a.x.y.b", true},
+		{"a.*.b", "a.b", false},
+		{"a.b", "a.b", true},
+		{"a.b", "a.b.c", false},
+	}
+	for _, tt := range tests {
+		if m := topicMatch(strings.Split(tt.pattern, "."), strings.Split(tt.key, ".")); m != tt.match {
+			t.Errorf("Expected %s matching %s to be %v. Obtained %v", tt.pattern, tt.key, tt.match, m)
+		}
+	}
+}
+
+func newServer(t *testing.T) (*Server, *amqp.Connection, *amqp.Channel) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	conn, err := amqp.Dial(s.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, conn, ch
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatal("Expected a delivery. Obtained a closed channel")
+		}
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a delivery. Obtained none")
+	}
+	return amqp.Delivery{}
+}
+
+func TestRoundTrip(t *testing.T) {
+	s, _, ch := newServer(t)
+	if err := ch.ExchangeDeclare("scans", Topic, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	q, err := ch.QueueDeclare("scans-dev", true, false, false, false, amqp.Table{"x-queue-type": "quorum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(q.Name, "#.dev", "scans", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 3))
+	var published []string
+	var settled []Settlement
+	s.OnPublish(func(m Message) { published = append(published, m.RoutingKey) })
+	s.OnSettle(func(st Settlement) { settled = append(settled, st) })
+
+	body := []byte(strings.Repeat("x", 3*frameMax))
+	for _, key := range []string{"a.dev", "a.prod", "b.dev"} {
+		msg := amqp.Publishing{Headers: amqp.Table{"x-key": key, "x-count": int32(1)}, ContentType: "application/json", Priority: 3, Body: body}
+		if err := ch.Publish("scans", key, false, false, msg); err != nil {
+			t.Fatal(err)
+		}
+		if c := <-confirms; !c.Ack {
+			t.Fatalf("Expected publish to %s to be confirmed. Obtained %+v", key, c)
+		}
+	}
+
+	deliveries, err := ch.Consume(q.Name, "test", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := receive(t, deliveries)
+	if first.RoutingKey != "a.dev" || first.Headers["x-key"] != "a.dev" || first.Priority != 3 || len(first.Body) != len(body) || first.Redelivered {
+		t.Errorf("Expected the a.dev message. Obtained %s %v %d %d bytes", first.RoutingKey, first.Headers, first.Priority, len(first.Body))
+	}
+	select {
+	case d := <-deliveries:
+		t.Fatalf("Expected prefetch to hold back the second message. Obtained %s", d.RoutingKey)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := first.Reject(true); err != nil {
+		t.Fatal(err)
+	}
+	again := receive(t, deliveries)
+	if again.RoutingKey != "a.dev" || !again.Redelivered {
+		t.Errorf("Expected the rejected message to be redelivered. Obtained %s %v", again.RoutingKey, again.Redelivered)
+	}
+	again.Ack(false)
+	second := receive(t, deliveries)
+	if second.RoutingKey != "b.dev" {
+		t.Errorf("Expected the b.dev message. Obtained %s", second.RoutingKey)
+	}
+	if n := s.Unacked(q.Name); n != 1 {
+		t.Errorf("Expected 1 unacked message. Obtained %d", n)
+	}
+	second.Nack(false, false)
+	if err := ch.Cancel("test", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-deliveries; ok {
+		t.Error("Expected the deliveries to be closed after cancel")
+	}
+	if messages, _ := s.Messages(q.Name); len(messages) != 0 || s.Unacked(q.Name) != 0 || s.Consumers(q.Name) != 0 {
+		t.Errorf("Expected an empty queue without consumers. Obtained %d messages", len(messages))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(published) != 3 {
+		t.Errorf("Expected 3 published messages. Obtained %v", published)
+	}
+	want := []bool{true, false, false}
+	if len(settled) != len(want) {
+		t.Fatalf("Expected %d settlements. Obtained %+v", len(want), settled)
+	}
+	for i, st := range settled {
+		if st.Queue != q.Name || st.Requeued != want[i] {
+			t.Errorf("Expected settlement %d of %s with requeued %v. Obtained %s %v", i+1, q.Name, want[i], st.Queue, st.Requeued)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	_, _, ch := newServer(t)
+	q, err := ch.QueueDeclare("", false, false, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := ch.Publish("", q.Name, false, false, amqp.Publishing{Body: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// count receives deliveries until none arrives for a while.
+	count := func(deliveries <-chan amqp.Delivery) int {
+		n := 0
+		for {
+			select {
+			case <-deliveries:
+				n++
+			case <-time.After(50 * time.Millisecond):
+				return n
+			}
+		}
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Consume(q.Name, "test", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(deliveries); n != 1 {
+		t.Fatalf("Expected 1 delivery under prefetch 1. Obtained %d", n)
+	}
+	if err := ch.Qos(3, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(deliveries); n != 0 {
+		t.Errorf("Expected the prefetch of the existing consumer to be kept. Obtained %d more deliveries", n)
+	}
+	if err := ch.Cancel("test", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Recover(true); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries, err = ch.Consume(q.Name, "test", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(deliveries); n != 3 {
+		t.Errorf("Expected 3 deliveries to a new consumer under prefetch 3. Obtained %d", n)
+	}
+	if err := ch.Qos(2, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Cancel("test", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Recover(true); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries, err = ch.Consume(q.Name, "test", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(deliveries); n != 2 {
+		t.Errorf("Expected 2 deliveries under a global prefetch of 2. Obtained %d", n)
+	}
+}
+
+func TestChannelErrors(t *testing.T) {
+	s, conn, ch := newServer(t)
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	if _, err := ch.QueueDeclarePassive("missing", true, false, false, false, nil); err == nil {
+		t.Fatal("Expected a passive declare of a missing queue to fail")
+	}
+	if err := <-closed; err == nil || err.Code != amqp.NotFound {
+		t.Errorf("Expected the channel to be closed with %d. Obtained %v", amqp.NotFound, err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	closed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	s.NackPublishes("amq.topic", true)
+	ch.Publish("amq.topic", "a", false, false, amqp.Publishing{})
+	if c := <-confirms; c.Ack {
+		t.Error("Expected the publish to be nacked")
+	}
+	ch.Publish("missing", "a", false, false, amqp.Publishing{})
+	if err := <-closed; err == nil || err.Code != amqp.NotFound {
+		t.Errorf("Expected publishing to a missing exchange to close the channel with %d. Obtained %v", amqp.NotFound, err)
+	}
+
+	s.DeclareQueue("held")
+	if _, err := s.Publish("", "held", amqp.Publishing{Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	ch, err = conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok, err := ch.Get("held", false)
+	if err != nil || !ok || string(d.Body) != "a" {
+		t.Fatalf("Expected to get the message. Obtained %v %v %q", ok, err, d.Body)
+	}
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	s.CloseConnections()
+	if err := <-connClosed; err == nil || err.Code != amqp.ConnectionForced {
+		t.Errorf("Expected the connection to be closed with %d. Obtained %v", amqp.ConnectionForced, err)
+	}
+	messages, err := s.WaitMessages("held", 1, time.Second)
+	if err != nil || !messages[0].Redelivered {
+		t.Errorf("Expected the unacked message to be requeued. Obtained %+v %v", messages, err)
+	}
+}
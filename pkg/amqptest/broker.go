@@ -0,0 +1,219 @@
+package amqptest
+
+import (
+	"strings"
+)
+
+// Exchange types the server routes.
+const (
+	Direct = "direct"
+	Fanout = "fanout"
+	Topic  = "topic"
+)
+
+// message is a published message. Properties are kept encoded as published.
+type message struct {
+	exchange    string
+	key         string
+	properties  []byte
+	body        []byte
+	redelivered bool
+}
+
+type binding struct {
+	queue string
+	key   string
+}
+
+type exchange struct {
+	name     string
+	kind     string
+	bindings []binding
+}
+
+// routes returns the names of the queues a message published with key is routed to.
+func (x *exchange) routes(key string) []string {
+	var queues []string
+	seen := map[string]bool{}
+	for _, b := range x.bindings {
+		if seen[b.queue] {
+			continue
+		}
+		var match bool
+		switch x.kind {
+		case Fanout:
+			match = true
+		case Direct:
+			match = b.key == key
+		case Topic:
+			match = topicMatch(strings.Split(b.key, "."), strings.Split(key, "."))
+		}
+		if match {
+			seen[b.queue] = true
+			queues = append(queues, b.queue)
+		}
+	}
+	return queues
+}
+
+// topicMatch matches the words of a routing key against the words of a topic
+// binding key, where * matches a single word and # zero or more words.
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+}
+
+type consumer struct {
+	tag     string
+	ch      *channel
+	queue   *queue
+	noAck   bool
+	unacked int
+
+	// Per-consumer prefetch limit of the channel when the consumer was created
+	prefetch int
+}
+
+type queue struct {
+	name       string
+	exclusive  *conn
+	autoDelete bool
+	messages   []*message
+	consumers  []*consumer
+
+	// Index of the consumer the next message is offered to first
+	next int
+}
+
+func (q *queue) removeConsumer(c *consumer) {
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			return
+		}
+	}
+}
+
+// pending is a message delivered to a channel and not settled yet.
+type pending struct {
+	queue    *queue
+	consumer *consumer
+	msg      *message
+}
+
+// available reports whether c may be sent another message under its own
+// prefetch limit and the global one of its channel.
+func (c *consumer) available() bool {
+	ch := c.ch
+	switch {
+	case ch.closing:
+		return false
+	case c.noAck:
+		return true
+	case ch.prefetchGlobal > 0 && len(ch.unacked) >= ch.prefetchGlobal:
+		return false
+	}
+	return c.prefetch == 0 || c.unacked < c.prefetch
+}
+
+// dispatch delivers the ready messages of q to its consumers in turn. It must be
+// called with the server lock held.
+func (s *Server) dispatch(q *queue) {
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+		var c *consumer
+		for i := 0; i < len(q.consumers); i++ {
+			candidate := q.consumers[(q.next+i)%len(q.consumers)]
+			if candidate.available() {
+				c = candidate
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		tag := c.ch.track(q, c, msg, c.noAck)
+		c.ch.conn.sendContent(c.ch.id, newMethod(classBasic, methodBasicDeliver).
+			shortstr(c.tag).
+			longlong(tag).
+			bit(msg.redelivered).
+			shortstr(msg.exchange).
+			shortstr(msg.key).
+			bytes(), msg)
+	}
+}
+
+// requeue puts messages back at the head of their queues, marked as redelivered.
+// It must be called with the server lock held.
+func (s *Server) requeue(settled []pending) {
+	s.notifySettled(settled, true)
+	queues := map[*queue]bool{}
+	for i := len(settled) - 1; i >= 0; i-- {
+		p := settled[i]
+		msg := *p.msg
+		msg.redelivered = true
+		if s.queues[p.queue.name] != p.queue {
+			continue
+		}
+		p.queue.messages = append([]*message{&msg}, p.queue.messages...)
+		queues[p.queue] = true
+	}
+	for q := range queues {
+		s.dispatch(q)
+	}
+}
+
+// route enqueues msg on the queues its exchange routes it to and returns their
+// number. It must be called with the server lock held.
+func (s *Server) route(msg *message) int {
+	var names []string
+	if msg.exchange == "" {
+		if _, ok := s.queues[msg.key]; ok {
+			names = []string{msg.key}
+		}
+	} else {
+		names = s.exchanges[msg.exchange].routes(msg.key)
+	}
+	for _, name := range names {
+		q := s.queues[name]
+		copied := *msg
+		q.messages = append(q.messages, &copied)
+		s.dispatch(q)
+	}
+	return len(names)
+}
+
+// deleteQueue deletes q, cancelling its consumers and removing its bindings.
+// It must be called with the server lock held.
+func (s *Server) deleteQueue(q *queue) int {
+	for _, c := range q.consumers {
+		delete(c.ch.consumers, c.tag)
+		c.ch.conn.send(c.ch.id, newMethod(classBasic, methodBasicCancel).shortstr(c.tag).bit(true).bytes())
+	}
+	for _, x := range s.exchanges {
+		bindings := x.bindings[:0]
+		for _, b := range x.bindings {
+			if b.queue != q.name {
+				bindings = append(bindings, b)
+			}
+		}
+		x.bindings = bindings
+	}
+	delete(s.queues, q.name)
+	return len(q.messages)
+}
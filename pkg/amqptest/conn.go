@@ -0,0 +1,825 @@
+package amqptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Classes and methods of AMQP 0-9-1 the server handles or sends.
+const (
+	classConnection = 10
+	classChannel    = 20
+	classExchange   = 40
+	classQueue      = 50
+	classBasic      = 60
+	classConfirm    = 85
+
+	methodConnectionStart   = 10
+	methodConnectionStartOk = 11
+	methodConnectionTune    = 30
+	methodConnectionTuneOk  = 31
+	methodConnectionOpen    = 40
+	methodConnectionOpenOk  = 41
+	methodConnectionClose   = 50
+	methodConnectionCloseOk = 51
+
+	methodChannelOpen    = 10
+	methodChannelOpenOk  = 11
+	methodChannelFlow    = 20
+	methodChannelFlowOk  = 21
+	methodChannelClose   = 40
+	methodChannelCloseOk = 41
+
+	methodExchangeDeclare   = 10
+	methodExchangeDeclareOk = 11
+	methodExchangeDelete    = 20
+	methodExchangeDeleteOk  = 21
+
+	methodQueueDeclare   = 10
+	methodQueueDeclareOk = 11
+	methodQueueBind      = 20
+	methodQueueBindOk    = 21
+	methodQueuePurge     = 30
+	methodQueuePurgeOk   = 31
+	methodQueueDelete    = 40
+	methodQueueDeleteOk  = 41
+	methodQueueUnbind    = 50
+	methodQueueUnbindOk  = 51
+
+	methodBasicQos       = 10
+	methodBasicQosOk     = 11
+	methodBasicConsume   = 20
+	methodBasicConsumeOk = 21
+	methodBasicCancel    = 30
+	methodBasicCancelOk  = 31
+	methodBasicPublish   = 40
+	methodBasicReturn    = 50
+	methodBasicDeliver   = 60
+	methodBasicGet       = 70
+	methodBasicGetOk     = 71
+	methodBasicGetEmpty  = 72
+	methodBasicAck       = 80
+	methodBasicReject    = 90
+	methodBasicRecover   = 110
+	methodBasicRecoverOk = 111
+	methodBasicNack      = 120
+
+	methodConfirmSelect   = 10
+	methodConfirmSelectOk = 11
+)
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// conn is a client connection. Frames are read and handled by serve with the
+// server lock held, and written by a separate goroutine from an unbounded
+// queue so that sending never blocks while holding the lock.
+type conn struct {
+	s        *Server
+	nc       net.Conn
+	channels map[uint16]*channel
+	frameMax int
+	closing  bool
+
+	outMu   sync.Mutex
+	outCond *sync.Cond
+	out     [][]byte
+	done    bool
+	stop    chan struct{}
+}
+
+// channel is an open channel of a connection.
+type channel struct {
+	id        uint16
+	conn      *conn
+	consumers map[string]*consumer
+	unacked   map[uint64]pending
+	nextTag   uint64
+	closing   bool
+
+	// Prefetch limits as RabbitMQ interprets basic.qos: the per-consumer limit
+	// applies to consumers created after it is set, the global one is shared
+	// by all consumers of the channel.
+	prefetch       int
+	prefetchGlobal int
+
+	confirm    bool
+	publishSeq uint64
+	publishing *publishing
+}
+
+// publishing is a message being received in a method, header and body frames.
+type publishing struct {
+	exchange   string
+	key        string
+	mandatory  bool
+	size       uint64
+	properties []byte
+	body       []byte
+	header     bool
+}
+
+// amqpError is a channel or connection exception.
+type amqpError struct {
+	code   uint16
+	text   string
+	class  uint16
+	method uint16
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	c := &conn{
+		s:        s,
+		nc:       nc,
+		channels: map[uint16]*channel{},
+		frameMax: frameMax,
+		stop:     make(chan struct{}),
+	}
+	c.outCond = sync.NewCond(&c.outMu)
+	return c
+}
+
+func (c *conn) serve(r *bufio.Reader) {
+	go c.write()
+	defer c.cleanup()
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		c.shutdown()
+		return
+	}
+	if string(hdr[:]) != string(protocolHeader) {
+		c.sendRaw(protocolHeader)
+		c.shutdown()
+		return
+	}
+	c.send(0, newMethod(classConnection, methodConnectionStart).
+		octet(0).
+		octet(9).
+		table(amqp.Table{
+			"product": "hashserve amqptest",
+			"capabilities": amqp.Table{
+				"publisher_confirms":     true,
+				"consumer_cancel_notify": true,
+				"basic.nack":             true,
+			},
+		}).
+		longstr([]byte("PLAIN AMQPLAIN")).
+		longstr([]byte("en_US")).
+		bytes())
+
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			c.shutdown()
+			return
+		}
+		c.s.mu.Lock()
+		c.handle(f)
+		c.s.mu.Unlock()
+	}
+}
+
+// cleanup releases what the connection holds once it is gone: unacknowledged
+// messages are requeued and exclusive queues deleted.
+func (c *conn) cleanup() {
+	c.shutdown()
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	for _, ch := range c.channels {
+		ch.release()
+	}
+	c.channels = map[uint16]*channel{}
+	for _, q := range c.s.queues {
+		if q.exclusive == c {
+			c.s.deleteQueue(q)
+		}
+	}
+	delete(c.s.conns, c)
+}
+
+func (c *conn) handle(f frame) {
+	if c.closing {
+		if f.typ == frameMethod && f.channel == 0 {
+			if d := newDecoder(f.payload); d.short() == classConnection && d.short() == methodConnectionCloseOk {
+				c.shutdown()
+			}
+		}
+		return
+	}
+	switch f.typ {
+	case frameHeartbeat:
+		return
+	case frameMethod:
+		d := newDecoder(f.payload)
+		class, method := d.short(), d.short()
+		if f.channel == 0 {
+			c.connectionMethod(class, method, d)
+			return
+		}
+		ch, ok := c.channels[f.channel]
+		if !ok {
+			if class == classChannel && method == methodChannelOpen {
+				c.channels[f.channel] = &channel{
+					id:        f.channel,
+					conn:      c,
+					consumers: map[string]*consumer{},
+					unacked:   map[uint64]pending{},
+				}
+				c.send(f.channel, newMethod(classChannel, methodChannelOpenOk).longstr(nil).bytes())
+				return
+			}
+			c.connectionError(amqp.ChannelError, fmt.Sprintf("CHANNEL_ERROR - expected 'channel.open' on channel %d", f.channel), class, method)
+			return
+		}
+		if ch.publishing != nil {
+			c.connectionError(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - expected content", class, method)
+			return
+		}
+		if ch.closing {
+			switch {
+			case class == classChannel && method == methodChannelClose:
+				c.send(ch.id, newMethod(classChannel, methodChannelCloseOk).bytes())
+				delete(c.channels, ch.id)
+			case class == classChannel && method == methodChannelCloseOk:
+				delete(c.channels, ch.id)
+			}
+			return
+		}
+		if err := ch.method(class, method, d); err != nil {
+			ch.fail(err)
+		}
+	case frameHeader, frameBody:
+		ch, ok := c.channels[f.channel]
+		if ok && ch.closing {
+			return
+		}
+		if !ok || ch.publishing == nil {
+			c.connectionError(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - unexpected content frame", 0, 0)
+			return
+		}
+		if err := ch.content(f); err != nil {
+			ch.fail(err)
+		}
+	default:
+		c.connectionError(amqp.FrameError, fmt.Sprintf("FRAME_ERROR - unknown frame type %d", f.typ), 0, 0)
+	}
+}
+
+func (c *conn) connectionMethod(class, method uint16, d *decoder) {
+	if class != classConnection {
+		c.connectionError(amqp.CommandInvalid, "COMMAND_INVALID - unexpected method on channel 0", class, method)
+		return
+	}
+	switch method {
+	case methodConnectionStartOk:
+		c.send(0, newMethod(classConnection, methodConnectionTune).
+			short(2047).
+			long(frameMax).
+			short(0).
+			bytes())
+	case methodConnectionTuneOk:
+		d.short()
+		if size := int(d.long()); size > 0 && size < c.frameMax {
+			c.frameMax = size
+		}
+		if heartbeat := d.short(); heartbeat > 0 {
+			go c.heartbeat(time.Duration(heartbeat) * time.Second)
+		}
+	case methodConnectionOpen:
+		c.send(0, newMethod(classConnection, methodConnectionOpenOk).shortstr("").bytes())
+	case methodConnectionClose:
+		c.send(0, newMethod(classConnection, methodConnectionCloseOk).bytes())
+		c.shutdown()
+	case methodConnectionCloseOk:
+		c.shutdown()
+	default:
+		c.connectionError(amqp.NotImplemented, fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d", class, method), class, method)
+	}
+}
+
+// connectionError closes the connection with a connection exception. It must
+// be called with the server lock held.
+func (c *conn) connectionError(code uint16, text string, class, method uint16) {
+	if c.closing {
+		return
+	}
+	c.closing = true
+	c.send(0, newMethod(classConnection, methodConnectionClose).
+		short(code).
+		shortstr(text).
+		short(class).
+		short(method).
+		bytes())
+	// Wait briefly for Close-Ok, which shuts the connection down earlier.
+	time.AfterFunc(time.Second, c.shutdown)
+}
+
+func (c *conn) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.sendRaw(frame{typ: frameHeartbeat}.encode())
+		}
+	}
+}
+
+func (c *conn) write() {
+	defer c.nc.Close()
+	for {
+		c.outMu.Lock()
+		for len(c.out) == 0 && !c.done {
+			c.outCond.Wait()
+		}
+		out, done := c.out, c.done
+		c.out = nil
+		c.outMu.Unlock()
+		for _, b := range out {
+			if _, err := c.nc.Write(b); err != nil {
+				return
+			}
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// shutdown closes the network connection once queued frames were written.
+func (c *conn) shutdown() {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if !c.done {
+		c.done = true
+		close(c.stop)
+		c.outCond.Broadcast()
+	}
+}
+
+func (c *conn) sendRaw(b ...[]byte) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if !c.done {
+		c.out = append(c.out, b...)
+		c.outCond.Broadcast()
+	}
+}
+
+// send sends a method frame.
+func (c *conn) send(ch uint16, method []byte) {
+	c.sendRaw(frame{typ: frameMethod, channel: ch, payload: method}.encode())
+}
+
+// sendContent sends a method frame followed by the content of msg.
+func (c *conn) sendContent(ch uint16, method []byte, msg *message) {
+	header := (&encoder{}).
+		short(classBasic).
+		short(0).
+		longlong(uint64(len(msg.body))).
+		bytes()
+	// The property flags and list are sent as published.
+	frames := [][]byte{
+		frame{typ: frameMethod, channel: ch, payload: method}.encode(),
+		frame{typ: frameHeader, channel: ch, payload: append(header, msg.properties...)}.encode(),
+	}
+	for body, max := msg.body, c.frameMax-8; len(body) > 0; {
+		n := len(body)
+		if n > max {
+			n = max
+		}
+		frames = append(frames, frame{typ: frameBody, channel: ch, payload: body[:n]}.encode())
+		body = body[n:]
+	}
+	c.sendRaw(frames...)
+}
+
+// fail closes the channel with a channel exception.
+func (ch *channel) fail(err *amqpError) {
+	ch.release()
+	ch.closing = true
+	ch.conn.send(ch.id, newMethod(classChannel, methodChannelClose).
+		short(err.code).
+		shortstr(err.text).
+		short(err.class).
+		short(err.method).
+		bytes())
+}
+
+// release cancels the consumers of the channel and requeues its
+// unacknowledged messages.
+func (ch *channel) release() {
+	ch.closing = true
+	ch.publishing = nil
+	for _, c := range ch.consumers {
+		ch.cancel(c)
+	}
+	ch.conn.s.requeue(ch.settle(0, true))
+}
+
+func (ch *channel) cancel(c *consumer) {
+	delete(ch.consumers, c.tag)
+	c.queue.removeConsumer(c)
+	if c.queue.autoDelete && len(c.queue.consumers) == 0 && ch.conn.s.queues[c.queue.name] == c.queue {
+		ch.conn.s.deleteQueue(c.queue)
+	}
+}
+
+// track records a message delivered on the channel and returns its delivery tag.
+func (ch *channel) track(q *queue, c *consumer, msg *message, noAck bool) uint64 {
+	ch.nextTag++
+	if !noAck {
+		ch.unacked[ch.nextTag] = pending{queue: q, consumer: c, msg: msg}
+		if c != nil {
+			c.unacked++
+		}
+	}
+	return ch.nextTag
+}
+
+// settle removes and returns the unacknowledged messages up to tag when
+// multiple is set, or tag alone otherwise, in delivery order. A tag of zero
+// with multiple settles every message.
+func (ch *channel) settle(tag uint64, multiple bool) []pending {
+	var tags []uint64
+	for t := range ch.unacked {
+		if t == tag || (multiple && (tag == 0 || t <= tag)) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	settled := make([]pending, 0, len(tags))
+	for _, t := range tags {
+		p := ch.unacked[t]
+		delete(ch.unacked, t)
+		if p.consumer != nil {
+			p.consumer.unacked--
+		}
+		settled = append(settled, p)
+	}
+	return settled
+}
+
+func notFound(kind, name string, class, method uint16) *amqpError {
+	return &amqpError{amqp.NotFound, fmt.Sprintf("NOT_FOUND - no %s '%s' in vhost '/'", kind, name), class, method}
+}
+
+func (ch *channel) queue(name string, class, method uint16) (*queue, *amqpError) {
+	q, ok := ch.conn.s.queues[name]
+	if !ok {
+		return nil, notFound("queue", name, class, method)
+	}
+	if q.exclusive != nil && q.exclusive != ch.conn {
+		return nil, &amqpError{amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", name), class, method}
+	}
+	return q, nil
+}
+
+func (ch *channel) method(class, method uint16, d *decoder) *amqpError {
+	s := ch.conn.s
+	reply := func(m *encoder) {
+		ch.conn.send(ch.id, m.bytes())
+	}
+	switch {
+	case class == classChannel && method == methodChannelClose:
+		ch.release()
+		reply(newMethod(classChannel, methodChannelCloseOk))
+		delete(ch.conn.channels, ch.id)
+	case class == classChannel && method == methodChannelFlow:
+		reply(newMethod(classChannel, methodChannelFlowOk).bit(d.bit()))
+
+	case class == classExchange && method == methodExchangeDeclare:
+		d.short()
+		name, kind := d.shortstr(), d.shortstr()
+		passive := d.bit()
+		d.bit()
+		d.bit()
+		d.bit()
+		noWait := d.bit()
+		d.table()
+		x, ok := s.exchanges[name]
+		switch {
+		case !ok && !passive && (name == "" || strings.HasPrefix(name, "amq.")):
+			return &amqpError{amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name), class, method}
+		case passive && !ok:
+			return notFound("exchange", name, class, method)
+		case ok && !passive && x.kind != kind:
+			return &amqpError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s' in vhost '/': received '%s' but current is '%s'", name, kind, x.kind), class, method}
+		case !ok:
+			if kind != Direct && kind != Fanout && kind != Topic {
+				ch.conn.connectionError(amqp.CommandInvalid, fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind), class, method)
+				return nil
+			}
+			s.exchanges[name] = &exchange{name: name, kind: kind}
+		}
+		if !noWait {
+			reply(newMethod(classExchange, methodExchangeDeclareOk))
+		}
+	case class == classExchange && method == methodExchangeDelete:
+		d.short()
+		name := d.shortstr()
+		d.bit()
+		noWait := d.bit()
+		if name == "" {
+			return &amqpError{amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange", class, method}
+		}
+		delete(s.exchanges, name)
+		if !noWait {
+			reply(newMethod(classExchange, methodExchangeDeleteOk))
+		}
+
+	case class == classQueue && method == methodQueueDeclare:
+		d.short()
+		name := d.shortstr()
+		passive := d.bit()
+		d.bit()
+		exclusive, autoDelete, noWait := d.bit(), d.bit(), d.bit()
+		d.table()
+		q, err := ch.queue(name, class, method)
+		if err != nil && (passive || err.code != amqp.NotFound) {
+			return err
+		}
+		if q == nil {
+			if name == "" {
+				name = s.generateName("amq.gen")
+			}
+			q = &queue{name: name, autoDelete: autoDelete}
+			if exclusive {
+				q.exclusive = ch.conn
+			}
+			s.queues[name] = q
+		}
+		if !noWait {
+			reply(newMethod(classQueue, methodQueueDeclareOk).
+				shortstr(q.name).
+				long(uint32(len(q.messages))).
+				long(uint32(len(q.consumers))))
+		}
+	case class == classQueue && method == methodQueueBind:
+		d.short()
+		name, exchange, key := d.shortstr(), d.shortstr(), d.shortstr()
+		noWait := d.bit()
+		d.table()
+		if _, err := ch.queue(name, class, method); err != nil {
+			return err
+		}
+		if exchange == "" {
+			return &amqpError{amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange", class, method}
+		}
+		if _, ok := s.exchanges[exchange]; !ok {
+			return notFound("exchange", exchange, class, method)
+		}
+		s.bind(name, exchange, key)
+		if !noWait {
+			reply(newMethod(classQueue, methodQueueBindOk))
+		}
+	case class == classQueue && method == methodQueueUnbind:
+		d.short()
+		name, exchange, key := d.shortstr(), d.shortstr(), d.shortstr()
+		d.table()
+		if _, err := ch.queue(name, class, method); err != nil {
+			return err
+		}
+		if x, ok := s.exchanges[exchange]; ok {
+			for i, b := range x.bindings {
+				if b.queue == name && b.key == key {
+					x.bindings = append(x.bindings[:i], x.bindings[i+1:]...)
+					break
+				}
+			}
+		}
+		reply(newMethod(classQueue, methodQueueUnbindOk))
+	case class == classQueue && method == methodQueuePurge:
+		d.short()
+		name := d.shortstr()
+		noWait := d.bit()
+		q, err := ch.queue(name, class, method)
+		if err != nil {
+			return err
+		}
+		n := len(q.messages)
+		q.messages = nil
+		if !noWait {
+			reply(newMethod(classQueue, methodQueuePurgeOk).long(uint32(n)))
+		}
+	case class == classQueue && method == methodQueueDelete:
+		d.short()
+		name := d.shortstr()
+		ifUnused, ifEmpty, noWait := d.bit(), d.bit(), d.bit()
+		q, err := ch.queue(name, class, method)
+		if err != nil {
+			return err
+		}
+		if ifUnused && len(q.consumers) > 0 {
+			return &amqpError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name), class, method}
+		}
+		if ifEmpty && len(q.messages) > 0 {
+			return &amqpError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - queue '%s' in vhost '/' not empty", name), class, method}
+		}
+		n := s.deleteQueue(q)
+		if !noWait {
+			reply(newMethod(classQueue, methodQueueDeleteOk).long(uint32(n)))
+		}
+
+	case class == classBasic && method == methodBasicQos:
+		d.long()
+		prefetch := int(d.short())
+		if d.bit() {
+			ch.prefetchGlobal = prefetch
+		} else {
+			ch.prefetch = prefetch
+		}
+		reply(newMethod(classBasic, methodBasicQosOk))
+		ch.dispatch()
+	case class == classBasic && method == methodBasicConsume:
+		d.short()
+		name, tag := d.shortstr(), d.shortstr()
+		d.bit()
+		noAck, exclusive, noWait := d.bit(), d.bit(), d.bit()
+		d.table()
+		q, err := ch.queue(name, class, method)
+		if err != nil {
+			return err
+		}
+		if tag == "" {
+			tag = s.generateName("amq.ctag")
+		}
+		if _, ok := ch.consumers[tag]; ok {
+			ch.conn.connectionError(amqp.NotAllowed, fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", tag), class, method)
+			return nil
+		}
+		if exclusive && len(q.consumers) > 0 {
+			return &amqpError{amqp.AccessRefused, fmt.Sprintf("ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", name), class, method}
+		}
+		c := &consumer{tag: tag, ch: ch, queue: q, noAck: noAck, prefetch: ch.prefetch}
+		ch.consumers[tag] = c
+		q.consumers = append(q.consumers, c)
+		if !noWait {
+			reply(newMethod(classBasic, methodBasicConsumeOk).shortstr(tag))
+		}
+		s.dispatch(q)
+	case class == classBasic && method == methodBasicCancel:
+		tag := d.shortstr()
+		noWait := d.bit()
+		if c, ok := ch.consumers[tag]; ok {
+			ch.cancel(c)
+		}
+		if !noWait {
+			reply(newMethod(classBasic, methodBasicCancelOk).shortstr(tag))
+		}
+	case class == classBasic && method == methodBasicPublish:
+		d.short()
+		ch.publishing = &publishing{exchange: d.shortstr(), key: d.shortstr(), mandatory: d.bit()}
+		if ch.confirm {
+			ch.publishSeq++
+		}
+	case class == classBasic && method == methodBasicGet:
+		d.short()
+		name := d.shortstr()
+		noAck := d.bit()
+		q, err := ch.queue(name, class, method)
+		if err != nil {
+			return err
+		}
+		if len(q.messages) == 0 {
+			reply(newMethod(classBasic, methodBasicGetEmpty).shortstr(""))
+			return nil
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		tag := ch.track(q, nil, msg, noAck)
+		ch.conn.sendContent(ch.id, newMethod(classBasic, methodBasicGetOk).
+			longlong(tag).
+			bit(msg.redelivered).
+			shortstr(msg.exchange).
+			shortstr(msg.key).
+			long(uint32(len(q.messages))).
+			bytes(), msg)
+	case class == classBasic && method == methodBasicAck:
+		tag, multiple := d.longlong(), d.bit()
+		return ch.ack(tag, multiple, false, false, class, method)
+	case class == classBasic && method == methodBasicNack:
+		tag, multiple, requeue := d.longlong(), d.bit(), d.bit()
+		return ch.ack(tag, multiple, true, requeue, class, method)
+	case class == classBasic && method == methodBasicReject:
+		tag, requeue := d.longlong(), d.bit()
+		return ch.ack(tag, false, true, requeue, class, method)
+	case class == classBasic && method == methodBasicRecover:
+		d.bit()
+		s.requeue(ch.settle(0, true))
+		reply(newMethod(classBasic, methodBasicRecoverOk))
+
+	case class == classConfirm && method == methodConfirmSelect:
+		noWait := d.bit()
+		ch.confirm = true
+		if !noWait {
+			reply(newMethod(classConfirm, methodConfirmSelectOk))
+		}
+
+	default:
+		ch.conn.connectionError(amqp.NotImplemented, fmt.Sprintf("NOT_IMPLEMENTED - method %d.%d", class, method), class, method)
+	}
+	if d.err != nil {
+		ch.conn.connectionError(amqp.SyntaxError, "SYNTAX_ERROR - "+d.err.Error(), class, method)
+	}
+	return nil
+}
+
+// ack settles delivered messages, dropping or requeueing them when rejected.
+func (ch *channel) ack(tag uint64, multiple, rejected, requeue bool, class, method uint16) *amqpError {
+	if _, ok := ch.unacked[tag]; !ok && !(multiple && tag == 0) {
+		return &amqpError{amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag), class, method}
+	}
+	settled := ch.settle(tag, multiple)
+	if rejected && requeue {
+		ch.conn.s.requeue(settled)
+		return nil
+	}
+	ch.conn.s.notifySettled(settled, false)
+	ch.dispatch()
+	return nil
+}
+
+// dispatch offers ready messages to the consumers of the channel, which may
+// take more after a qos change or settlement.
+func (ch *channel) dispatch() {
+	queues := map[*queue]bool{}
+	for _, c := range ch.consumers {
+		queues[c.queue] = true
+	}
+	for q := range queues {
+		ch.conn.s.dispatch(q)
+	}
+}
+
+// content receives a content header or body frame of a published message and
+// routes the message once complete.
+func (ch *channel) content(f frame) *amqpError {
+	p := ch.publishing
+	if f.typ == frameHeader {
+		if p.header {
+			ch.conn.connectionError(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - unexpected content header", classBasic, methodBasicPublish)
+			return nil
+		}
+		d := newDecoder(f.payload)
+		d.short()
+		d.short()
+		p.size = d.longlong()
+		if d.err != nil {
+			ch.conn.connectionError(amqp.FrameError, "FRAME_ERROR - "+d.err.Error(), classBasic, methodBasicPublish)
+			return nil
+		}
+		p.properties = f.payload[12:]
+		p.header = true
+	} else {
+		if !p.header {
+			ch.conn.connectionError(amqp.UnexpectedFrame, "UNEXPECTED_FRAME - expected content header", classBasic, methodBasicPublish)
+			return nil
+		}
+		p.body = append(p.body, f.payload...)
+	}
+	if uint64(len(p.body)) < p.size {
+		return nil
+	}
+	ch.publishing = nil
+	return ch.publish(p)
+}
+
+func (ch *channel) publish(p *publishing) *amqpError {
+	s := ch.conn.s
+	if _, ok := s.exchanges[p.exchange]; !ok {
+		return notFound("exchange", p.exchange, classBasic, methodBasicPublish)
+	}
+	if ch.confirm && s.nacked[p.exchange] {
+		ch.conn.send(ch.id, newMethod(classBasic, methodBasicNack).longlong(ch.publishSeq).bit(false).bit(false).bytes())
+		return nil
+	}
+	msg := &message{exchange: p.exchange, key: p.key, properties: p.properties, body: p.body}
+	if s.onPublish != nil {
+		if m, err := msg.export(); err == nil {
+			s.onPublish(m)
+		}
+	}
+	if s.route(msg) == 0 && p.mandatory {
+		ch.conn.sendContent(ch.id, newMethod(classBasic, methodBasicReturn).
+			short(amqp.NoRoute).
+			shortstr("NO_ROUTE").
+			shortstr(p.exchange).
+			shortstr(p.key).
+			bytes(), msg)
+	}
+	if ch.confirm {
+		ch.conn.send(ch.id, newMethod(classBasic, methodBasicAck).longlong(ch.publishSeq).bit(false).bytes())
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package amqptest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// Frame types and the frame end octet of AMQP 0-9-1.
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+// Largest frame the server accepts and proposes to clients.
+const frameMax = 131072
+
+type frame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+}
+
+func readFrame(r *bufio.Reader) (frame, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	size := binary.BigEndian.Uint32(hdr[3:])
+	if size > frameMax {
+		return frame{}, errors.Errorf("frame of %d bytes exceeds the frame max", size)
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	if payload[size] != frameEnd {
+		return frame{}, errors.New("missing frame end")
+	}
+	return frame{typ: hdr[0], channel: binary.BigEndian.Uint16(hdr[1:3]), payload: payload[:size]}, nil
+}
+
+func (f frame) encode() []byte {
+	b := make([]byte, 7, 8+len(f.payload))
+	b[0] = f.typ
+	binary.BigEndian.PutUint16(b[1:3], f.channel)
+	binary.BigEndian.PutUint32(b[3:7], uint32(len(f.payload)))
+	b = append(b, f.payload...)
+	return append(b, frameEnd)
+}
+
+// decoder reads the fields of a method or content header. The first error is
+// kept and every later read returns a zero value.
+type decoder struct {
+	r    *bytes.Reader
+	err  error
+	bits byte
+	nbit int
+}
+
+func newDecoder(b []byte) *decoder {
+	return &decoder{r: bytes.NewReader(b), nbit: 8}
+}
+
+func (d *decoder) read(n int) []byte {
+	d.nbit = 8
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = errors.Wrap(err, "truncated method")
+	}
+	return b
+}
+
+func (d *decoder) octet() byte       { return d.read(1)[0] }
+func (d *decoder) short() uint16     { return binary.BigEndian.Uint16(d.read(2)) }
+func (d *decoder) long() uint32      { return binary.BigEndian.Uint32(d.read(4)) }
+func (d *decoder) longlong() uint64  { return binary.BigEndian.Uint64(d.read(8)) }
+func (d *decoder) shortstr() string  { return string(d.read(int(d.octet()))) }
+func (d *decoder) longstr() []byte   { return d.read(int(d.long())) }
+func (d *decoder) timestamp() uint64 { return d.longlong() }
+
+// bit reads the next of consecutive bit fields, which share an octet.
+func (d *decoder) bit() bool {
+	if d.nbit == 8 {
+		d.bits = d.octet()
+		d.nbit = 0
+	}
+	v := d.bits&(1<<uint(d.nbit)) != 0
+	d.nbit++
+	return v
+}
+
+func (d *decoder) table() amqp.Table {
+	b := d.longstr()
+	t := amqp.Table{}
+	if d.err != nil {
+		return t
+	}
+	fd := newDecoder(b)
+	for fd.r.Len() > 0 && fd.err == nil {
+		name := fd.shortstr()
+		t[name] = fd.field()
+	}
+	if fd.err != nil {
+		d.err = fd.err
+	}
+	return t
+}
+
+// field reads a field value with the type codes of the streadway client.
+func (d *decoder) field() interface{} {
+	switch typ := d.octet(); typ {
+	case 't':
+		return d.octet() != 0
+	case 'b':
+		return d.octet()
+	case 's':
+		return int16(d.short())
+	case 'I':
+		return int32(d.long())
+	case 'l':
+		return int64(d.longlong())
+	case 'f':
+		return math.Float32frombits(d.long())
+	case 'd':
+		return math.Float64frombits(d.longlong())
+	case 'D':
+		scale := d.octet()
+		return amqp.Decimal{Scale: scale, Value: int32(d.long())}
+	case 'S':
+		return string(d.longstr())
+	case 'A':
+		fd := newDecoder(d.longstr())
+		values := []interface{}{}
+		for fd.r.Len() > 0 && fd.err == nil {
+			values = append(values, fd.field())
+		}
+		if fd.err != nil && d.err == nil {
+			d.err = fd.err
+		}
+		return values
+	case 'T':
+		return time.Unix(int64(d.timestamp()), 0)
+	case 'F':
+		return d.table()
+	case 'x':
+		return d.longstr()
+	case 'V':
+		return nil
+	default:
+		if d.err == nil {
+			d.err = errors.Errorf("unknown field type %q", typ)
+		}
+		return nil
+	}
+}
+
+// encoder writes the fields of a method or content header.
+type encoder struct {
+	buf  bytes.Buffer
+	bits byte
+	nbit int
+}
+
+func newMethod(class, method uint16) *encoder {
+	e := &encoder{}
+	return e.short(class).short(method)
+}
+
+func (e *encoder) flush() {
+	if e.nbit > 0 {
+		e.buf.WriteByte(e.bits)
+		e.bits, e.nbit = 0, 0
+	}
+}
+
+func (e *encoder) octet(v byte) *encoder {
+	e.flush()
+	e.buf.WriteByte(v)
+	return e
+}
+
+func (e *encoder) short(v uint16) *encoder {
+	e.flush()
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	e.buf.Write(b[:])
+	return e
+}
+
+func (e *encoder) long(v uint32) *encoder {
+	e.flush()
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+	return e
+}
+
+func (e *encoder) longlong(v uint64) *encoder {
+	e.flush()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+	return e
+}
+
+func (e *encoder) shortstr(s string) *encoder {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	e.octet(byte(len(s)))
+	e.buf.WriteString(s)
+	return e
+}
+
+func (e *encoder) longstr(b []byte) *encoder {
+	e.long(uint32(len(b)))
+	e.buf.Write(b)
+	return e
+}
+
+func (e *encoder) bit(v bool) *encoder {
+	if e.nbit == 8 {
+		e.flush()
+	}
+	if v {
+		e.bits |= 1 << uint(e.nbit)
+	}
+	e.nbit++
+	return e
+}
+
+func (e *encoder) table(t amqp.Table) *encoder {
+	fe := &encoder{}
+	for name, value := range t {
+		fe.shortstr(name)
+		fe.field(value)
+	}
+	fe.flush()
+	return e.longstr(fe.buf.Bytes())
+}
+
+// field writes a field value with the type codes of the streadway client.
+// Values of other types are written as void.
+func (e *encoder) field(value interface{}) {
+	switch v := value.(type) {
+	case bool:
+		e.octet('t')
+		if v {
+			e.octet(1)
+		} else {
+			e.octet(0)
+		}
+	case byte:
+		e.octet('b').octet(v)
+	case int16:
+		e.octet('s').short(uint16(v))
+	case int:
+		e.octet('I').long(uint32(v))
+	case int32:
+		e.octet('I').long(uint32(v))
+	case int64:
+		e.octet('l').longlong(uint64(v))
+	case float32:
+		e.octet('f').long(math.Float32bits(v))
+	case float64:
+		e.octet('d').longlong(math.Float64bits(v))
+	case amqp.Decimal:
+		e.octet('D').octet(v.Scale).long(uint32(v.Value))
+	case string:
+		e.octet('S').longstr([]byte(v))
+	case []interface{}:
+		fe := &encoder{}
+		for _, item := range v {
+			fe.field(item)
+		}
+		fe.flush()
+		e.octet('A').longstr(fe.buf.Bytes())
+	case time.Time:
+		e.octet('T').longlong(uint64(v.Unix()))
+	case amqp.Table:
+		e.octet('F').table(v)
+	case []byte:
+		e.octet('x').longstr(v)
+	default:
+		e.octet('V')
+	}
+}
+
+func (e *encoder) bytes() []byte {
+	e.flush()
+	return e.buf.Bytes()
+}
+
+// Property flags of the basic content class.
+const (
+	flagContentType     = 0x8000
+	flagContentEncoding = 0x4000
+	flagHeaders         = 0x2000
+	flagDeliveryMode    = 0x1000
+	flagPriority        = 0x0800
+	flagCorrelationID   = 0x0400
+	flagReplyTo         = 0x0200
+	flagExpiration      = 0x0100
+	flagMessageID       = 0x0080
+	flagTimestamp       = 0x0040
+	flagType            = 0x0020
+	flagUserID          = 0x0010
+	flagAppID           = 0x0008
+)
+
+// decodeProperties decodes the property flags and list of a content header.
+func decodeProperties(b []byte) (amqp.Publishing, error) {
+	var p amqp.Publishing
+	d := newDecoder(b)
+	flags := d.short()
+	if flags&flagContentType != 0 {
+		p.ContentType = d.shortstr()
+	}
+	if flags&flagContentEncoding != 0 {
+		p.ContentEncoding = d.shortstr()
+	}
+	if flags&flagHeaders != 0 {
+		p.Headers = d.table()
+	}
+	if flags&flagDeliveryMode != 0 {
+		p.DeliveryMode = d.octet()
+	}
+	if flags&flagPriority != 0 {
+		p.Priority = d.octet()
+	}
+	if flags&flagCorrelationID != 0 {
+		p.CorrelationId = d.shortstr()
+	}
+	if flags&flagReplyTo != 0 {
+		p.ReplyTo = d.shortstr()
+	}
+	if flags&flagExpiration != 0 {
+		p.Expiration = d.shortstr()
+	}
+	if flags&flagMessageID != 0 {
+		p.MessageId = d.shortstr()
+	}
+	if flags&flagTimestamp != 0 {
+		p.Timestamp = time.Unix(int64(d.timestamp()), 0)
+	}
+	if flags&flagType != 0 {
+		p.Type = d.shortstr()
+	}
+	if flags&flagUserID != 0 {
+		p.UserId = d.shortstr()
+	}
+	if flags&flagAppID != 0 {
+		p.AppId = d.shortstr()
+	}
+	return p, d.err
+}
+
+// encodeProperties encodes the property flags and list of p.
+func encodeProperties(p amqp.Publishing) []byte {
+	var flags uint16
+	e := &encoder{}
+	set := func(flag uint16, ok bool, write func()) {
+		if ok {
+			flags |= flag
+			write()
+		}
+	}
+	set(flagContentType, p.ContentType != "", func() { e.shortstr(p.ContentType) })
+	set(flagContentEncoding, p.ContentEncoding != "", func() { e.shortstr(p.ContentEncoding) })
+	set(flagHeaders, len(p.Headers) > 0, func() { e.table(p.Headers) })
+	set(flagDeliveryMode, p.DeliveryMode != 0, func() { e.octet(p.DeliveryMode) })
+	set(flagPriority, p.Priority != 0, func() { e.octet(p.Priority) })
+	set(flagCorrelationID, p.CorrelationId != "", func() { e.shortstr(p.CorrelationId) })
+	set(flagReplyTo, p.ReplyTo != "", func() { e.shortstr(p.ReplyTo) })
+	set(flagExpiration, p.Expiration != "", func() { e.shortstr(p.Expiration) })
+	set(flagMessageID, p.MessageId != "", func() { e.shortstr(p.MessageId) })
+	set(flagTimestamp, !p.Timestamp.IsZero(), func() { e.longlong(uint64(p.Timestamp.Unix())) })
+	set(flagType, p.Type != "", func() { e.shortstr(p.Type) })
+	set(flagUserID, p.UserId != "", func() { e.shortstr(p.UserId) })
+	set(flagAppID, p.AppId != "", func() { e.shortstr(p.AppId) })
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], flags)
+	return append(b[:], e.bytes()...)
+}
@@ -0,0 +1,314 @@
+package amqptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// Message is a message held by a queue of the Server.
+type Message struct {
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	amqp.Publishing
+}
+
+// Server is an in-process AMQP 0-9-1 server implementing the subset of the
+// protocol hashserve uses, for integration tests with the streadway client:
+// exchange and queue declare, bind, direct, fanout and topic routing, qos,
+// consume, get, ack, nack and reject, publisher confirms and connection and
+// channel close. Everything is kept in memory and lost on Close.
+//
+// Exchanges hashserve expects to exist, such as the hashserve exchange, are
+// declared with DeclareExchange before connecting.
+type Server struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu        sync.Mutex
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+	conns     map[*conn]bool
+	nacked    map[string]bool
+	seq       int
+	closed    bool
+
+	onPublish func(Message)
+	onSettle  func(Settlement)
+}
+
+// Settlement is a delivered message a client acknowledged, rejected or
+// nacked, or that was requeued because its channel closed.
+type Settlement struct {
+	Queue    string
+	Message  Message
+	Requeued bool
+}
+
+// NewServer starts a Server listening on a random local port. The default
+// exchange and the amq.direct, amq.fanout and amq.topic exchanges exist.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:        ln,
+		exchanges: map[string]*exchange{},
+		queues:    map[string]*queue{},
+		conns:     map[*conn]bool{},
+		nacked:    map[string]bool{},
+	}
+	for name, kind := range map[string]string{"": Direct, "amq.direct": Direct, "amq.fanout": Fanout, "amq.topic": Topic} {
+		s.exchanges[name] = &exchange{name: name, kind: kind}
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := newConn(s, nc)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve(bufio.NewReader(nc))
+		}()
+	}
+}
+
+// URL returns the AMQP URL of the server. Any credentials and virtual host are accepted.
+func (s *Server) URL() string {
+	return "amqp://guest:guest@" + s.ln.Addr().String() + "/"
+}
+
+// Close closes every connection and stops the server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+	return err
+}
+
+// CloseConnections closes every client connection as a broker shutdown would.
+// Unacknowledged messages are requeued.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.connectionError(amqp.ConnectionForced, "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'", 0, 0)
+	}
+}
+
+// DeclareExchange declares an exchange of kind Direct, Fanout or Topic.
+func (s *Server) DeclareExchange(name string, kind string) error {
+	if kind != Direct && kind != Fanout && kind != Topic {
+		return errors.Errorf("unsupported exchange type %q", kind)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if x, ok := s.exchanges[name]; ok {
+		if x.kind != kind {
+			return errors.Errorf("exchange %q is of type %s", name, x.kind)
+		}
+		return nil
+	}
+	s.exchanges[name] = &exchange{name: name, kind: kind}
+	return nil
+}
+
+// DeclareQueue declares a queue.
+func (s *Server) DeclareQueue(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.queues[name]; !ok {
+		s.queues[name] = &queue{name: name}
+	}
+}
+
+// Bind binds a queue to an exchange with a binding key.
+func (s *Server) Bind(queue string, exchange string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bind(queue, exchange, key)
+}
+
+func (s *Server) bind(queue string, exchange string, key string) error {
+	if _, ok := s.queues[queue]; !ok {
+		return errors.Errorf("no queue %q", queue)
+	}
+	x, ok := s.exchanges[exchange]
+	if !ok {
+		return errors.Errorf("no exchange %q", exchange)
+	}
+	for _, b := range x.bindings {
+		if b.queue == queue && b.key == key {
+			return nil
+		}
+	}
+	x.bindings = append(x.bindings, binding{queue: queue, key: key})
+	return nil
+}
+
+// Publish routes msg as if a client had published it and returns the number of
+// queues it was routed to.
+func (s *Server) Publish(exchange string, key string, msg amqp.Publishing) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.exchanges[exchange]; !ok {
+		return 0, errors.Errorf("no exchange %q", exchange)
+	}
+	return s.route(&message{exchange: exchange, key: key, properties: encodeProperties(msg), body: msg.Body}), nil
+}
+
+// NackPublishes makes the server nack, instead of route, messages published
+// to exchange by channels in confirm mode, or stop doing so.
+func (s *Server) NackPublishes(exchange string, nack bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nacked[exchange] = nack
+}
+
+// Messages returns the messages ready for delivery in queue.
+func (s *Server) Messages(queue string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[queue]
+	if !ok {
+		return nil, errors.Errorf("no queue %q", queue)
+	}
+	messages := make([]Message, 0, len(q.messages))
+	for _, msg := range q.messages {
+		m, err := msg.export()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// WaitMessages waits up to timeout for queue to hold at least n ready messages
+// and returns them.
+func (s *Server) WaitMessages(queue string, n int, timeout time.Duration) ([]Message, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		messages, err := s.Messages(queue)
+		if err == nil && len(messages) >= n {
+			return messages, nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return nil, err
+			}
+			return messages, errors.Errorf("%d of %d messages in queue %q after %s", len(messages), n, queue, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// OnPublish registers f to be called with every message a client publishes to
+// an existing exchange, whether or not it is routed to a queue. f is called with
+// the server lock held and must not call the Server.
+func (s *Server) OnPublish(f func(Message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onPublish = f
+}
+
+// OnSettle registers f to be called with every settled message. f is called
+// with the server lock held and must not call the Server.
+func (s *Server) OnSettle(f func(Settlement)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onSettle = f
+}
+
+// Ready returns the number of messages ready for delivery in queue.
+func (s *Server) Ready(queue string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[queue]; ok {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// Unacked returns the number of messages of queue delivered and not settled yet.
+func (s *Server) Unacked(queue string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for c := range s.conns {
+		for _, ch := range c.channels {
+			for _, p := range ch.unacked {
+				if p.queue.name == queue {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// Consumers returns the number of consumers of queue.
+func (s *Server) Consumers(queue string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[queue]; ok {
+		return len(q.consumers)
+	}
+	return 0
+}
+
+// notifySettled calls the OnSettle function, if any, for settled messages. It
+// must be called with the server lock held.
+func (s *Server) notifySettled(settled []pending, requeued bool) {
+	if s.onSettle == nil {
+		return
+	}
+	for _, p := range settled {
+		if m, err := p.msg.export(); err == nil {
+			s.onSettle(Settlement{Queue: p.queue.name, Message: m, Requeued: requeued})
+		}
+	}
+}
+
+func (m *message) export() (Message, error) {
+	p, err := decodeProperties(m.properties)
+	if err != nil {
+		return Message{}, err
+	}
+	p.Body = m.body
+	return Message{Exchange: m.exchange, RoutingKey: m.key, Redelivered: m.redelivered, Publishing: p}, nil
+}
+
+// generateName returns a server generated queue or consumer tag name. It must
+// be called with the server lock held.
+func (s *Server) generateName(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s-%d", prefix, s.seq)
+}
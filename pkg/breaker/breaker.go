@@ -0,0 +1,156 @@
+package breaker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// Open rejects every call until the open timeout has passed.
+	Open
+	// HalfOpen rejects calls while a single probe decides whether to close again.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+var stateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "hashserve_hasher_breaker_state",
+	Help: "State of the hasher circuit breaker: 0 closed, 1 open, 2 half-open.",
+})
+
+// Breaker is a consecutive failure circuit breaker. It opens after threshold
+// consecutive failures, and once openTimeout has passed a probe decides
+// whether it closes again. It is safe for concurrent use.
+type Breaker struct {
+	threshold   int
+	openTimeout time.Duration
+	now         func() time.Time
+
+	mu            sync.Mutex
+	state         State
+	failures      int
+	openedAt      time.Time
+	onStateChange []func(State)
+}
+
+// New creates a closed Breaker.
+func New(threshold int, openTimeout time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		now:         time.Now,
+	}
+}
+
+// OnStateChange registers fn to be called after every state transition.
+func (b *Breaker) OnStateChange(fn func(State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onStateChange = append(b.onStateChange, fn)
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether a call may be made.
+func (b *Breaker) Allow() bool {
+	return b.State() == Closed
+}
+
+// Success records a successful call.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+// Failure records a failed call and opens the breaker once the threshold of
+// consecutive failures is reached.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	b.failures++
+	if b.state != Closed || b.failures < b.threshold {
+		b.mu.Unlock()
+		return
+	}
+	b.transition(Open)
+}
+
+// transition changes the state and notifies listeners. It must be called
+// with b.mu held and releases it.
+func (b *Breaker) transition(state State) {
+	b.state = state
+	if state == Open {
+		b.openedAt = b.now()
+	}
+	if state == Closed {
+		b.failures = 0
+	}
+	callbacks := b.onStateChange
+	b.mu.Unlock()
+
+	stateGauge.Set(float64(state))
+	for _, fn := range callbacks {
+		fn(state)
+	}
+}
+
+// Run probes an open breaker with probe once the open timeout has passed,
+// checking every interval, until ctx is done. A successful probe closes the
+// breaker, a failed one re-opens it for another timeout.
+func (b *Breaker) Run(ctx context.Context, interval time.Duration, probe func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.tryProbe(ctx, probe)
+		}
+	}
+}
+
+func (b *Breaker) tryProbe(ctx context.Context, probe func(context.Context) error) {
+	b.mu.Lock()
+	if b.state != Open || b.now().Sub(b.openedAt) < b.openTimeout {
+		b.mu.Unlock()
+		return
+	}
+	b.transition(HalfOpen)
+
+	err := probe(ctx)
+	b.mu.Lock()
+	if err != nil {
+		b.transition(Open)
+		return
+	}
+	b.transition(Closed)
+}
@@ -0,0 +1,58 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := New(2, time.Minute)
+	b.now = func() time.Time { return now }
+	var states []State
+	b.OnStateChange(func(s State) { states = append(states, s) })
+
+	b.Failure()
+	b.Success()
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("Expected non consecutive failures to keep the breaker closed")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Expected breaker to open after consecutive failures")
+	}
+
+	probeErr := errors.New("hasher down")
+	probe := func(context.Context) error { return probeErr }
+	b.tryProbe(context.Background(), probe)
+	if b.State() != Open || len(states) != 1 {
+		t.Fatalf("Expected no probe before the open timeout. States %v", states)
+	}
+
+	now = now.Add(time.Minute)
+	b.tryProbe(context.Background(), probe)
+	if b.State() != Open {
+		t.Fatal("Expected failed probe to re-open the breaker")
+	}
+
+	probeErr = nil
+	now = now.Add(time.Minute)
+	b.tryProbe(context.Background(), probe)
+	if !b.Allow() {
+		t.Fatal("Expected successful probe to close the breaker")
+	}
+
+	want := []State{Open, HalfOpen, Open, HalfOpen, Closed}
+	if len(states) != len(want) {
+		t.Fatalf("Expected transitions %v. Obtained %v", want, states)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("Expected transitions %v. Obtained %v", want, states)
+			break
+		}
+	}
+}
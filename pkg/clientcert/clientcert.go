@@ -0,0 +1,166 @@
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons reported when a client certificate is rejected.
+const (
+	ReasonPEM         = "pem"
+	ReasonParse       = "parse"
+	ReasonNotYetValid = "not_yet_valid"
+	ReasonExpired     = "expired"
+	ReasonKeyUsage    = "key_usage"
+)
+
+var (
+	rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hashserve_client_cert_rejected_total",
+		Help: "Number of scans rejected because of an invalid client certificate.",
+	}, []string{"reason"})
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hashserve_client_cert_cache_total",
+		Help: "Number of client certificate validations by cache result.",
+	}, []string{"result"})
+)
+
+// Invalid is returned by Validate when a client certificate cannot be used.
+// It never contains the certificate itself.
+type Invalid struct {
+	Reason      string
+	Fingerprint string
+	Detail      string
+}
+
+func (e *Invalid) Error() string {
+	return fmt.Sprintf("invalid client certificate %s: %s", shortFingerprint(e.Fingerprint), e.Detail)
+}
+
+// Info describes a validated client certificate.
+type Info struct {
+	// Hex encoded SHA-256 of the PEM data, safe to log.
+	Fingerprint string
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+// entry is a cached validation result, expiry is re-checked on every use.
+type entry struct {
+	info Info
+	err  *Invalid
+}
+
+// Validator validates PEM encoded client certificates, caching the parse
+// result by fingerprint. It is safe for concurrent use.
+type Validator struct {
+	maxEntries int
+	now        func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]entry
+}
+
+// New creates a Validator caching at most maxEntries certificates.
+func New(maxEntries int) *Validator {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &Validator{
+		maxEntries: maxEntries,
+		now:        time.Now,
+		cache:      map[string]entry{},
+	}
+}
+
+// Validate checks that data holds a PEM encoded certificate that is currently
+// valid and usable for client authentication. Failures are returned as *Invalid.
+func (v *Validator) Validate(data string) (Info, error) {
+	sum := sha256.Sum256([]byte(data))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	v.mu.Lock()
+	e, ok := v.cache[fingerprint]
+	v.mu.Unlock()
+	if ok {
+		cacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		cacheLookups.WithLabelValues("miss").Inc()
+		e = parse(fingerprint, []byte(data))
+		v.mu.Lock()
+		if len(v.cache) >= v.maxEntries {
+			// Certificates are few and long lived, starting over is simpler than LRU.
+			v.cache = map[string]entry{}
+		}
+		v.cache[fingerprint] = e
+		v.mu.Unlock()
+	}
+
+	err := e.err
+	if err == nil {
+		now := v.now()
+		if now.Before(e.info.NotBefore) {
+			err = &Invalid{ReasonNotYetValid, fingerprint, fmt.Sprintf("not valid before %s", e.info.NotBefore.Format(time.RFC3339))}
+		} else if now.After(e.info.NotAfter) {
+			err = &Invalid{ReasonExpired, fingerprint, fmt.Sprintf("expired at %s", e.info.NotAfter.Format(time.RFC3339))}
+		}
+	}
+	if err != nil {
+		rejected.WithLabelValues(err.Reason).Inc()
+		return Info{}, err
+	}
+	return e.info, nil
+}
+
+// parse decodes the first certificate in data and checks its key usage.
+func parse(fingerprint string, data []byte) entry {
+	var block *pem.Block
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			return entry{err: &Invalid{ReasonPEM, fingerprint, "no PEM encoded certificate found"}}
+		}
+		if block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return entry{err: &Invalid{ReasonParse, fingerprint, "unable to parse certificate"}}
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return entry{err: &Invalid{ReasonKeyUsage, fingerprint, "key usage does not allow digital signatures"}}
+	}
+	if len(cert.ExtKeyUsage) > 0 && !clientAuth(cert.ExtKeyUsage) {
+		return entry{err: &Invalid{ReasonKeyUsage, fingerprint, "extended key usage does not allow client authentication"}}
+	}
+	return entry{info: Info{
+		Fingerprint: fingerprint,
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+	}}
+}
+
+func clientAuth(usages []x509.ExtKeyUsage) bool {
+	for _, u := range usages {
+		if u == x509.ExtKeyUsageClientAuth || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func shortFingerprint(fingerprint string) string {
+	if len(fingerprint) > 16 {
+		return fingerprint[:16]
+	}
+	return fingerprint
+}
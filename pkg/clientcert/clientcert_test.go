@@ -0,0 +1,101 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func newCert(t *testing.T, keyUsage x509.KeyUsage, extKeyUsage []x509.ExtKeyUsage) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hashserve-test"},
+		NotBefore:    epoch,
+		NotAfter:     epoch.Add(24 * time.Hour),
+		KeyUsage:     keyUsage,
+		ExtKeyUsage:  extKeyUsage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestValidate(t *testing.T) {
+	valid := newCert(t, x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+	tests := []struct {
+		name   string
+		cert   string
+		now    time.Time
+		reason string
+	}{
+		{"valid", valid, epoch.Add(time.Hour), ""},
+		{"no usage restrictions", newCert(t, 0, nil), epoch.Add(time.Hour), ""},
+		{"not PEM", "not a certificate", epoch, ReasonPEM},
+		{"garbage", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("junk")})), epoch, ReasonParse},
+		{"not yet valid", valid, epoch.Add(-time.Hour), ReasonNotYetValid},
+		{"expired", valid, epoch.Add(48 * time.Hour), ReasonExpired},
+		{"key usage", newCert(t, x509.KeyUsageCertSign, nil), epoch, ReasonKeyUsage},
+		{"server only", newCert(t, 0, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}), epoch, ReasonKeyUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New(10)
+			v.now = func() time.Time { return tt.now }
+			_, err := v.Validate(tt.cert)
+			var invalid *Invalid
+			switch {
+			case tt.reason == "" && err != nil:
+				t.Errorf("Expected certificate to be valid. Obtained %s", err)
+			case tt.reason != "" && !errors.As(err, &invalid):
+				t.Errorf("Expected certificate to be invalid. Obtained %v", err)
+			case tt.reason != "" && invalid.Reason != tt.reason:
+				t.Errorf("Expected reason %s. Obtained %s", tt.reason, invalid.Reason)
+			}
+			if err != nil && strings.Contains(err.Error(), "BEGIN") {
+				t.Errorf("Expected error to not contain the certificate. Obtained %s", err)
+			}
+		})
+	}
+}
+
+func TestValidateCache(t *testing.T) {
+	cert := newCert(t, 0, nil)
+	v := New(1)
+	now := epoch.Add(time.Hour)
+	v.now = func() time.Time { return now }
+	info, err := v.Validate(cert)
+	if err != nil {
+		t.Fatalf("Expected certificate to be valid. Obtained %s", err)
+	}
+	if _, ok := v.cache[info.Fingerprint]; !ok {
+		t.Fatal("Expected certificate to be cached by fingerprint")
+	}
+
+	// Expiry is re-checked on cached certificates.
+	now = epoch.Add(48 * time.Hour)
+	if _, err := v.Validate(cert); err == nil {
+		t.Error("Expected cached certificate to expire")
+	}
+
+	v.Validate("other")
+	if len(v.cache) != 1 {
+		t.Errorf("Expected cache to be bounded to 1 entry. Obtained %d", len(v.cache))
+	}
+}
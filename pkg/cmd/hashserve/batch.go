@@ -0,0 +1,94 @@
+package hashserve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"go.uber.org/zap"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+)
+
+// batchCommand runs the workers over a JSON lines file of scan requests
+// instead of RabbitMQ.
+func batchCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("batch", "")
+	in := fs.String("in", "-", "JSON lines `file` of scan requests, - for stdin")
+	fingerprints := fs.String("fingerprints", "fingerprints.jsonl", "JSON lines output `file` of fingerprints, - for stdout")
+	retries := fs.String("retries", "retries.jsonl", "JSON lines output `file` of scan requests to retry")
+	failures := fs.String("failures", "failures.jsonl", "JSON lines output `file` of parked, dropped and rejected scans")
+	checkpoint := fs.String("checkpoint", "", "`file` recording progress, a run with an existing checkpoint resumes and appends to its outputs")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+	ctx, config, undo, err := setupConfig(ctx, &config{offline: true})
+	if err != nil {
+		return err
+	}
+	defer undo()
+	shutdown, err := startTracer(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+	c, _, _, err := newConsumer(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	input := io.Reader(os.Stdin)
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	_, statErr := os.Stat(*checkpoint)
+	resume := *checkpoint != "" && statErr == nil
+	var out rabbitmq.BatchOutputs
+	for _, o := range []struct {
+		path string
+		w    *io.Writer
+	}{
+		{*fingerprints, &out.Fingerprints},
+		{*retries, &out.Retries},
+		{*failures, &out.Failures},
+	} {
+		if o.path == "-" {
+			*o.w = stdout
+			continue
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if resume {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		f, err := os.OpenFile(o.path, flags, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		*o.w = f
+	}
+
+	result, err := c.RunBatch(ctx, input, out, *checkpoint)
+	logger.Info(ctx, "Batch finished",
+		zap.Int("lines", result.Lines),
+		zap.Int("skipped", result.Skipped),
+		zap.Int("fingerprints", result.Fingerprints),
+		zap.Int("retries", result.Retries),
+		zap.Int("failures", result.Failures))
+	if *fingerprints != "-" {
+		fmt.Fprintf(stdout, "%d lines, %d skipped, %d fingerprints, %d retries, %d failures\n",
+			result.Lines, result.Skipped, result.Fingerprints, result.Retries, result.Failures)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package hashserve
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// stdout receives the output of commands, replaced in tests.
+var stdout io.Writer = os.Stdout
+
+// errUsage is returned when a command is invoked incorrectly, its usage has already been printed.
+var errUsage = fmt.Errorf("invalid usage")
+
+// command is a subcommand of the hashserve binary.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+// commands lists the subcommands in the order they are documented.
+func commands(version string) []command {
+	return []command{
+		{"serve", "consume scans and publish fingerprints (default)", serveCommand},
+		{"batch", "run the workers over a JSON lines file instead of RabbitMQ", batchCommand},
+		{"dev", "run the workers over an in-process bus and a fake hasher, with an HTTP endpoint to submit scans", devCommand},
+		{"fakehasher", "serve a fake hasher with scripted responses", fakeHasherCommand},
+		{"loadtest", "measure worker throughput with generated scans, an in-process broker and a fake hasher", loadtestCommand},
+		{"publish", "publish scan requests to hashserve", publishCommand},
+		{"dlq", "inspect, purge and requeue the dead letter queue", dlqCommand},
+		{"hash", "hash a URL with the hasher service", hashCommand},
+		{"topology", "show or declare the RabbitMQ exchanges and queues", topologyCommand},
+		{"config", "print the effective configuration", configCommand},
+		{"version", "print the version", func(ctx context.Context, args []string) error {
+			fmt.Fprintln(stdout, version)
+			return nil
+		}},
+	}
+}
+
+// Execute runs the subcommand named by args[0]. Without arguments it serves,
+// as the binary did before it had subcommands. All commands share the
+// environment configuration of serve.
+func Execute(ctx context.Context, version string, args []string) error {
+	if len(args) == 0 {
+		return serveCommand(ctx, nil)
+	}
+	cmds := commands(version)
+	for _, c := range cmds {
+		if c.name == args[0] {
+			if err := c.run(ctx, args[1:]); err != flag.ErrHelp {
+				return err
+			}
+			return nil
+		}
+	}
+	usage(cmds)
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func usage(cmds []command) {
+	fmt.Fprintln(stdout, "Usage: hashserve <command> [flags]")
+	fmt.Fprintln(stdout)
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, c := range cmds {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+}
+
+// newFlagSet creates the flag set of a command, printing its usage to stdout.
+func newFlagSet(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	fs.Usage = func() {
+		fmt.Fprintf(stdout, "Usage: hashserve %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args, translating a usage error into errUsage. A request
+// for help returns flag.ErrHelp, which Execute treats as success.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil && err != flag.ErrHelp {
+		return errUsage
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func serveCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("serve", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return Run(ctx)
+}
+
+func configCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("config", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	config := &config{}
+	if err := config.load(); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, s := range config.settings() {
+		fmt.Fprintf(tw, "%s\t%s\n", s.name, maskSetting(s))
+	}
+	return tw.Flush()
+}
+
+// maskSetting hides secret values. Broker URIs keep everything but their passwords.
+func maskSetting(s setting) string {
+	if !s.secret || s.value == "" {
+		return s.value
+	}
+	if s.name != "MULTIPLE_BROKERS" {
+		return "********"
+	}
+	uris := strings.Split(s.value, ";")
+	for i, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			uris[i] = "********"
+			continue
+		}
+		uris[i] = u.Redacted()
+	}
+	return strings.Join(uris, ";")
+}
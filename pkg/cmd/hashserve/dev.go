@@ -0,0 +1,173 @@
+package hashserve
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"go.uber.org/zap"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+)
+
+// devCommand runs the workers over an in-process bus instead of RabbitMQ and,
+// unless a hasher URL is given, a fake hasher. Scans are submitted and
+// published messages observed over HTTP.
+func devCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("dev", "")
+	addr := fs.String("addr", "localhost:8090", "`address` of the HTTP endpoint")
+	hasher := fs.String("hasher", "", "`URL` of a real hasher service, by default a fake hasher is served under /hasher")
+	newHasher := fakeHasherFlags(fs)
+	retryDelay := fs.Duration("retry-delay", 10*time.Second, "delay before retried scans are delivered again")
+	capacity := fs.Int("capacity", 1000, "number of published messages kept for observation")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, config, undo, err := setupConfig(ctx, &config{offline: true, dev: true})
+	if err != nil {
+		return err
+	}
+	defer undo()
+	shutdown, err := startTracer(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	bus := rabbitmq.NewBus(*capacity, *retryDelay)
+	mux := http.NewServeMux()
+	mux.Handle("/scans", devScans(bus))
+	mux.Handle("/messages", devMessages(bus, ""))
+	mux.Handle("/fingerprints", devMessages(bus, rabbitmq.IMAGEEXCHANGENAME))
+	config.hasherURL = *hasher
+	if *hasher == "" {
+		h, err := newHasher()
+		if err != nil {
+			return err
+		}
+		mux.Handle("/hasher/", http.StripPrefix("/hasher", h))
+		config.hasherURL = "http://" + ln.Addr().String() + "/hasher"
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		logger.Info(ctx, "dev server listening", zap.String("addr", ln.Addr().String()), zap.String("hasher", config.hasherURL))
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error(ctx, "dev server stopped", zap.Error(err))
+			stop()
+		}
+	}()
+
+	c, adminServer, _, err := newConsumer(ctx, config)
+	if err != nil {
+		return err
+	}
+	if adminServer != nil {
+		go func() {
+			if err := adminServer.Serve(ctx); err != nil {
+				logger.Error(ctx, "admin server stopped", zap.Error(err))
+			}
+		}()
+	}
+	return c.ServeBus(ctx, bus)
+}
+
+// devScans publishes the scan requests posted as JSON or JSON lines to the bus
+// and responds with the result of each.
+func devScans(bus *rabbitmq.Bus) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		scans, err := decodeScanRequests(r.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		type result struct {
+			URL    string `json:"url"`
+			Result string `json:"result"`
+		}
+		results := []result{}
+		status := http.StatusAccepted
+		for i := range scans {
+			res := publishScan(r.Context(), bus, &scans[i])
+			if res != "accepted" {
+				status = http.StatusBadRequest
+			}
+			results = append(results, result{scans[i].URL, res})
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(results)
+	})
+}
+
+// devMessages lists the messages published to exchange, or to any exchange when
+// empty, after the after query parameter. With a wait duration it waits that
+// long for a message to be published when there is none yet.
+func devMessages(bus *rabbitmq.Bus, exchange string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		exchange := exchange
+		if exchange == "" {
+			exchange = q.Get("exchange")
+		}
+		var after uint64
+		if s := q.Get("after"); s != "" {
+			var err error
+			if after, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(rw, "invalid after", http.StatusBadRequest)
+				return
+			}
+		}
+		messages := bus.Messages(after, exchange)
+		if s := q.Get("wait"); s != "" && len(messages) == 0 {
+			wait, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(rw, "invalid wait", http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			defer cancel()
+			// Other exchanges may be published to first, wait until one of ours is.
+			for len(messages) == 0 && ctx.Err() == nil {
+				seq := after
+				if all := bus.Messages(after, ""); len(all) > 0 {
+					seq = all[len(all)-1].Seq
+				}
+				bus.Wait(ctx, seq)
+				messages = bus.Messages(after, exchange)
+			}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(messages)
+	})
+}
@@ -0,0 +1,70 @@
+package hashserve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+)
+
+func TestDevScans(t *testing.T) {
+	bus := rabbitmq.NewBus(10, time.Second)
+	tests := []struct {
+		body     string
+		status   int
+		messages int
+	}{
+		{`{"url": "https://example.com/a.jpg", "product": "websites"}`, http.StatusAccepted, 1},
+		{`{"url": "https://example.com/b.jpg", "product": "websites"}` + "\n" + `{"url": "https://example.com/c.jpg"}`, http.StatusBadRequest, 2},
+		{`{"url": `, http.StatusBadRequest, 2},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		devScans(bus).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/scans", strings.NewReader(tt.body)))
+		if rec.Code != tt.status {
+			t.Errorf("Expected status %d for %s. Obtained %d %s", tt.status, tt.body, rec.Code, rec.Body.String())
+		}
+		if n := len(bus.Messages(0, rabbitmq.SCANEXCHANGE)); n != tt.messages {
+			t.Errorf("Expected %d published scans after %s. Obtained %d", tt.messages, tt.body, n)
+		}
+	}
+}
+
+func TestDevMessages(t *testing.T) {
+	bus := rabbitmq.NewBus(10, time.Second)
+	ctx := context.Background()
+	bus.Publish(ctx, []byte(`{"n":1}`), rabbitmq.SCANEXCHANGE)
+	bus.Publish(ctx, []byte(`{"n":2}`), rabbitmq.IMAGEEXCHANGENAME)
+
+	get := func(h http.Handler, target string) ([]rabbitmq.BusMessage, int) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var messages []rabbitmq.BusMessage
+		json.Unmarshal(rec.Body.Bytes(), &messages)
+		return messages, rec.Code
+	}
+	if messages, _ := get(devMessages(bus, ""), "/messages"); len(messages) != 2 {
+		t.Errorf("Expected every message. Obtained %+v", messages)
+	}
+	if messages, _ := get(devMessages(bus, ""), "/messages?exchange=hashserve"); len(messages) != 1 || messages[0].Seq != 1 {
+		t.Errorf("Expected the message of the hashserve exchange. Obtained %+v", messages)
+	}
+	if _, status := get(devMessages(bus, ""), "/messages?after=x"); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid after to be refused. Obtained %d", status)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		bus.Publish(ctx, []byte(`{"n":3}`), rabbitmq.SCANEXCHANGE)
+		bus.Publish(ctx, []byte(`{"n":4}`), rabbitmq.IMAGEEXCHANGENAME)
+	}()
+	messages, _ := get(devMessages(bus, rabbitmq.IMAGEEXCHANGENAME), "/fingerprints?after=2&wait=5s")
+	if len(messages) != 1 || messages[0].Seq != 4 {
+		t.Errorf("Expected to wait for the next fingerprint. Obtained %+v", messages)
+	}
+}
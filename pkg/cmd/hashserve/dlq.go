@@ -0,0 +1,391 @@
+package hashserve
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+	"github.com/gdcorp-infosec/hashserve/pkg/signing"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// dlqMessage is a message of the dead letter queue with the fields it can be filtered and summarised by.
+type dlqMessage struct {
+	delivery amqp.Delivery
+	scan     types.ScanRequest
+	// False when the body is not a scan request
+	valid  bool
+	status string
+	host   string
+}
+
+func newDLQMessage(d amqp.Delivery) dlqMessage {
+	m := dlqMessage{delivery: d, status: dlqStatus(d.Headers), host: "-"}
+	m.valid = json.Unmarshal(d.Body, &m.scan) == nil
+	if !m.valid {
+		m.status = "undecodable"
+	}
+	if u, err := url.Parse(m.scan.URL); err == nil && u.Hostname() != "" {
+		m.host = u.Hostname()
+	}
+	return m
+}
+
+// dlqStatus returns why a message was dead lettered: the outcome of a parked
+// scan, the reason of its latest x-death entry or retry for scans the outcome
+// policy retried.
+func dlqStatus(headers amqp.Table) string {
+	if reason, ok := headers[rabbitmq.PARK_REASON_HEADER].(string); ok {
+		return strings.SplitN(reason, ":", 2)[0]
+	}
+	if deaths, ok := headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			if reason, ok := death["reason"].(string); ok {
+				return reason
+			}
+		}
+	}
+	return "retry"
+}
+
+// dlqFilter selects dead letter queue messages, empty fields match everything.
+type dlqFilter struct {
+	product  string
+	status   string
+	host     string
+	minRetry int
+	maxRetry int
+}
+
+func (f *dlqFilter) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.product, "product", "", "only messages of `product`")
+	fs.StringVar(&f.status, "status", "", "only messages with `status`, e.g. retry or transport error")
+	fs.StringVar(&f.host, "host", "", "only messages scanning `host`")
+	fs.IntVar(&f.minRetry, "min-retry", 0, "only messages retried at least `n` times")
+	fs.IntVar(&f.maxRetry, "max-retry", -1, "only messages retried at most `n` times, -1 for no limit")
+}
+
+func (f *dlqFilter) match(m dlqMessage) bool {
+	return (f.product == "" || f.product == m.scan.Product) &&
+		(f.status == "" || f.status == m.status) &&
+		(f.host == "" || strings.EqualFold(f.host, m.host)) &&
+		m.scan.RetryCount >= f.minRetry &&
+		(f.maxRetry < 0 || m.scan.RetryCount <= f.maxRetry)
+}
+
+// dlqCommand dispatches the dlq subcommands. Every subcommand browses the queue
+// by fetching its messages unacknowledged, so other consumers do not see them
+// until the subcommand releases them.
+func dlqCommand(ctx context.Context, args []string) error {
+	subcommands := []struct {
+		name    string
+		summary string
+		run     func(ctx context.Context, s *dlqSession, args []string) error
+	}{
+		{"peek", "print messages without removing them", dlqPeek},
+		{"summary", "count messages by product, status, retry count and host", dlqSummary},
+		{"export", "write messages as JSON lines without removing them", dlqExport},
+		{"purge", "remove matching messages", dlqPurge},
+		{"requeue", "publish matching messages to hashserve again and remove them", dlqRequeue},
+	}
+	if len(args) > 0 {
+		for _, sc := range subcommands {
+			if sc.name != args[0] {
+				continue
+			}
+			s := &dlqSession{}
+			fs := newFlagSet("dlq "+sc.name, "")
+			fs.StringVar(&s.queue, "queue", "", "dead letter `queue` bound to the "+rabbitmq.RETRYEXCHANGE+" exchange, required")
+			fs.IntVar(&s.limit, "limit", 0, "browse at most `n` messages, 0 for all")
+			s.filter.register(fs)
+			s.flags = fs
+			return sc.run(ctx, s, args[1:])
+		}
+	}
+	fmt.Fprintln(stdout, "Usage: hashserve dlq <command> [flags]")
+	fmt.Fprintln(stdout)
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	for _, sc := range subcommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", sc.name, sc.summary)
+	}
+	tw.Flush()
+	if len(args) > 0 && args[0] != "help" && args[0] != "-h" {
+		return errUsage
+	}
+	return nil
+}
+
+// dlqSession holds the flags shared by the dlq subcommands and, once opened,
+// the browsed messages.
+type dlqSession struct {
+	flags  *flag.FlagSet
+	queue  string
+	limit  int
+	filter dlqFilter
+
+	config   *config
+	undo     func()
+	conn     *rabbitmq.Connection
+	ch       *rabbitmq.Channel
+	messages []dlqMessage
+}
+
+// open parses args, connects and browses the queue. close must be called
+// even when open fails.
+func (s *dlqSession) open(ctx context.Context, args []string) (context.Context, error) {
+	if err := parseFlags(s.flags, args); err != nil {
+		return ctx, err
+	}
+	// The dead letter queue is provisioned outside hashserve, so its name is
+	// not known here.
+	if s.flags.NArg() != 0 || s.queue == "" {
+		s.flags.Usage()
+		return ctx, errUsage
+	}
+	ctx, config, undo, err := setup(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	s.undo = undo
+	s.config = config
+	if s.conn, err = rabbitmq.Dial(config.amqpBroker); err != nil {
+		return ctx, err
+	}
+	if s.ch, err = s.conn.Channel(); err != nil {
+		return ctx, err
+	}
+	q, err := s.ch.QueueInspect(s.queue)
+	if err != nil {
+		return ctx, errors.Wrapf(err, "unable to inspect %s", s.queue)
+	}
+	// Fetched messages stay unacknowledged, so the message count bounds the
+	// loop even though the queue keeps receiving messages.
+	n := q.Messages
+	if s.limit > 0 && s.limit < n {
+		n = s.limit
+	}
+	for len(s.messages) < n {
+		d, ok, err := s.ch.Get(s.queue, false)
+		if err != nil {
+			return ctx, err
+		}
+		if !ok {
+			break
+		}
+		s.messages = append(s.messages, newDLQMessage(d))
+	}
+	return ctx, nil
+}
+
+// matching returns the browsed messages selected by the filter.
+func (s *dlqSession) matching() []dlqMessage {
+	var matches []dlqMessage
+	for _, m := range s.messages {
+		if s.filter.match(m) {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// close returns every message that was not acknowledged to the queue.
+func (s *dlqSession) close() {
+	if s.ch != nil {
+		s.ch.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.undo != nil {
+		s.undo()
+	}
+}
+
+func dlqPeek(ctx context.Context, s *dlqSession, args []string) error {
+	defer s.close()
+	if _, err := s.open(ctx, args); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tPRODUCT\tSTATUS\tRETRY\tHOST\tURL")
+	for i, m := range s.matching() {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\n", i+1, m.scan.Product, m.status, m.scan.RetryCount, m.host, m.scan.URL)
+	}
+	return tw.Flush()
+}
+
+func dlqSummary(ctx context.Context, s *dlqSession, args []string) error {
+	defer s.close()
+	if _, err := s.open(ctx, args); err != nil {
+		return err
+	}
+	summarise(stdout, s.matching())
+	return nil
+}
+
+// summarise writes the message counts of each product, status, retry count and host.
+func summarise(w io.Writer, messages []dlqMessage) {
+	dimensions := []struct {
+		name  string
+		value func(m dlqMessage) string
+	}{
+		{"PRODUCT", func(m dlqMessage) string { return m.scan.Product }},
+		{"STATUS", func(m dlqMessage) string { return m.status }},
+		{"RETRY", func(m dlqMessage) string { return strconv.Itoa(m.scan.RetryCount) }},
+		{"HOST", func(m dlqMessage) string { return m.host }},
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "TOTAL\t%d\n", len(messages))
+	for _, d := range dimensions {
+		counts := map[string]int{}
+		for _, m := range messages {
+			counts[d.value(m)]++
+		}
+		values := make([]string, 0, len(counts))
+		for v := range counts {
+			values = append(values, v)
+		}
+		// Most frequent first, ties alphabetically.
+		sort.Slice(values, func(i, j int) bool {
+			if counts[values[i]] != counts[values[j]] {
+				return counts[values[i]] > counts[values[j]]
+			}
+			return values[i] < values[j]
+		})
+		fmt.Fprintf(tw, "\n%s\tCOUNT\n", d.name)
+		for _, v := range values {
+			if v == "" {
+				fmt.Fprintf(tw, "-\t%d\n", counts[v])
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%d\n", v, counts[v])
+		}
+	}
+	tw.Flush()
+}
+
+// dlqRecord is an exported message of the dead letter queue.
+type dlqRecord struct {
+	Status  string                 `json:"status"`
+	Headers map[string]interface{} `json:"headers,omitempty"`
+	// The scan request, or the raw body when it is not valid JSON
+	Body interface{} `json:"body"`
+}
+
+func dlqExport(ctx context.Context, s *dlqSession, args []string) error {
+	output := s.flags.String("o", "-", "JSON lines output `file`, - for stdout")
+	defer s.close()
+	if _, err := s.open(ctx, args); err != nil {
+		return err
+	}
+	w := stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	for _, m := range s.matching() {
+		if err := enc.Encode(exportRecord(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportRecord(m dlqMessage) dlqRecord {
+	r := dlqRecord{Status: m.status, Headers: m.delivery.Headers, Body: string(m.delivery.Body)}
+	if json.Valid(m.delivery.Body) {
+		r.Body = json.RawMessage(m.delivery.Body)
+	}
+	return r
+}
+
+func dlqPurge(ctx context.Context, s *dlqSession, args []string) error {
+	dryRun := s.flags.Bool("dry-run", false, "count matching messages without removing them")
+	defer s.close()
+	if _, err := s.open(ctx, args); err != nil {
+		return err
+	}
+	matches := s.matching()
+	if *dryRun {
+		fmt.Fprintf(stdout, "%d of %d messages in %s match\n", len(matches), len(s.messages), s.queue)
+		return nil
+	}
+	for _, m := range matches {
+		if err := m.delivery.Ack(false); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "%d of %d messages purged from %s\n", len(matches), len(s.messages), s.queue)
+	return nil
+}
+
+func dlqRequeue(ctx context.Context, s *dlqSession, args []string) error {
+	resetRetry := s.flags.Bool("reset-retry", false, "reset the retry count of requeued scans to 0")
+	dryRun := s.flags.Bool("dry-run", false, "count matching messages without requeueing them")
+	defer s.close()
+	ctx, err := s.open(ctx, args)
+	if err != nil {
+		return err
+	}
+	matches := s.matching()
+	if *dryRun {
+		fmt.Fprintf(stdout, "%d of %d messages in %s match\n", len(matches), len(s.messages), s.queue)
+		return nil
+	}
+	opts := []rabbitmq.ProducerOption{rabbitmq.WithRoutingKey("#." + s.config.env)}
+	if s.config.signingKeyringFile != "" {
+		k, err := signing.Load(s.config.signingKeyringFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, rabbitmq.WithSigner(k))
+	}
+	producer, err := rabbitmq.NewProducer(ctx, s.config.env, s.conn, opts...)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+	requeued, skipped := 0, 0
+	for _, m := range matches {
+		if !m.valid {
+			// Only scan requests can be requeued, the rest stays for inspection.
+			skipped++
+			continue
+		}
+		scan := m.scan
+		if *resetRetry {
+			scan.RetryCount = 0
+		}
+		body, err := json.Marshal(scan)
+		if err != nil {
+			return err
+		}
+		// The original is only removed once the broker confirmed its copy.
+		if err := producer.Publish(ctx, body, rabbitmq.SCANEXCHANGE); err != nil {
+			return errors.Wrapf(err, "requeued %d messages before failing", requeued)
+		}
+		if err := m.delivery.Ack(false); err != nil {
+			return err
+		}
+		requeued++
+	}
+	fmt.Fprintf(stdout, "%d of %d messages requeued from %s, %d undecodable skipped\n", requeued, len(s.messages), s.queue, skipped)
+	return nil
+}
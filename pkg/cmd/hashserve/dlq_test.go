@@ -0,0 +1,101 @@
+package hashserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+)
+
+func dlqMessages() []dlqMessage {
+	return []dlqMessage{
+		newDLQMessage(amqp.Delivery{Body: []byte(`{"url": "https://a.example.com/1.jpg", "product": "websites", "retryCount": 2}`)}),
+		newDLQMessage(amqp.Delivery{
+			Body:    []byte(`{"url": "https://b.example.com/2.jpg", "product": "hosting", "retryCount": 5}`),
+			Headers: amqp.Table{rabbitmq.PARK_REASON_HEADER: "transport error: connection refused"},
+		}),
+		newDLQMessage(amqp.Delivery{
+			Body:    []byte(`{"url": "https://A.example.com/3.jpg", "product": "websites", "retryCount": 0}`),
+			Headers: amqp.Table{"x-death": []interface{}{amqp.Table{"reason": "rejected", "queue": "hashserve-dev"}}},
+		}),
+		newDLQMessage(amqp.Delivery{Body: []byte(`not json`)}),
+	}
+}
+
+func TestDLQMessage(t *testing.T) {
+	tests := []struct {
+		status string
+		host   string
+		valid  bool
+	}{
+		{"retry", "a.example.com", true},
+		{"transport error", "b.example.com", true},
+		{"rejected", "A.example.com", true},
+		{"undecodable", "-", false},
+	}
+	for i, m := range dlqMessages() {
+		if m.status != tests[i].status || m.host != tests[i].host || m.valid != tests[i].valid {
+			t.Errorf("Expected message %d to be %+v. Obtained status %q, host %q, valid %v", i, tests[i], m.status, m.host, m.valid)
+		}
+	}
+}
+
+func TestDLQFilter(t *testing.T) {
+	tests := []struct {
+		filter  dlqFilter
+		matches int
+	}{
+		{dlqFilter{maxRetry: -1}, 4},
+		{dlqFilter{product: "websites", maxRetry: -1}, 2},
+		{dlqFilter{status: "transport error", maxRetry: -1}, 1},
+		{dlqFilter{host: "a.example.com", maxRetry: -1}, 2},
+		{dlqFilter{minRetry: 2, maxRetry: -1}, 2},
+		{dlqFilter{maxRetry: 2}, 3},
+		{dlqFilter{product: "websites", minRetry: 1, maxRetry: 3}, 1},
+	}
+	for _, tt := range tests {
+		n := 0
+		for _, m := range dlqMessages() {
+			if tt.filter.match(m) {
+				n++
+			}
+		}
+		if n != tt.matches {
+			t.Errorf("Expected %+v to match %d messages. Obtained %d", tt.filter, tt.matches, n)
+		}
+	}
+}
+
+func TestSummarise(t *testing.T) {
+	var out bytes.Buffer
+	summarise(&out, dlqMessages())
+	for _, want := range []string{"TOTAL  4", "websites  2", "transport error  1", "undecodable      1", "a.example.com  1"} {
+		if !strings.Contains(strings.Join(strings.Fields(out.String()), " "), strings.Join(strings.Fields(want), " ")) {
+			t.Errorf("Expected summary containing %q. Obtained\n%s", want, out.String())
+		}
+	}
+}
+
+func TestExportRecord(t *testing.T) {
+	messages := dlqMessages()
+	b, _ := json.Marshal(exportRecord(messages[1]))
+	var decoded struct {
+		Status  string
+		Headers map[string]string
+		Body    struct{ Product string }
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Status != "transport error" || decoded.Body.Product != "hosting" || decoded.Headers[rabbitmq.PARK_REASON_HEADER] == "" {
+		t.Errorf("Expected the scan request to be exported as JSON. Obtained %s", b)
+	}
+	b, _ = json.Marshal(exportRecord(messages[3]))
+	if !strings.Contains(string(b), `"body":"not json"`) {
+		t.Errorf("Expected an undecodable body to be exported as a string. Obtained %s", b)
+	}
+}
@@ -0,0 +1,78 @@
+package hashserve
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/fakehasher"
+)
+
+// fakeHasherFlags registers the flags configuring a fake hasher on fs and
+// returns a function creating it once fs was parsed.
+func fakeHasherFlags(fs *flag.FlagSet) func() (*fakehasher.Hasher, error) {
+	behaviour := fakehasher.DefaultBehaviour()
+	fs.IntVar(&behaviour.StatusCode, "status", behaviour.StatusCode, "hasher status code of fake hasher responses")
+	fs.IntVar(&behaviour.HTTPStatus, "http-status", behaviour.HTTPStatus, "HTTP status of fake hasher responses")
+	latency := fs.Duration("latency", 0, "latency of fake hasher responses")
+	fs.StringVar(&behaviour.Latency, "latency-dist", "", "`distribution` of latency added to fake hasher responses: a duration, uniform:<min>-<max>, exp:<mean> or normal:<mean>,<stddev>")
+	script := fs.String("script", "", "JSON `file` scripting fake hasher responses per URL")
+	return func() (*fakehasher.Hasher, error) {
+		behaviour.LatencyMs = int(*latency / time.Millisecond)
+		if _, err := fakehasher.ParseLatency(behaviour.Latency); err != nil {
+			return nil, err
+		}
+		h := fakehasher.New(behaviour)
+		if *script != "" {
+			s, err := fakehasher.LoadScript(*script)
+			if err != nil {
+				return nil, err
+			}
+			h.SetScript(s)
+		}
+		return h, nil
+	}
+}
+
+// fakeHasherCommand serves a fake hasher, e.g. for contract tests or to run
+// serve without the hasher sidecar.
+func fakeHasherCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("fakehasher", "")
+	addr := fs.String("addr", "localhost:8080", "`address` to listen on")
+	newHasher := fakeHasherFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+	h, err := newHasher()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	fmt.Fprintf(stdout, "fake hasher listening on http://%s\n", ln.Addr())
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
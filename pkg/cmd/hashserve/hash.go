@@ -0,0 +1,52 @@
+package hashserve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+)
+
+// hashCommand hashes a URL with the hasher service, as the image worker would,
+// and prints the hasher response.
+func hashCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("hash", "<url>")
+	certFile := fs.String("cert", "", "PEM `file` of the client certificate the hasher presents")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	ctx, config, undo, err := setupConfig(ctx, &config{offline: true})
+	if err != nil {
+		return err
+	}
+	defer undo()
+	var cert string
+	if *certFile != "" {
+		b, err := ioutil.ReadFile(*certFile)
+		if err != nil {
+			return err
+		}
+		cert = string(b)
+	}
+	body, status, err := rabbitmq.HashURL(ctx, config.hasherURL, fs.Arg(0), cert)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, body, "", "  ") != nil {
+		out.Reset()
+		out.Write(body)
+	}
+	fmt.Fprintln(stdout, out.String())
+	if status < 200 || status > 299 {
+		return fmt.Errorf("hasher HTTP status %d", status)
+	}
+	return nil
+}
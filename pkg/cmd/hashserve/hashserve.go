@@ -3,11 +3,28 @@ package hashserve
 import (
 	"context"
 	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"github.com/gdcorp-infosec/hashserve/pkg/adaptive"
+	"github.com/gdcorp-infosec/hashserve/pkg/admin"
+	"github.com/gdcorp-infosec/hashserve/pkg/allowlist"
+	"github.com/gdcorp-infosec/hashserve/pkg/breaker"
+	"github.com/gdcorp-infosec/hashserve/pkg/escalation"
+	"github.com/gdcorp-infosec/hashserve/pkg/fairqueue"
+	"github.com/gdcorp-infosec/hashserve/pkg/hostlimit"
+	"github.com/gdcorp-infosec/hashserve/pkg/pdna"
 	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+	"github.com/gdcorp-infosec/hashserve/pkg/redact"
+	"github.com/gdcorp-infosec/hashserve/pkg/signing"
+	"github.com/gdcorp-infosec/hashserve/pkg/tracing"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+	"github.com/gdcorp-infosec/hashserve/pkg/urlpolicy"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // config provides a central location for all application specific configuration.
@@ -17,6 +34,10 @@ type config struct {
 	// namespacing RabbitMQ Exchanges, Queues, and Bindings.
 	env string
 
+	// Optional file of NAME=value lines overriding the reloadable settings,
+	// re-read on SIGHUP
+	configFile string
+
 	// Broker host to connect and consume messages from.
 	amqpBroker string
 
@@ -26,8 +47,118 @@ type config struct {
 	// Log level
 	logLevel string
 
+	// Bounds of the adaptive number of image worker go routines. Unless set
+	// they follow NO_IMAGE_WORKER_THREADS, also on reload, which disables
+	// adaptation
+	minImageThread string
+	maxImageThread string
+
+	// Base URL of the hasher service
+	hasherURL string
+
+	// Hasher latency above which the image worker count is decreased
+	hasherTargetLatency string
+
+	// Fraction of failed hasher calls above which the image worker count is decreased
+	hasherMaxErrorRate string
+
+	// Interval at which the image worker count is re-evaluated
+	concurrencyWindow string
+
+	// Messages prefetched per active image worker. Products are only scheduled
+	// fairly among the prefetched messages, so weights and priorities need a
+	// window holding scans of several products
+	prefetchPerWorker string
+
+	// Consecutive hasher failures after which consumption is paused, 0 disables the circuit breaker
+	breakerFailureThreshold string
+
+	// Time the circuit breaker stays open before probing the hasher
+	breakerOpenTimeout string
+
+	// Comma separated outcome=action overrides of the default outcome policy
+	outcomePolicy string
+
 	// Max retry count
 	maxRetryCount string
+
+	// Optional JSON lines file of PhotoDNA reference hashes to match images against
+	pdnaReferenceFile string
+
+	// Maximum PhotoDNA distance reported as a near-duplicate match
+	pdnaMatchThreshold string
+
+	// Maximum number of near-duplicate matches attached to a fingerprint
+	pdnaMatchLimit string
+
+	// Optional JSON file overriding the default policy of URLs the hasher may
+	// fetch. Hosts are resolved again right before the hasher is called and
+	// refused when their answers changed, redirects must be restricted by the
+	// egress policy of the hasher.
+	urlPolicyFile string
+
+	// Optional JSON keyring file enabling verification of incoming and signing of published messages
+	signingKeyringFile string
+
+	// Optional JSON keyring file enabling encryption of account identifiers in published fingerprints
+	identifierKeyringFile string
+
+	// Comma separated account identifier fields to encrypt
+	encryptedIdentifierFields string
+
+	// Optional JSON file of known-benign URLs, hosts, digests and asset IDs
+	allowlistFile string
+
+	// Optional JSON object of per product ML score escalation thresholds
+	escalationThresholds string
+
+	// AMQP priority of escalated fingerprints
+	escalationPriority string
+
+	// Maximum concurrent hasher requests per scanned host, 0 for no limit
+	hostMaxConcurrency string
+
+	// Sustained hasher requests per second per scanned host, 0 for no limit
+	hostRateLimit string
+
+	// Hasher requests per scanned host allowed in a burst above the rate limit
+	hostRateBurst string
+
+	// Comma separated product=weight pairs for image worker scheduling
+	productWeights string
+
+	// Comma separated product=n pairs, a product is served before the others
+	// while it has fewer than n image scans in flight
+	productPriority string
+
+	// Comma separated field=mode overrides of the default log and trace redaction rules
+	redactionRules string
+
+	// HMAC key used to hash redacted account identifiers, which are masked
+	// instead when it is not set
+	redactionKey string
+
+	// Listen address of the admin HTTP server, disabled when empty
+	adminAddr string
+
+	// Bearer token required for mutating admin requests
+	adminToken string
+
+	// Trace exporter, one of elastic, otlp or none
+	tracingExporter string
+
+	// Set for commands that run without a broker, which makes MULTIPLE_BROKERS optional
+	offline bool
+
+	// Set by the dev command, whose fake hasher never fetches scan URLs so the
+	// default URL policy is not applied
+	dev bool
+
+	// Level of the logger created by setupConfig, changed when LOG_LEVEL is reloaded
+	level zap.AtomicLevel
+
+	// Logger of configuration changes, which ignores the log level
+	audit *zap.Logger
 }
 
 // load attempts to load all necessary environment variables needed to run the application.
@@ -36,9 +167,16 @@ func (w *config) load() (err error) {
 	if err = w.loadEnv("ENV", &w.env); err != nil {
 		return
 	}
+	w.loadOptionalEnv("CONFIG_FILE", &w.configFile, "")
+	if w.configFile != "" {
+		if err = w.loadFile(w.configFile); err != nil {
+			return
+		}
+	}
 
-
-	if err = w.loadEnv("MULTIPLE_BROKERS", &w.amqpBroker); err != nil {
+	if w.offline {
+		w.loadOptionalEnv("MULTIPLE_BROKERS", &w.amqpBroker, "")
+	} else if err = w.loadEnv("MULTIPLE_BROKERS", &w.amqpBroker); err != nil {
 			return
 		}
 	if err = w.loadEnv("NO_IMAGE_WORKER_THREADS", &w.nImageThread); err != nil {
@@ -52,9 +190,101 @@ func (w *config) load() (err error) {
 		w.logLevel = "INFO"
 		err = nil
 	}
+	w.loadOptionalEnv("MIN_IMAGE_WORKER_THREADS", &w.minImageThread, "")
+	w.loadOptionalEnv("MAX_IMAGE_WORKER_THREADS", &w.maxImageThread, "")
+	w.loadOptionalEnv("HASHER_URL", &w.hasherURL, rabbitmq.DEFAULT_HASHER_URL)
+	w.loadOptionalEnv("HASHER_TARGET_LATENCY", &w.hasherTargetLatency, "10s")
+	w.loadOptionalEnv("HASHER_MAX_ERROR_RATE", &w.hasherMaxErrorRate, "0.1")
+	w.loadOptionalEnv("CONCURRENCY_WINDOW", &w.concurrencyWindow, "30s")
+	w.loadOptionalEnv("PREFETCH_PER_WORKER", &w.prefetchPerWorker, strconv.Itoa(rabbitmq.DEFAULT_PREFETCH_PER_WORKER))
+	w.loadOptionalEnv("BREAKER_FAILURE_THRESHOLD", &w.breakerFailureThreshold, "5")
+	w.loadOptionalEnv("BREAKER_OPEN_TIMEOUT", &w.breakerOpenTimeout, "30s")
+	w.loadOptionalEnv("OUTCOME_POLICY", &w.outcomePolicy, "")
+	w.loadOptionalEnv("PDNA_REFERENCE_FILE", &w.pdnaReferenceFile, "")
+	if w.pdnaReferenceFile != "" {
+		if err = w.loadEnv("PDNA_MATCH_THRESHOLD", &w.pdnaMatchThreshold); err != nil {
+			return
+		}
+	}
+	w.loadOptionalEnv("PDNA_MATCH_LIMIT", &w.pdnaMatchLimit, "10")
+	w.loadOptionalEnv("URL_POLICY_FILE", &w.urlPolicyFile, "")
+	w.loadOptionalEnv("SIGNING_KEYRING_FILE", &w.signingKeyringFile, "")
+	w.loadOptionalEnv("IDENTIFIER_KEYRING_FILE", &w.identifierKeyringFile, "")
+	w.loadOptionalEnv("ENCRYPTED_IDENTIFIER_FIELDS", &w.encryptedIdentifierFields, strings.Join(types.IdentifierFields, ","))
+	w.loadOptionalEnv("ALLOWLIST_FILE", &w.allowlistFile, "")
+	w.loadOptionalEnv("ESCALATION_THRESHOLDS", &w.escalationThresholds, "")
+	w.loadOptionalEnv("ESCALATION_PRIORITY", &w.escalationPriority, "9")
+	w.loadOptionalEnv("HOST_MAX_CONCURRENCY", &w.hostMaxConcurrency, "0")
+	w.loadOptionalEnv("HOST_RATE_LIMIT", &w.hostRateLimit, "0")
+	w.loadOptionalEnv("HOST_RATE_BURST", &w.hostRateBurst, "1")
+	w.loadOptionalEnv("PRODUCT_WEIGHTS", &w.productWeights, "")
+	w.loadOptionalEnv("PRODUCT_PRIORITY_IN_FLIGHT", &w.productPriority, "")
+	w.loadOptionalEnv("REDACTION_RULES", &w.redactionRules, "")
+	w.loadOptionalEnv("REDACTION_KEY", &w.redactionKey, "")
+	w.loadOptionalEnv("ADMIN_ADDR", &w.adminAddr, "")
+	w.loadOptionalEnv("ADMIN_TOKEN", &w.adminToken, "")
+	w.loadOptionalEnv("TRACING_EXPORTER", &w.tracingExporter, "elastic")
 	return
 }
 
+// setting is a loaded configuration value and the environment variable it was loaded from.
+type setting struct {
+	name   string
+	value  string
+	secret bool
+}
+
+// settings returns the loaded configuration in the order load reads it.
+func (w *config) settings() []setting {
+	minImageThread, maxImageThread := w.workerBounds()
+	return []setting{
+		{"ENV", w.env, false},
+		{"CONFIG_FILE", w.configFile, false},
+		{"MULTIPLE_BROKERS", w.amqpBroker, true},
+		{"NO_IMAGE_WORKER_THREADS", w.nImageThread, false},
+		{"MAX_RETRY_COUNT", w.maxRetryCount, false},
+		{"LOG_LEVEL", w.logLevel, false},
+		{"MIN_IMAGE_WORKER_THREADS", minImageThread, false},
+		{"MAX_IMAGE_WORKER_THREADS", maxImageThread, false},
+		{"HASHER_URL", w.hasherURL, false},
+		{"HASHER_TARGET_LATENCY", w.hasherTargetLatency, false},
+		{"HASHER_MAX_ERROR_RATE", w.hasherMaxErrorRate, false},
+		{"CONCURRENCY_WINDOW", w.concurrencyWindow, false},
+		{"PREFETCH_PER_WORKER", w.prefetchPerWorker, false},
+		{"BREAKER_FAILURE_THRESHOLD", w.breakerFailureThreshold, false},
+		{"BREAKER_OPEN_TIMEOUT", w.breakerOpenTimeout, false},
+		{"OUTCOME_POLICY", w.outcomePolicy, false},
+		{"PDNA_REFERENCE_FILE", w.pdnaReferenceFile, false},
+		{"PDNA_MATCH_THRESHOLD", w.pdnaMatchThreshold, false},
+		{"PDNA_MATCH_LIMIT", w.pdnaMatchLimit, false},
+		{"URL_POLICY_FILE", w.urlPolicyFile, false},
+		{"SIGNING_KEYRING_FILE", w.signingKeyringFile, false},
+		{"IDENTIFIER_KEYRING_FILE", w.identifierKeyringFile, false},
+		{"ENCRYPTED_IDENTIFIER_FIELDS", w.encryptedIdentifierFields, false},
+		{"ALLOWLIST_FILE", w.allowlistFile, false},
+		{"ESCALATION_THRESHOLDS", w.escalationThresholds, false},
+		{"ESCALATION_PRIORITY", w.escalationPriority, false},
+		{"HOST_MAX_CONCURRENCY", w.hostMaxConcurrency, false},
+		{"HOST_RATE_LIMIT", w.hostRateLimit, false},
+		{"HOST_RATE_BURST", w.hostRateBurst, false},
+		{"PRODUCT_WEIGHTS", w.productWeights, false},
+		{"PRODUCT_PRIORITY_IN_FLIGHT", w.productPriority, false},
+		{"REDACTION_RULES", w.redactionRules, false},
+		{"REDACTION_KEY", w.redactionKey, true},
+		{"ADMIN_ADDR", w.adminAddr, false},
+		{"ADMIN_TOKEN", w.adminToken, true},
+		{"TRACING_EXPORTER", w.tracingExporter, false},
+	}
+}
+
+// loadOptionalEnv loads the environment variable name into dst, falling back
+// to def when it is not set.
+func (w *config) loadOptionalEnv(name string, dst *string, def string) {
+	if err := w.loadEnv(name, dst); err != nil {
+		*dst = def
+	}
+}
+
 // loadEnv attempts to look for an environment variable with name and
 // loads it into the destination pointed to by dst. If the environment
 // variable does not exist, it returns an error, else nil.
@@ -71,22 +301,141 @@ func (w *config) loadEnv(name string, dst *string) error {
 	return nil
 }
 
+// workerBounds returns MIN_IMAGE_WORKER_THREADS and MAX_IMAGE_WORKER_THREADS,
+// each NO_IMAGE_WORKER_THREADS when not set.
+func (w *config) workerBounds() (string, string) {
+	min, max := w.minImageThread, w.maxImageThread
+	if min == "" {
+		min = w.nImageThread
+	}
+	if max == "" {
+		max = w.nImageThread
+	}
+	return min, max
+}
+
+// parseProductInts parses comma separated product=value pairs, e.g. websites=2,hosting=1.
+func parseProductInts(s string) (map[string]int, error) {
+	values := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid product value %q", pair)
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || v < 0 {
+			return nil, errors.Errorf("invalid product value %q", pair)
+		}
+		values[strings.TrimSpace(kv[0])] = v
+	}
+	return values, nil
+}
+
+// parseIdentifierFields parses comma separated account identifier field names, e.g. shopperID,domain.
+func parseIdentifierFields(s string) ([]string, error) {
+	var fields []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, f := range types.IdentifierFields {
+			known = known || f == name
+		}
+		if !known {
+			return nil, errors.Errorf("unknown identifier field %q", name)
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+// newRedactor creates the redactor applied to log output and trace labels.
+func newRedactor(config *config) (*redact.Redactor, error) {
+	rules, err := redact.ParseRules(config.redactionRules)
+	if err != nil {
+		return nil, err
+	}
+	return redact.New(rules, []byte(config.redactionKey)), nil
+}
+
+// newTracer creates the tracer of the configured exporter. The Elastic APM and
+// OTLP exporters are configured through their ELASTIC_APM_* and OTEL_* variables.
+func newTracer(ctx context.Context, config *config) (tracing.Tracer, error) {
+	switch config.tracingExporter {
+	case "", "elastic":
+		return tracing.NewElastic(), nil
+	case "otlp":
+		return tracing.NewOTLP(ctx)
+	case "none":
+		return tracing.Nop{}, nil
+	}
+	return nil, errors.Errorf("unknown trace exporter %q", config.tracingExporter)
+}
+
+// startTracer makes the tracer of the configured exporter the default tracer.
+// shutdown flushes its pending spans.
+func startTracer(ctx context.Context, config *config) (shutdown func(), err error) {
+	tracer, err := newTracer(ctx, config)
+	if err != nil {
+		logger.Error(ctx, "Unable to create a tracer for the TRACING_EXPORTER configuration", zap.Error(err))
+		return nil, err
+	}
+	tracing.SetDefault(tracer)
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracer.Shutdown(shutdownCtx); err != nil {
+			logger.Error(ctx, "Unable to flush pending spans", zap.Error(err))
+		}
+	}, nil
+}
+
 // Run initializes the baseline application, loggers, and other things necessary to Work.
 func Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	config := config{}
-	if err := config.load(); err != nil {
-		return err
-	}
-	lr, lrUndo, err := logger.New(config.logLevel, "stderr")
+	ctx, config, undo, err := setup(ctx)
 	if err != nil {
 		return err
 	}
-	defer lrUndo()
-	ctx = logger.WithContext(ctx, lr)
+	defer undo()
 	logger.Info(ctx, "app object created successfully")
-	return Work(ctx, &config)
+	return Work(ctx, config)
+}
+
+// setup loads the configuration and returns a context carrying the redacting
+// logger shared by all commands. undo flushes the logger.
+func setup(ctx context.Context) (context.Context, *config, func(), error) {
+	return setupConfig(ctx, &config{})
+}
+
+// setupConfig is setup for a config with preset fields, e.g. offline.
+func setupConfig(ctx context.Context, config *config) (context.Context, *config, func(), error) {
+	if err := config.load(); err != nil {
+		return nil, nil, nil, err
+	}
+	redactor, err := newRedactor(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if config.level, err = zap.ParseAtomicLevel(config.logLevel); err != nil {
+		return nil, nil, nil, err
+	}
+	// The level is applied by a wrapping core so that it can be changed and
+	// configuration changes are logged whatever it is.
+	lr, lrUndo, err := logger.New(zapcore.DebugLevel.CapitalString(), "stderr")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	lr = lr.WithOptions(zap.WrapCore(redactor.Core))
+	config.audit = lr.Named("audit")
+	lr = lr.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core { return &levelCore{Core: c, level: config.level} }))
+	return logger.WithContext(ctx, lr), config, lrUndo, nil
 }
 
 // Work serves as the main work function of the application.
@@ -94,19 +443,23 @@ func Run(ctx context.Context) error {
 // It is responsible for loading application specific configurations as well as
 // serving the main work loop.
 func Work(ctx context.Context, config *config) error {
-	uri := config.amqpBroker
-
-	nImageThreadInt, err := strconv.Atoi(config.nImageThread)
+	shutdown, err := startTracer(ctx, config)
 	if err != nil {
-		logger.Error(ctx, "Unable to convert NO_IMAGE_WORKER_THREADS configuration to int")
 		return err
 	}
-	maxRetryCountInt, err := strconv.Atoi(config.maxRetryCount)
+	defer shutdown()
+	w, adminServer, reloader, err := newConsumer(ctx, config)
 	if err != nil {
-		logger.Error(ctx, "Unable to convert MAX_RETRY_COUNT configuration to int")
 		return err
 	}
-	w := rabbitmq.NewConsumer(config.env, uri, nImageThreadInt, maxRetryCountInt)
+	go reloader.watch(ctx)
+	if adminServer != nil {
+		go func() {
+			if err := adminServer.Serve(ctx); err != nil {
+				logger.Error(ctx, "admin server stopped", zap.Error(err))
+			}
+		}()
+	}
 	err = w.Serve(ctx)
 	if err != nil {
 		logger.Error(ctx, "main: unable to perform work", zap.Error(err))
@@ -114,3 +467,203 @@ func Work(ctx context.Context, config *config) error {
 	}
 	return err
 }
+
+// newConsumer creates the consumer of the configuration, the admin server, if
+// configured, exposing its state and the reloader of its reloadable settings.
+func newConsumer(ctx context.Context, config *config) (*rabbitmq.Consumer, *admin.Server, *reloader, error) {
+	uri := config.amqpBroker
+
+	nImageThreadInt, err := strconv.Atoi(config.nImageThread)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert NO_IMAGE_WORKER_THREADS configuration to int")
+		return nil, nil, nil, err
+	}
+	maxRetryCountInt, err := strconv.Atoi(config.maxRetryCount)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert MAX_RETRY_COUNT configuration to int")
+		return nil, nil, nil, err
+	}
+	redactor, err := newRedactor(config)
+	if err != nil {
+		logger.Error(ctx, "Unable to parse REDACTION_RULES configuration", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	opts := []rabbitmq.ConsumerOption{rabbitmq.WithRedactor(redactor), rabbitmq.WithHasherURL(config.hasherURL)}
+	minImageThread, maxImageThread := config.workerBounds()
+	minImageThreadInt, err := strconv.Atoi(minImageThread)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert MIN_IMAGE_WORKER_THREADS configuration to int")
+		return nil, nil, nil, err
+	}
+	maxImageThreadInt, err := strconv.Atoi(maxImageThread)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert MAX_IMAGE_WORKER_THREADS configuration to int")
+		return nil, nil, nil, err
+	}
+	// The limit only adapts when its bounds differ, which a reload may change.
+	targetLatency, err := time.ParseDuration(config.hasherTargetLatency)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert HASHER_TARGET_LATENCY configuration to duration")
+		return nil, nil, nil, err
+	}
+	maxErrorRate, err := strconv.ParseFloat(config.hasherMaxErrorRate, 64)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert HASHER_MAX_ERROR_RATE configuration to float")
+		return nil, nil, nil, err
+	}
+	window, err := time.ParseDuration(config.concurrencyWindow)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert CONCURRENCY_WINDOW configuration to duration")
+		return nil, nil, nil, err
+	}
+	ctrl := adaptive.New(nImageThreadInt, minImageThreadInt, maxImageThreadInt, targetLatency, maxErrorRate)
+	opts = append(opts, rabbitmq.WithConcurrency(ctrl, window))
+	prefetchPerWorker, err := strconv.Atoi(config.prefetchPerWorker)
+	if err != nil || prefetchPerWorker < 1 {
+		logger.Error(ctx, "Unable to convert PREFETCH_PER_WORKER configuration to a positive int")
+		return nil, nil, nil, errors.Errorf("invalid PREFETCH_PER_WORKER %q", config.prefetchPerWorker)
+	}
+	opts = append(opts, rabbitmq.WithPrefetchPerWorker(prefetchPerWorker))
+	policy, err := rabbitmq.ParsePolicy(config.outcomePolicy)
+	if err != nil {
+		logger.Error(ctx, "Unable to parse OUTCOME_POLICY configuration", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	opts = append(opts, rabbitmq.WithPolicy(policy))
+	breakerFailureThreshold, err := strconv.Atoi(config.breakerFailureThreshold)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert BREAKER_FAILURE_THRESHOLD configuration to int")
+		return nil, nil, nil, err
+	}
+	if breakerFailureThreshold > 0 {
+		openTimeout, err := time.ParseDuration(config.breakerOpenTimeout)
+		if err != nil {
+			logger.Error(ctx, "Unable to convert BREAKER_OPEN_TIMEOUT configuration to duration")
+			return nil, nil, nil, err
+		}
+		opts = append(opts, rabbitmq.WithBreaker(breaker.New(breakerFailureThreshold, openTimeout)))
+	}
+	if config.pdnaReferenceFile != "" {
+		threshold, err := strconv.ParseFloat(config.pdnaMatchThreshold, 64)
+		if err != nil {
+			logger.Error(ctx, "Unable to convert PDNA_MATCH_THRESHOLD configuration to float")
+			return nil, nil, nil, err
+		}
+		limit, err := strconv.Atoi(config.pdnaMatchLimit)
+		if err != nil {
+			logger.Error(ctx, "Unable to convert PDNA_MATCH_LIMIT configuration to int")
+			return nil, nil, nil, err
+		}
+		ix, err := pdna.LoadIndex(config.pdnaReferenceFile, threshold, limit)
+		if err != nil {
+			logger.Error(ctx, "Unable to load PhotoDNA reference set", zap.Error(err))
+			return nil, nil, nil, err
+		}
+		logger.Info(ctx, "PhotoDNA reference set loaded", zap.Int("references", ix.Len()))
+		opts = append(opts, rabbitmq.WithMatcher(ix))
+	}
+	r := &reloader{config: config, concurrency: ctrl}
+	if !config.dev || config.urlPolicyFile != "" {
+		urlPolicy, err := urlpolicy.New(urlpolicy.DefaultRules(), net.DefaultResolver)
+		if config.urlPolicyFile != "" {
+			urlPolicy, err = urlpolicy.Load(config.urlPolicyFile)
+		}
+		if err != nil {
+			logger.Error(ctx, "Unable to load URL policy", zap.Error(err))
+			return nil, nil, nil, err
+		}
+		opts = append(opts, rabbitmq.WithURLPolicy(urlPolicy))
+		if config.urlPolicyFile != "" {
+			r.urlPolicy = urlPolicy
+		}
+	}
+	var adminServer *admin.Server
+	if config.adminAddr != "" {
+		adminServer = admin.NewServer(config.adminAddr, config.adminToken)
+	}
+	if config.signingKeyringFile != "" {
+		k, err := signing.Load(config.signingKeyringFile)
+		if err != nil {
+			logger.Error(ctx, "Unable to load signing keyring", zap.Error(err))
+			return nil, nil, nil, err
+		}
+		opts = append(opts, rabbitmq.WithKeyring(k))
+	}
+	if config.identifierKeyringFile != "" {
+		k, err := types.LoadIdentifierKeyring(config.identifierKeyringFile)
+		if err != nil {
+			logger.Error(ctx, "Unable to load identifier keyring", zap.Error(err))
+			return nil, nil, nil, err
+		}
+		fields, err := parseIdentifierFields(config.encryptedIdentifierFields)
+		if err != nil {
+			logger.Error(ctx, "Unable to parse ENCRYPTED_IDENTIFIER_FIELDS configuration", zap.Error(err))
+			return nil, nil, nil, err
+		}
+		opts = append(opts, rabbitmq.WithIdentifierEncryption(k, fields))
+	}
+	if config.allowlistFile != "" {
+		l, err := allowlist.Load(config.allowlistFile)
+		if err != nil {
+			logger.Error(ctx, "Unable to load allowlist", zap.Error(err))
+			return nil, nil, nil, err
+		}
+		opts = append(opts, rabbitmq.WithAllowlist(l))
+		r.allowlist = l
+		if adminServer != nil {
+			adminServer.Handle("/allowlist", l)
+		}
+	}
+	if config.escalationThresholds != "" {
+		priority, err := strconv.ParseUint(config.escalationPriority, 10, 8)
+		if err != nil || priority > rabbitmq.EscalationMaxPriority {
+			logger.Error(ctx, "Unable to convert ESCALATION_PRIORITY configuration to a priority of the escalation queue")
+			return nil, nil, nil, errors.Errorf("invalid ESCALATION_PRIORITY %q", config.escalationPriority)
+		}
+		p, err := escalation.ParsePolicy(config.escalationThresholds, uint8(priority))
+		if err != nil {
+			logger.Error(ctx, "Unable to load ESCALATION_THRESHOLDS configuration", zap.Error(err))
+			return nil, nil, nil, err
+		}
+		opts = append(opts, rabbitmq.WithEscalation(p))
+		r.escalation = p
+	}
+	hostMaxConcurrency, err := strconv.Atoi(config.hostMaxConcurrency)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert HOST_MAX_CONCURRENCY configuration to int")
+		return nil, nil, nil, err
+	}
+	hostRateLimit, err := strconv.ParseFloat(config.hostRateLimit, 64)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert HOST_RATE_LIMIT configuration to float")
+		return nil, nil, nil, err
+	}
+	hostRateBurst, err := strconv.Atoi(config.hostRateBurst)
+	if err != nil {
+		logger.Error(ctx, "Unable to convert HOST_RATE_BURST configuration to int")
+		return nil, nil, nil, err
+	}
+	if hostMaxConcurrency > 0 || hostRateLimit > 0 {
+		opts = append(opts, rabbitmq.WithHostLimiter(hostlimit.New(hostMaxConcurrency, hostRateLimit, hostRateBurst)))
+	}
+	weights, err := parseProductInts(config.productWeights)
+	if err != nil {
+		logger.Error(ctx, "Unable to parse PRODUCT_WEIGHTS configuration", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	priority, err := parseProductInts(config.productPriority)
+	if err != nil {
+		logger.Error(ctx, "Unable to parse PRODUCT_PRIORITY_IN_FLIGHT configuration", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	imageQueue := fairqueue.New(weights, priority, 1)
+	opts = append(opts, rabbitmq.WithImageQueue(imageQueue))
+	if adminServer != nil {
+		adminServer.Handle("/scheduler", imageQueue)
+	}
+	r.consumer = rabbitmq.NewConsumer(config.env, uri, nImageThreadInt, maxRetryCountInt, opts...)
+	if adminServer != nil {
+		adminServer.Handle("/config", r)
+	}
+	return r.consumer, adminServer, r, nil
+}
@@ -0,0 +1,270 @@
+//go:build loadtest
+// +build loadtest
+
+package hashserve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"go.uber.org/zap"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/amqptest"
+	"github.com/gdcorp-infosec/hashserve/pkg/loadgen"
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+	"github.com/gdcorp-infosec/hashserve/pkg/signing"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// loadtestCommand measures the throughput of the consumer. It serves an
+// in-process AMQP broker and a fake hasher, publishes a generated mix of scans
+// at a given rate and reports throughput, latencies from publishing to
+// settling, outcomes and the backlog of the hashserve queue over time.
+// Retried scans are not delivered again.
+func loadtestCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("loadtest", "")
+	mixFlag := fs.String("mix", "image=90,video=5,misc=5", "relative `weights` of image, video and misc scans")
+	productsFlag := fs.String("products", "websites", "comma separated `products` scans are published for in turn")
+	rate := fs.Float64("rate", 100, "scans published per second, 0 to publish each once the previous one was confirmed")
+	count := fs.Int("count", 0, "number of scans to publish, 0 to publish for -duration")
+	duration := fs.Duration("duration", 30*time.Second, "how long to publish scans when -count is 0")
+	interval := fs.Duration("interval", 5*time.Second, "interval of progress reports")
+	drain := fs.Duration("drain", time.Minute, "how long to wait for published scans to complete")
+	workers := fs.Int("workers", 0, "image workers, overriding NO_IMAGE_WORKER_THREADS")
+	prefetch := fs.Int("prefetch", 0, "messages prefetched per image worker, overriding PREFETCH_PER_WORKER")
+	seed := fs.Int64("seed", 1, "seed of the sequence of scan kinds")
+	newHasher := fakeHasherFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 || *rate < 0 || *count < 0 || *interval <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+	mix, err := loadgen.ParseMix(*mixFlag)
+	if err != nil {
+		return err
+	}
+	var products []string
+	for _, p := range strings.Split(*productsFlag, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			products = append(products, p)
+		}
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	preset := &config{offline: true, dev: true}
+	if *workers > 0 {
+		preset.nImageThread = strconv.Itoa(*workers)
+	}
+	if *prefetch > 0 {
+		preset.prefetchPerWorker = strconv.Itoa(*prefetch)
+	}
+	ctx, config, undo, err := setupConfig(ctx, preset)
+	if err != nil {
+		return err
+	}
+	defer undo()
+	shutdown, err := startTracer(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	h, err := newHasher()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	hasher := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go hasher.Serve(ln)
+	defer hasher.Close()
+	config.hasherURL = "http://" + ln.Addr().String()
+
+	broker, err := amqptest.NewServer()
+	if err != nil {
+		return err
+	}
+	defer broker.Close()
+	for _, name := range rabbitmq.ExternalExchanges {
+		if err := broker.DeclareExchange(name, amqptest.Topic); err != nil {
+			return err
+		}
+	}
+	config.amqpBroker = broker.URL()
+	queue := "hashserve-" + config.env
+	recorder := loadgen.NewRecorder(time.Now())
+	broker.OnPublish(func(m amqptest.Message) { recordOutput(recorder, m) })
+	broker.OnSettle(func(s amqptest.Settlement) {
+		var scan types.ScanRequest
+		if s.Queue == queue && json.Unmarshal(s.Message.Body, &scan) == nil {
+			recorder.Settled(scan.URL, s.Requeued, time.Now())
+		}
+	})
+
+	c, _, _, err := newConsumer(ctx, config)
+	if err != nil {
+		return err
+	}
+	serveCtx, cancelServe := context.WithCancel(ctx)
+	defer cancelServe()
+	served := make(chan error, 1)
+	go func() { served <- c.Serve(serveCtx) }()
+	for broker.Consumers(queue) == 0 {
+		select {
+		case err := <-served:
+			return fmt.Errorf("consumer stopped before consuming: %v", err)
+		case <-ctx.Done():
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	conn, err := rabbitmq.Dial(broker.URL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Scans are signed as products sign them, otherwise a consumer verifying
+	// signatures would park every one of them.
+	opts := []rabbitmq.ProducerOption{rabbitmq.WithRoutingKey("#." + config.env)}
+	if config.signingKeyringFile != "" {
+		k, err := signing.Load(config.signingKeyringFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, rabbitmq.WithSigner(k))
+	}
+	producer, err := rabbitmq.NewProducer(ctx, config.env, conn, opts...)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	target := fmt.Sprintf("for %s", *duration)
+	if *count > 0 {
+		target = fmt.Sprintf("%d scans", *count)
+	}
+	pace := "as fast as confirmed"
+	if *rate > 0 {
+		pace = fmt.Sprintf("at %g scans/s", *rate)
+	}
+	fmt.Fprintf(stdout, "Publishing %s %s, mix %s, %s image workers, prefetch %s per worker\n", target, pace, mix, config.nImageThread, config.prefetchPerWorker)
+	fmt.Fprintf(stdout, "%8s %10s %10s %9s %9s %9s %8s %8s\n", "time", "published", "completed", "scans/s", "p50", "p99", "retried", "backlog")
+	start := time.Now()
+	reported := make(chan struct{})
+	stopReports := make(chan struct{})
+	go func() {
+		defer close(reported)
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				r := recorder.Interval(now, broker.Ready(queue)+broker.Unacked(queue))
+				fmt.Fprintf(stdout, "%8s %10d %10d %9.1f %9s %9s %7.1f%% %8d\n",
+					now.Sub(start).Round(*interval), r.Published, r.Completed, r.Throughput, millis(r.Latency.P50), millis(r.Latency.P99), 100*r.RetryRate, r.Backlog)
+			case <-stopReports:
+				return
+			}
+		}
+	}()
+
+	gen := loadgen.NewGenerator(mix, products, fmt.Sprintf("https://loadtest.example.com/%d", start.Unix()), *seed)
+	published := 0
+	for ; *count == 0 || published < *count; published++ {
+		if *count == 0 && time.Since(start) >= *duration {
+			break
+		}
+		if *rate > 0 {
+			if wait := time.Until(start.Add(time.Duration(float64(published) / *rate * float64(time.Second)))); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		scan, kind := gen.Next()
+		body, err := json.Marshal(scan)
+		if err != nil {
+			return err
+		}
+		recorder.Published(scan.URL, kind, time.Now())
+		if err := producer.Publish(ctx, body, rabbitmq.SCANEXCHANGE); err != nil {
+			logger.Error(ctx, "Unable to publish scan", zap.Error(err))
+			break
+		}
+	}
+	deadline := time.Now().Add(*drain)
+	for recorder.InFlight() > 0 && time.Now().Before(deadline) && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	end := time.Now()
+	close(stopReports)
+	<-reported
+	cancelServe()
+	if err := <-served; err != nil {
+		logger.Error(ctx, "consumer stopped", zap.Error(err))
+	}
+
+	total := recorder.Total(end)
+	fmt.Fprintln(stdout)
+	fmt.Fprintf(stdout, "published    %d scans\n", total.Published)
+	fmt.Fprintf(stdout, "completed    %d scans in %s, %.1f scans/s\n", total.Completed, total.Elapsed.Round(time.Millisecond), total.Throughput)
+	var outcomes []string
+	for _, o := range loadgen.Outcomes {
+		outcomes = append(outcomes, fmt.Sprintf("%s %d", o, total.Outcomes[o]))
+	}
+	fmt.Fprintf(stdout, "outcomes     %s\n", strings.Join(outcomes, ", "))
+	fmt.Fprintf(stdout, "requeued     %d\n", total.Requeued)
+	fmt.Fprintf(stdout, "latency      p50 %s, p90 %s, p99 %s, max %s\n", millis(total.Latency.P50), millis(total.Latency.P90), millis(total.Latency.P99), millis(total.Latency.Max))
+	fmt.Fprintf(stdout, "retry rate   %.1f%%\n", 100*total.RetryRate)
+	fmt.Fprintf(stdout, "max backlog  %d\n", total.Backlog)
+	if n := recorder.InFlight(); n > 0 {
+		return fmt.Errorf("%d scans did not complete within %s", n, *drain)
+	}
+	return nil
+}
+
+// recordOutput records the outcome of the scans a message hashserve published
+// was for.
+func recordOutput(recorder *loadgen.Recorder, m amqptest.Message) {
+	switch m.Exchange {
+	case rabbitmq.IMAGEEXCHANGENAME:
+		var fingerprints types.Fingerprints
+		if json.Unmarshal(m.Body, &fingerprints) == nil {
+			for _, f := range fingerprints.Fingerprints {
+				recorder.Output(f.Path, loadgen.Fingerprinted)
+			}
+		}
+	case rabbitmq.RETRYEXCHANGE, rabbitmq.PARKINGEXCHANGE:
+		outcome := loadgen.Retried
+		if m.Exchange == rabbitmq.PARKINGEXCHANGE {
+			outcome = loadgen.Parked
+		}
+		var scan types.ScanRequest
+		if json.Unmarshal(m.Body, &scan) == nil {
+			recorder.Output(scan.URL, outcome)
+		}
+	}
+}
+
+func millis(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
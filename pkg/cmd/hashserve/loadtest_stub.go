@@ -0,0 +1,16 @@
+//go:build !loadtest
+// +build !loadtest
+
+package hashserve
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// loadtestCommand is only built with the loadtest tag, which links the
+// in-process broker into the binary.
+func loadtestCommand(ctx context.Context, args []string) error {
+	return errors.New("loadtest is not built into this binary, build it with -tags loadtest")
+}
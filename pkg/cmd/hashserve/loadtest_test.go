@@ -0,0 +1,40 @@
+//go:build loadtest
+// +build loadtest
+
+package hashserve
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadtestCommand(t *testing.T) {
+	t.Setenv("ENV", "dev")
+	t.Setenv("NO_IMAGE_WORKER_THREADS", "2")
+	t.Setenv("MAX_RETRY_COUNT", "3")
+	t.Setenv("TRACING_EXPORTER", "none")
+	keyring := filepath.Join(t.TempDir(), "keyring.json")
+	if err := ioutil.WriteFile(keyring, []byte(`{"signing": {"id": "hashserve", "algorithm": "hmac-sha256", "secret": "MDEyMzQ1Njc4OWFiY2RlZg=="}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SIGNING_KEYRING_FILE", keyring)
+	out := capture(t)
+	args := []string{"loadtest", "-mix", "image=3,misc=1", "-count", "40", "-rate", "0", "-interval", "50ms", "-workers", "4", "-prefetch", "3", "-drain", "10s"}
+	if err := Execute(context.Background(), "", args); err != nil {
+		t.Fatalf("Expected the load test to complete. Obtained %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"4 image workers, prefetch 3 per worker",
+		"published    40 scans",
+		"completed    40 scans",
+		"retried 0, parked 0, dropped 0",
+		"retry rate   0.0%",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in the report. Obtained\n%s", want, out)
+		}
+	}
+}
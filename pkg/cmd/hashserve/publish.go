@@ -0,0 +1,171 @@
+package hashserve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+	"github.com/gdcorp-infosec/hashserve/pkg/signing"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// publishCommand publishes scan requests built from flags or read from a JSON
+// or JSON lines file to the hashserve exchange and reports the broker
+// confirmation of each.
+func publishCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("publish", "")
+	file := fs.String("file", "", "JSON or JSON lines `file` of scan requests, - for stdin")
+	dryRun := fs.Bool("dry-run", false, "validate the scan requests without publishing them")
+	var scan types.ScanRequest
+	var certFile string
+	fs.StringVar(&scan.URL, "url", "", "`URL` to scan")
+	fs.StringVar(&scan.Product, "product", "", "product submitting the scan")
+	fs.StringVar(&scan.AssetID, "asset-id", "", "asset ID of the scanned content")
+	fs.StringVar(&certFile, "cert", "", "PEM `file` of the client certificate the hasher presents")
+	fs.IntVar(&scan.RetryCount, "retry-count", 0, "retry count of the scan")
+	fs.StringVar(&scan.Identifiers.ShopperId, "shopper-id", "", "shopper ID of the account")
+	fs.StringVar(&scan.Identifiers.ContainerId, "container-id", "", "container ID of the account")
+	fs.StringVar(&scan.Identifiers.Domain, "domain", "", "domain of the account")
+	fs.StringVar(&scan.Identifiers.GUID, "guid", "", "GUID of the account")
+	fs.StringVar(&scan.Identifiers.XID, "xid", "", "XID of the account")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if (*file == "") == (scan.URL == "") || fs.NArg() != 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	var scans []types.ScanRequest
+	if *file != "" {
+		r := io.Reader(os.Stdin)
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		if scans, err = decodeScanRequests(r); err != nil {
+			return err
+		}
+	} else {
+		if certFile != "" {
+			b, err := ioutil.ReadFile(certFile)
+			if err != nil {
+				return err
+			}
+			scan.Cert = string(b)
+		}
+		scans = []types.ScanRequest{scan}
+	}
+
+	ctx, config, undo, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer undo()
+	var producer rabbitmq.Publisher
+	if !*dryRun {
+		opts := []rabbitmq.ProducerOption{rabbitmq.WithRoutingKey("#." + config.env)}
+		if config.signingKeyringFile != "" {
+			k, err := signing.Load(config.signingKeyringFile)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, rabbitmq.WithSigner(k))
+		}
+		conn, err := rabbitmq.Dial(config.amqpBroker)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		p, err := rabbitmq.NewProducer(ctx, config.env, conn, opts...)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		producer = p
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tPRODUCT\tURL\tRESULT")
+	failed := 0
+	for i := range scans {
+		result := publishScan(ctx, producer, &scans[i])
+		if result != "accepted" && result != "valid" {
+			failed++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i+1, scans[i].Product, scans[i].URL, result)
+	}
+	tw.Flush()
+	if failed > 0 {
+		return errors.Errorf("%d of %d scan requests not accepted", failed, len(scans))
+	}
+	return nil
+}
+
+// publishScan validates and, unless producer is nil, publishes scan. It
+// returns the result reported for the scan.
+func publishScan(ctx context.Context, producer rabbitmq.Publisher, scan *types.ScanRequest) string {
+	if err := scan.ValidateRequiredFields(); err != nil {
+		return "invalid: " + err.Error()
+	}
+	if scan.PublishTime == "" {
+		scan.PublishTime = time.Now().Format(time.RFC3339)
+	}
+	if producer == nil {
+		return "valid"
+	}
+	body, err := json.Marshal(scan)
+	if err != nil {
+		return "invalid: " + err.Error()
+	}
+	if err := producer.Publish(ctx, body, rabbitmq.SCANEXCHANGE); err != nil {
+		return "rejected: " + err.Error()
+	}
+	return "accepted"
+}
+
+// decodeScanRequests reads a stream of JSON scan requests. Each value may be a
+// single scan request or an array of them, so JSON files and JSON lines both work.
+// Unknown fields are refused to catch misspelt hand-crafted requests.
+func decodeScanRequests(r io.Reader) ([]types.ScanRequest, error) {
+	var scans []types.ScanRequest
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return scans, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "scan request %d", n)
+		}
+		strict := json.NewDecoder(bytes.NewReader(raw))
+		strict.DisallowUnknownFields()
+		var err error
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			var batch []types.ScanRequest
+			err = strict.Decode(&batch)
+			scans = append(scans, batch...)
+		} else {
+			var scan types.ScanRequest
+			err = strict.Decode(&scan)
+			scans = append(scans, scan)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "scan request %d", n)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package hashserve
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+func TestDecodeScanRequests(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		urls  []string
+		err   bool
+	}{
+		{"object", `{"url": "https://example.com/a.jpg", "product": "websites"}`, []string{"https://example.com/a.jpg"}, false},
+		{"array", `[{"url": "https://example.com/a.jpg"}, {"url": "https://example.com/b.jpg"}]`, []string{"https://example.com/a.jpg", "https://example.com/b.jpg"}, false},
+		{"lines", "{\"url\": \"https://example.com/a.jpg\"}\n{\"url\": \"https://example.com/b.jpg\"}\n", []string{"https://example.com/a.jpg", "https://example.com/b.jpg"}, false},
+		{"empty", "", nil, false},
+		{"unknown field", `{"url": "https://example.com/a.jpg", "prodcut": "websites"}`, nil, true},
+		{"malformed", `{"url": `, nil, true},
+	}
+	for _, tt := range tests {
+		scans, err := decodeScanRequests(strings.NewReader(tt.input))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error %v. Obtained %v", tt.name, tt.err, err)
+			continue
+		}
+		if len(scans) != len(tt.urls) {
+			t.Errorf("%s: expected %d scan requests. Obtained %d", tt.name, len(tt.urls), len(scans))
+			continue
+		}
+		for i, scan := range scans {
+			if scan.URL != tt.urls[i] {
+				t.Errorf("%s: expected URL %s. Obtained %s", tt.name, tt.urls[i], scan.URL)
+			}
+		}
+	}
+}
+
+func TestPublishScanDryRun(t *testing.T) {
+	tests := []struct {
+		scan   types.ScanRequest
+		result string
+	}{
+		{types.ScanRequest{URL: "https://example.com/a.jpg", Product: "websites"}, "valid"},
+		{types.ScanRequest{URL: "example.com/a.jpg", Product: "websites"}, "invalid: invalid URL"},
+		{types.ScanRequest{URL: "https://example.com/a.jpg"}, "invalid: missing product"},
+	}
+	for _, tt := range tests {
+		scan := tt.scan
+		if result := publishScan(context.Background(), nil, &scan); result != tt.result {
+			t.Errorf("Expected %q for %+v. Obtained %q", tt.result, tt.scan, result)
+		}
+		if tt.result == "valid" && scan.PublishTime == "" {
+			t.Error("Expected the publish time to be set")
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package hashserve
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/adaptive"
+	"github.com/gdcorp-infosec/hashserve/pkg/allowlist"
+	"github.com/gdcorp-infosec/hashserve/pkg/escalation"
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+	"github.com/gdcorp-infosec/hashserve/pkg/urlpolicy"
+)
+
+// reloadable returns the settings that can be changed without a restart, by
+// name. The allowlist and URL policy files are re-read on every reload.
+func (w *config) reloadable() map[string]*string {
+	return map[string]*string{
+		"LOG_LEVEL":                &w.logLevel,
+		"MAX_RETRY_COUNT":          &w.maxRetryCount,
+		"NO_IMAGE_WORKER_THREADS":  &w.nImageThread,
+		"MIN_IMAGE_WORKER_THREADS": &w.minImageThread,
+		"MAX_IMAGE_WORKER_THREADS": &w.maxImageThread,
+		"HASHER_TARGET_LATENCY":    &w.hasherTargetLatency,
+		"HASHER_MAX_ERROR_RATE":    &w.hasherMaxErrorRate,
+		"ESCALATION_THRESHOLDS":    &w.escalationThresholds,
+	}
+}
+
+// loadFile loads the NAME=value lines of path into the reloadable settings
+// that are not set yet. Blank lines and lines starting with # are ignored.
+func (w *config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fields := w.reloadable()
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("%s:%d: expected NAME=value", path, i+1)
+		}
+		dst, ok := fields[strings.TrimSpace(kv[0])]
+		if !ok {
+			return errors.Errorf("%s:%d: %s cannot be reloaded", path, i+1, strings.TrimSpace(kv[0]))
+		}
+		if *dst == "" {
+			*dst = strings.TrimSpace(kv[1])
+		}
+	}
+	return nil
+}
+
+// levelCore drops the entries below a level that can be changed at runtime.
+type levelCore struct {
+	zapcore.Core
+	level zap.AtomicLevel
+}
+
+func (c *levelCore) Enabled(lvl zapcore.Level) bool {
+	return c.level.Enabled(lvl)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// reloader changes the reloadable settings of a consumer while it runs, on
+// SIGHUP or through the /config admin endpoint. A reload is validated as a
+// whole before any of it is applied, so an invalid one changes nothing.
+type reloader struct {
+	mu     sync.Mutex
+	config *config
+
+	consumer    *rabbitmq.Consumer
+	concurrency *adaptive.Controller
+
+	// Optional lists re-read on every reload, nil when not configured
+	allowlist  *allowlist.List
+	urlPolicy  *urlpolicy.Policy
+	escalation *escalation.Policy
+}
+
+// reload is a validated change of the reloadable settings.
+type reload struct {
+	level         zapcore.Level
+	maxRetryCount int
+	workers       int
+	minWorkers    int
+	maxWorkers    int
+	targetLatency time.Duration
+	maxErrorRate  float64
+	escalation    map[string]escalation.Thresholds
+	allowlist     allowlist.Rules
+	urlPolicy     urlpolicy.Rules
+}
+
+// watch reloads the configuration on every SIGHUP until ctx is done.
+func (r *reloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.reloadFile("SIGHUP"); err != nil {
+				logger.Error(ctx, "Unable to reload configuration", zap.Error(err))
+			}
+		}
+	}
+}
+
+// reloadFile reloads the reloadable settings from CONFIG_FILE and the
+// environment, as at startup.
+func (r *reloader) reloadFile(source string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fresh := &config{offline: r.config.offline, dev: r.config.dev}
+	if err := fresh.load(); err != nil {
+		r.config.audit.Warn("configuration reload rejected", zap.String("source", source), zap.Error(err))
+		return err
+	}
+	values := map[string]string{}
+	for name, v := range fresh.reloadable() {
+		values[name] = *v
+	}
+	return r.apply(source, values)
+}
+
+// set changes the named reloadable settings to the given values.
+func (r *reloader) set(source string, values map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.apply(source, values)
+}
+
+// apply validates the current configuration changed by values and applies it,
+// logging every changed setting. It is called with mu held.
+func (r *reloader) apply(source string, values map[string]string) error {
+	next := *r.config
+	fields := next.reloadable()
+	for name, v := range values {
+		dst, ok := fields[name]
+		if !ok {
+			err := errors.Errorf("%s cannot be reloaded", name)
+			r.config.audit.Warn("configuration reload rejected", zap.String("source", source), zap.Error(err))
+			return err
+		}
+		*dst = v
+	}
+	u, err := r.prepare(&next)
+	if err != nil {
+		r.config.audit.Warn("configuration reload rejected", zap.String("source", source), zap.Error(err))
+		return err
+	}
+
+	r.config.level.SetLevel(u.level)
+	r.consumer.SetMaxRetryCount(u.maxRetryCount)
+	r.concurrency.SetTargets(u.targetLatency, u.maxErrorRate)
+	if next.nImageThread != r.config.nImageThread || next.minImageThread != r.config.minImageThread || next.maxImageThread != r.config.maxImageThread {
+		r.consumer.SetWorkers(u.workers, u.minWorkers, u.maxWorkers)
+	}
+	// Validated by prepare, setting them cannot fail.
+	if r.escalation != nil {
+		r.escalation.Set(u.escalation)
+	}
+	if r.allowlist != nil {
+		r.allowlist.Set(u.allowlist)
+		r.config.audit.Info("configuration file reloaded", zap.String("setting", "ALLOWLIST_FILE"), zap.String("file", next.allowlistFile), zap.String("source", source))
+	}
+	if r.urlPolicy != nil {
+		r.urlPolicy.Set(u.urlPolicy)
+		r.config.audit.Info("configuration file reloaded", zap.String("setting", "URL_POLICY_FILE"), zap.String("file", next.urlPolicyFile), zap.String("source", source))
+	}
+
+	previous := r.config.reloadable()
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changes := 0
+	for _, name := range names {
+		if *fields[name] != *previous[name] {
+			r.config.audit.Info("configuration changed", zap.String("setting", name), zap.String("from", *previous[name]), zap.String("to", *fields[name]), zap.String("source", source))
+			changes++
+		}
+	}
+	r.config = &next
+	r.config.audit.Info("configuration reloaded", zap.String("source", source), zap.Int("changes", changes))
+	return nil
+}
+
+// prepare validates the reloadable settings of next and reads the lists in
+// use, so that applying them cannot fail.
+func (r *reloader) prepare(next *config) (*reload, error) {
+	u := &reload{}
+	var err error
+	if u.level, err = zapcore.ParseLevel(next.logLevel); err != nil {
+		return nil, errors.Errorf("invalid LOG_LEVEL %q", next.logLevel)
+	}
+	if u.maxRetryCount, err = strconv.Atoi(next.maxRetryCount); err != nil || u.maxRetryCount < 0 {
+		return nil, errors.Errorf("invalid MAX_RETRY_COUNT %q", next.maxRetryCount)
+	}
+	minWorkers, maxWorkers := next.workerBounds()
+	for _, s := range []struct {
+		name  string
+		value string
+		dst   *int
+	}{
+		{"NO_IMAGE_WORKER_THREADS", next.nImageThread, &u.workers},
+		{"MIN_IMAGE_WORKER_THREADS", minWorkers, &u.minWorkers},
+		{"MAX_IMAGE_WORKER_THREADS", maxWorkers, &u.maxWorkers},
+	} {
+		if *s.dst, err = strconv.Atoi(s.value); err != nil || *s.dst < 1 {
+			return nil, errors.Errorf("invalid %s %q", s.name, s.value)
+		}
+	}
+	if u.workers < u.minWorkers || u.workers > u.maxWorkers {
+		return nil, errors.Errorf("NO_IMAGE_WORKER_THREADS %d is not between MIN_IMAGE_WORKER_THREADS %d and MAX_IMAGE_WORKER_THREADS %d", u.workers, u.minWorkers, u.maxWorkers)
+	}
+	if u.targetLatency, err = time.ParseDuration(next.hasherTargetLatency); err != nil || u.targetLatency <= 0 {
+		return nil, errors.Errorf("invalid HASHER_TARGET_LATENCY %q", next.hasherTargetLatency)
+	}
+	if u.maxErrorRate, err = strconv.ParseFloat(next.hasherMaxErrorRate, 64); err != nil || u.maxErrorRate < 0 || u.maxErrorRate > 1 {
+		return nil, errors.Errorf("invalid HASHER_MAX_ERROR_RATE %q", next.hasherMaxErrorRate)
+	}
+	switch {
+	case r.escalation == nil && next.escalationThresholds != "":
+		return nil, errors.New("ESCALATION_THRESHOLDS can only be reloaded when set at startup")
+	case r.escalation != nil && next.escalationThresholds == "":
+		return nil, errors.New("ESCALATION_THRESHOLDS cannot be cleared without a restart")
+	case r.escalation != nil:
+		if u.escalation, err = escalation.ParseThresholds(next.escalationThresholds); err != nil {
+			return nil, errors.Wrap(err, "invalid ESCALATION_THRESHOLDS")
+		}
+	}
+	if r.allowlist != nil {
+		if u.allowlist, err = allowlist.ReadRules(next.allowlistFile); err == nil {
+			err = u.allowlist.Validate()
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ALLOWLIST_FILE")
+		}
+	}
+	if r.urlPolicy != nil {
+		if u.urlPolicy, err = urlpolicy.ReadRules(next.urlPolicyFile); err == nil {
+			err = u.urlPolicy.Validate()
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid URL_POLICY_FILE")
+		}
+	}
+	return u, nil
+}
+
+// ServeHTTP reports the reloadable settings on GET, reloads them as on SIGHUP
+// on POST and changes those of a JSON object of names to values on PUT.
+func (r *reloader) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	source := "admin " + req.RemoteAddr
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := r.reloadFile(source); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodPut:
+		values := map[string]string{}
+		if err := json.NewDecoder(req.Body).Decode(&values); err != nil {
+			http.Error(rw, "invalid settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.set(source, values); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mu.Lock()
+	settings := map[string]string{}
+	for name, v := range r.config.reloadable() {
+		settings[name] = *v
+	}
+	r.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(settings)
+}
@@ -0,0 +1,166 @@
+package hashserve
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "hashserve.conf")
+	allowlistFile := filepath.Join(dir, "allowlist.json")
+	write := func(path, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(configFile, "# reloadable settings\nMAX_RETRY_COUNT=3\n")
+	write(allowlistFile, `{"hosts": ["*.wsimg.com"]}`)
+	t.Setenv("ENV", "dev")
+	t.Setenv("CONFIG_FILE", configFile)
+	t.Setenv("NO_IMAGE_WORKER_THREADS", "2")
+	t.Setenv("MAX_IMAGE_WORKER_THREADS", "8")
+	t.Setenv("MAX_RETRY_COUNT", "1")
+	t.Setenv("ALLOWLIST_FILE", allowlistFile)
+	t.Setenv("ESCALATION_THRESHOLDS", `{"*": {"csam": 0.9}}`)
+	t.Setenv("TRACING_EXPORTER", "none")
+
+	ctx, config, undo, err := setupConfig(context.Background(), &config{offline: true, dev: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer undo()
+	if config.maxRetryCount != "3" {
+		t.Errorf("Expected CONFIG_FILE to override MAX_RETRY_COUNT. Obtained %q", config.maxRetryCount)
+	}
+	core, logs := observer.New(zapcore.InfoLevel)
+	config.audit = zap.New(core)
+	_, _, r, err := newConsumer(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, body string) (int, map[string]string) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, "/config", strings.NewReader(body)))
+		settings := map[string]string{}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &settings); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, settings
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		status   int
+		settings map[string]string
+	}{
+		{"get", http.MethodGet, "", http.StatusOK, map[string]string{"LOG_LEVEL": "INFO", "MAX_RETRY_COUNT": "3"}},
+		{"set", http.MethodPut, `{"LOG_LEVEL": "DEBUG", "NO_IMAGE_WORKER_THREADS": "6"}`, http.StatusOK, map[string]string{"LOG_LEVEL": "DEBUG", "NO_IMAGE_WORKER_THREADS": "6"}},
+		{"invalid level", http.MethodPut, `{"LOG_LEVEL": "LOUD", "MAX_RETRY_COUNT": "5"}`, http.StatusBadRequest, nil},
+		{"workers out of bounds", http.MethodPut, `{"NO_IMAGE_WORKER_THREADS": "9"}`, http.StatusBadRequest, nil},
+		{"not reloadable", http.MethodPut, `{"MULTIPLE_BROKERS": "amqp://broker:5672/"}`, http.StatusBadRequest, nil},
+		{"cleared escalation", http.MethodPut, `{"ESCALATION_THRESHOLDS": ""}`, http.StatusBadRequest, nil},
+		{"invalid escalation", http.MethodPut, `{"ESCALATION_THRESHOLDS": "{\"*\": {\"csam\": 2}}"}`, http.StatusBadRequest, nil},
+		{"malformed", http.MethodPut, `{"MAX_RETRY_COUNT": 5}`, http.StatusBadRequest, nil},
+		{"unchanged after rejections", http.MethodGet, "", http.StatusOK, map[string]string{"LOG_LEVEL": "DEBUG", "MAX_RETRY_COUNT": "3", "NO_IMAGE_WORKER_THREADS": "6"}},
+		{"method", http.MethodDelete, "", http.StatusMethodNotAllowed, nil},
+	}
+	for _, tt := range tests {
+		status, settings := do(tt.method, tt.body)
+		if status != tt.status {
+			t.Errorf("%s: expected status %d. Obtained %d", tt.name, tt.status, status)
+		}
+		for name, want := range tt.settings {
+			if settings[name] != want {
+				t.Errorf("%s: expected %s %q. Obtained %q", tt.name, name, want, settings[name])
+			}
+		}
+	}
+	if config.level.Level() != zapcore.DebugLevel || r.concurrency.Limit() != 6 {
+		t.Errorf("Expected the DEBUG level and 6 image workers. Obtained %s and %d", config.level.Level(), r.concurrency.Limit())
+	}
+
+	// A reload re-reads CONFIG_FILE, the environment and the allowlist, and is
+	// rejected as a whole when either is invalid.
+	write(configFile, "MAX_RETRY_COUNT=7\n")
+	write(allowlistFile, `{"hosts": [""]}`)
+	if status, _ := do(http.MethodPost, ""); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid allowlist to be rejected. Obtained %d", status)
+	}
+	write(allowlistFile, `{"hosts": ["*.wsimg.com", "*.example.com"]}`)
+	if status, settings := do(http.MethodPost, ""); status != http.StatusOK || settings["MAX_RETRY_COUNT"] != "7" || settings["LOG_LEVEL"] != "INFO" || settings["NO_IMAGE_WORKER_THREADS"] != "2" {
+		t.Errorf("Expected MAX_RETRY_COUNT 7, LOG_LEVEL INFO and 2 image workers reloaded. Obtained %d %v", status, settings)
+	}
+	if _, ok := r.allowlist.MatchRequest(&types.ScanRequest{URL: "https://img.example.com/a.jpg"}); !ok {
+		t.Error("Expected the reloaded allowlist to match")
+	}
+	write(configFile, "HASHER_URL=http://hasher\n")
+	if status, _ := do(http.MethodPost, ""); status != http.StatusBadRequest {
+		t.Errorf("Expected a CONFIG_FILE setting that cannot be reloaded to be rejected. Obtained %d", status)
+	}
+
+	var changes []string
+	for _, entry := range logs.FilterMessage("configuration changed").All() {
+		fields := entry.ContextMap()
+		changes = append(changes, fields["setting"].(string)+"="+fields["to"].(string))
+	}
+	if want := "LOG_LEVEL=DEBUG NO_IMAGE_WORKER_THREADS=6 LOG_LEVEL=INFO MAX_RETRY_COUNT=7 NO_IMAGE_WORKER_THREADS=2"; strings.Join(changes, " ") != want {
+		t.Errorf("Expected audit lines for %s. Obtained %v", want, changes)
+	}
+	if n := logs.FilterMessage("configuration reload rejected").Len(); n != 7 {
+		t.Errorf("Expected 7 rejected reloads to be logged. Obtained %d", n)
+	}
+}
+
+func TestReloadWorkerBoundsFollow(t *testing.T) {
+	t.Setenv("ENV", "dev")
+	t.Setenv("NO_IMAGE_WORKER_THREADS", "2")
+	t.Setenv("MAX_RETRY_COUNT", "1")
+	t.Setenv("TRACING_EXPORTER", "none")
+	ctx, config, undo, err := setupConfig(context.Background(), &config{offline: true, dev: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer undo()
+	_, _, r, err := newConsumer(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unset bounds follow NO_IMAGE_WORKER_THREADS, set ones are kept.
+	if err := r.set("test", map[string]string{"NO_IMAGE_WORKER_THREADS": "5"}); err != nil {
+		t.Fatalf("Expected only NO_IMAGE_WORKER_THREADS to be reloaded. Obtained %v", err)
+	}
+	if r.concurrency.Limit() != 5 || r.concurrency.Max() != 5 {
+		t.Errorf("Expected 5 image workers with a maximum of 5. Obtained %d with %d", r.concurrency.Limit(), r.concurrency.Max())
+	}
+	if err := r.set("test", map[string]string{"MAX_IMAGE_WORKER_THREADS": "6"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.set("test", map[string]string{"NO_IMAGE_WORKER_THREADS": "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if r.concurrency.Limit() != 3 || r.concurrency.Max() != 6 {
+		t.Errorf("Expected 3 image workers with a maximum of 6. Obtained %d with %d", r.concurrency.Limit(), r.concurrency.Max())
+	}
+	if err := r.set("test", map[string]string{"NO_IMAGE_WORKER_THREADS": "7"}); err == nil {
+		t.Error("Expected NO_IMAGE_WORKER_THREADS above the set MAX_IMAGE_WORKER_THREADS to be rejected")
+	}
+}
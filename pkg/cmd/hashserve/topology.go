@@ -0,0 +1,57 @@
+package hashserve
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+)
+
+// topologyCommand prints the queues of the environment with their message and
+// consumer counts, optionally declaring them first.
+func topologyCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("topology", "")
+	declare := fs.Bool("declare", false, "declare the exchanges, queues and bindings before inspecting them")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	ctx, config, undo, err := setup(ctx)
+	if err != nil {
+		return err
+	}
+	defer undo()
+	conn, err := rabbitmq.Dial(config.amqpBroker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if *declare {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		err = ch.DeclareTopology(config.env)
+		ch.Close()
+		if err != nil {
+			return err
+		}
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EXCHANGE\tKEY\tQUEUE\tMESSAGES\tCONSUMERS")
+	for _, b := range rabbitmq.Topology(config.env) {
+		// A missing queue closes the channel, so each queue is inspected on its own.
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		q, err := ch.QueueInspect(b.Queue)
+		ch.Close()
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t%s\t%s\tmissing\t-\n", b.Exchange, b.Key, b.Queue)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", b.Exchange, b.Key, b.Queue, q.Messages, q.Consumers)
+	}
+	return tw.Flush()
+}
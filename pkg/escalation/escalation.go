@@ -0,0 +1,117 @@
+package escalation
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultProduct is the key of the thresholds applied to products without
+// thresholds of their own.
+const DefaultProduct = "*"
+
+// Thresholds maps an ML score label (e.g. csam) to the score at or above
+// which a fingerprint is escalated. A label applies to the highest score of
+// any model, a "model/label" key (e.g. thorn/csam) to a single model only.
+type Thresholds map[string]float64
+
+// Policy decides which fingerprints are escalated based on their ML scores.
+// It is safe for concurrent use.
+type Policy struct {
+	mu sync.RWMutex
+
+	// Per product thresholds, keyed by product name or DefaultProduct.
+	products map[string]Thresholds
+
+	// AMQP priority set on escalated messages.
+	priority uint8
+}
+
+// NewPolicy creates a Policy from per product thresholds.
+func NewPolicy(products map[string]Thresholds, priority uint8) (*Policy, error) {
+	if err := validate(products); err != nil {
+		return nil, err
+	}
+	return &Policy{products: products, priority: priority}, nil
+}
+
+// ParsePolicy creates a Policy from a JSON object of product name to thresholds,
+// e.g. {"*": {"csam": 0.9}, "websites": {"csam": 0.8, "pornography": 0.95}}.
+func ParsePolicy(s string, priority uint8) (*Policy, error) {
+	products, err := ParseThresholds(s)
+	if err != nil {
+		return nil, err
+	}
+	return NewPolicy(products, priority)
+}
+
+// ParseThresholds parses and validates per product thresholds as ParsePolicy does.
+func ParseThresholds(s string) (map[string]Thresholds, error) {
+	products := map[string]Thresholds{}
+	if err := json.Unmarshal([]byte(s), &products); err != nil {
+		return nil, errors.Wrap(err, "unable to parse escalation thresholds")
+	}
+	if err := validate(products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// Set validates products and atomically replaces the current thresholds with them.
+func (p *Policy) Set(products map[string]Thresholds) error {
+	if err := validate(products); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.products = products
+	return nil
+}
+
+func validate(products map[string]Thresholds) error {
+	for product, thresholds := range products {
+		for label, score := range thresholds {
+			if score < 0 || score > 1 {
+				return errors.Errorf("threshold %v for %s/%s is outside [0, 1]", score, product, label)
+			}
+		}
+	}
+	return nil
+}
+
+// Priority returns the AMQP priority to publish escalations with.
+func (p *Policy) Priority() uint8 {
+	return p.priority
+}
+
+// Evaluate reports whether scores exceed any threshold configured for product
+// and, if so, a human readable reason naming every exceeded label.
+func (p *Policy) Evaluate(product string, scores map[string]float64) (string, bool) {
+	p.mu.RLock()
+	thresholds, ok := p.products[product]
+	if !ok {
+		thresholds = p.products[DefaultProduct]
+	}
+	p.mu.RUnlock()
+	labels := make([]string, 0, len(thresholds))
+	for label := range thresholds {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	reason := ""
+	for _, label := range labels {
+		score, ok := scores[label]
+		if !ok || score < thresholds[label] {
+			continue
+		}
+		if reason != "" {
+			reason += "; "
+		}
+		reason += fmt.Sprintf("%s score %.4f >= %.4f", label, score, thresholds[label])
+	}
+	return reason, reason != ""
+}
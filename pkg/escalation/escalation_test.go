@@ -0,0 +1,62 @@
+package escalation
+
+import (
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	p, err := ParsePolicy(`{"*": {"csam": 0.9}, "websites": {"csam": 0.8, "pornography": 0.95}}`, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		Product  string
+		Scores   map[string]float64
+		Escalate bool
+		Reason   string
+	}{
+		{"websites", map[string]float64{"csam": 0.85}, true, "csam score 0.8500 >= 0.8000"},
+		{"hosting", map[string]float64{"csam": 0.85}, false, ""},
+		{"hosting", map[string]float64{"csam": 0.9}, true, "csam score 0.9000 >= 0.9000"},
+		{"websites", map[string]float64{"csam": 0.81, "pornography": 0.99}, true, "csam score 0.8100 >= 0.8000; pornography score 0.9900 >= 0.9500"},
+		{"websites", map[string]float64{"others": 1}, false, ""},
+	}
+	for _, tc := range testCases {
+		reason, ok := p.Evaluate(tc.Product, tc.Scores)
+		if ok != tc.Escalate || reason != tc.Reason {
+			t.Errorf("%s %v: expected (%q, %t). Obtained (%q, %t)", tc.Product, tc.Scores, tc.Reason, tc.Escalate, reason, ok)
+		}
+	}
+}
+
+func TestParsePolicyRejectsInvalidThresholds(t *testing.T) {
+	if _, err := ParsePolicy(`{"*": {"csam": 1.5}}`, 9); err == nil {
+		t.Error("Expected error for threshold above 1")
+	}
+}
+
+func TestSet(t *testing.T) {
+	p, err := ParsePolicy(`{"*": {"csam": 0.9}}`, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseThresholds(`{"*": {"csam": -0.1}}`); err == nil {
+		t.Error("Expected error for threshold below 0")
+	}
+	if err := p.Set(map[string]Thresholds{"*": {"csam": 2}}); err == nil {
+		t.Error("Expected error setting a threshold above 1")
+	}
+	if _, ok := p.Evaluate("hosting", map[string]float64{"csam": 0.95}); !ok {
+		t.Error("Expected the thresholds to be kept after an invalid set")
+	}
+	thresholds, err := ParseThresholds(`{"*": {"csam": 0.99}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Set(thresholds); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Evaluate("hosting", map[string]float64{"csam": 0.95}); ok {
+		t.Error("Expected no escalation below the new threshold")
+	}
+}
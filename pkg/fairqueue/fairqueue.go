@@ -0,0 +1,208 @@
+package fairqueue
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var backlog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "hashserve_product_backlog",
+	Help: "Number of scans waiting for an image worker, per product.",
+}, []string{"product"})
+
+// Stats describes the scheduler state of a single product.
+type Stats struct {
+	Queued           int `json:"queued"`
+	InFlight         int `json:"inFlight"`
+	Weight           int `json:"weight"`
+	PriorityInFlight int `json:"priorityInFlight"`
+}
+
+type productQueue struct {
+	items    []interface{}
+	inFlight int
+
+	// Virtual time of the product for stride scheduling. Each dispatch
+	// advances it by 1/weight, the product with the lowest pass goes next.
+	pass float64
+}
+
+// Queue is a weighted fair queue with a FIFO sub-queue per product.
+//
+// Products with fewer items in flight than their priority in-flight count are
+// served first. Otherwise products are served in proportion to their weight
+// using stride scheduling. No capacity is kept free for a product, its items
+// only take precedence once they are queued. It is safe for concurrent use.
+//
+// Fairness only applies to the items pushed, which for the consumer are the
+// scans prefetched from a single broker queue. A product whose backlog fills
+// that queue ahead of the others still delays them by the time it takes to
+// drain the backlog, however small the prefetch window is.
+type Queue struct {
+	weights       map[string]int
+	priority      map[string]int
+	defaultWeight int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[string]*productQueue
+	queued int
+	vtime  float64
+	closed bool
+}
+
+// New creates a Queue. Products missing from weights use defaultWeight,
+// products missing from priority are never served ahead of their weight.
+// priority maps a product to the number of items in flight up to which it is
+// served first.
+func New(weights map[string]int, priority map[string]int, defaultWeight int) *Queue {
+	if defaultWeight < 1 {
+		defaultWeight = 1
+	}
+	q := &Queue{
+		weights:       weights,
+		priority:      priority,
+		defaultWeight: defaultWeight,
+		queues:        map[string]*productQueue{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *Queue) weight(product string) int {
+	if w, ok := q.weights[product]; ok && w > 0 {
+		return w
+	}
+	return q.defaultWeight
+}
+
+// Push appends item to the sub-queue of product. Items pushed after Close
+// are dropped and false is returned.
+func (q *Queue) Push(product string, item interface{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	pq, ok := q.queues[product]
+	if !ok {
+		pq = &productQueue{}
+		q.queues[product] = pq
+	}
+	if len(pq.items) == 0 && pq.pass < q.vtime {
+		// A product becoming active again must not use credit accumulated while idle.
+		pq.pass = q.vtime
+	}
+	pq.items = append(pq.items, item)
+	q.queued++
+	backlog.WithLabelValues(product).Set(float64(len(pq.items)))
+	q.cond.Signal()
+	return true
+}
+
+// Pop blocks until an item is available and returns it together with a done
+// func that must be called once the item has been processed. ok is false once
+// the queue is closed and drained.
+func (q *Queue) Pop() (item interface{}, done func(), ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.queued == 0 {
+		if q.closed {
+			return nil, nil, false
+		}
+		q.cond.Wait()
+	}
+
+	product := q.next()
+	pq := q.queues[product]
+	item = pq.items[0]
+	pq.items[0] = nil
+	pq.items = pq.items[1:]
+	pq.inFlight++
+	q.queued--
+	q.vtime = pq.pass
+	pq.pass += 1 / float64(q.weight(product))
+	backlog.WithLabelValues(product).Set(float64(len(pq.items)))
+
+	var once sync.Once
+	return item, func() {
+		once.Do(func() {
+			q.mu.Lock()
+			pq.inFlight--
+			if len(pq.items) == 0 && pq.inFlight == 0 {
+				delete(q.queues, product)
+			}
+			q.mu.Unlock()
+		})
+	}, true
+}
+
+// next picks the product to serve. It must be called with q.mu held and at
+// least one item queued.
+func (q *Queue) next() string {
+	best := ""
+	bestRatio := 1.0
+	for product, pq := range q.queues {
+		priority := q.priority[product]
+		if len(pq.items) == 0 || pq.inFlight >= priority {
+			continue
+		}
+		ratio := float64(pq.inFlight) / float64(priority)
+		if best == "" || ratio < bestRatio || (ratio == bestRatio && product < best) {
+			best, bestRatio = product, ratio
+		}
+	}
+	if best != "" {
+		return best
+	}
+	for product, pq := range q.queues {
+		if len(pq.items) == 0 {
+			continue
+		}
+		if best == "" || pq.pass < q.queues[best].pass || (pq.pass == q.queues[best].pass && product < best) {
+			best = product
+		}
+	}
+	return best
+}
+
+// Close wakes every blocked Pop. Items already queued are still returned.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Backlog returns the scheduler state of every product with queued or in-flight items.
+func (q *Queue) Backlog() map[string]Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := make(map[string]Stats, len(q.queues))
+	for product, pq := range q.queues {
+		if len(pq.items) == 0 && pq.inFlight == 0 {
+			continue
+		}
+		stats[product] = Stats{
+			Queued:           len(pq.items),
+			InFlight:         pq.inFlight,
+			Weight:           q.weight(product),
+			PriorityInFlight: q.priority[product],
+		}
+	}
+	return stats
+}
+
+// ServeHTTP reports the per product backlog as JSON.
+func (q *Queue) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(q.Backlog())
+}
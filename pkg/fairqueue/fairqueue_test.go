@@ -0,0 +1,62 @@
+package fairqueue
+
+import (
+	"testing"
+)
+
+func TestPopIsWeightedFair(t *testing.T) {
+	q := New(map[string]int{"hosting": 2}, nil, 1)
+	for i := 0; i < 100; i++ {
+		q.Push("backfill", i)
+	}
+	for i := 0; i < 10; i++ {
+		q.Push("hosting", i)
+		q.Push("websites", i)
+	}
+	for i := 0; i < 20; i++ {
+		_, done, ok := q.Pop()
+		if !ok {
+			t.Fatal("Expected an item")
+		}
+		done()
+	}
+	counts := map[string]int{}
+	for product, stats := range q.Backlog() {
+		counts[product] = stats.Queued
+	}
+	// hosting has twice the weight of the others, so of 20 pops it gets 10 and the others 5 each.
+	if counts["hosting"] != 0 || counts["websites"] != 5 || counts["backfill"] != 95 {
+		t.Errorf("Unexpected remaining backlog %v", counts)
+	}
+}
+
+func TestPriorityIsServedFirst(t *testing.T) {
+	q := New(nil, map[string]int{"realtime": 1}, 1)
+	for i := 0; i < 5; i++ {
+		q.Push("backfill", i)
+	}
+	q.Push("realtime", "scan")
+	item, _, _ := q.Pop()
+	if item != "scan" {
+		t.Errorf("Expected the priority product to be served first. Obtained %v", item)
+	}
+	q.Push("realtime", "second scan")
+	if item, _, _ := q.Pop(); item == "second scan" {
+		t.Error("Expected the priority product to share once its priority in-flight count is reached")
+	}
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	q := New(nil, nil, 1)
+	q.Push("websites", 1)
+	q.Close()
+	if q.Push("websites", 2) {
+		t.Error("Expected push after close to be refused")
+	}
+	if _, _, ok := q.Pop(); !ok {
+		t.Error("Expected queued item to be returned after close")
+	}
+	if _, _, ok := q.Pop(); ok {
+		t.Error("Expected closed and drained queue to return false")
+	}
+}
@@ -0,0 +1,161 @@
+package contract
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/pdna"
+	"github.com/gdcorp-infosec/hashserve/pkg/rabbitmq"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// Config describes the hasher under test.
+type Config struct {
+	// Base URL of the hasher service, e.g. http://localhost:8080
+	BaseURL string
+
+	// Image the hasher can download and hash
+	ImageURL string
+
+	// Video the hasher can download and hash, the video checks are skipped when empty
+	VideoURL string
+
+	// URL the hasher fails to download because it does not exist
+	MissingURL string
+
+	// Client certificate sent with every hash request
+	Cert string
+
+	// Timeout of every request, defaults to 2 minutes as in hashserve
+	Timeout time.Duration
+}
+
+// Run checks that the hasher at c.BaseURL honours the contract hashserve
+// relies on: the health check, the request and response bodies of the image
+// and video endpoints and the hasher status codes.
+func Run(t *testing.T, c Config) {
+	if c.Timeout == 0 {
+		c.Timeout = 2 * time.Minute
+	}
+	client := &http.Client{Timeout: c.Timeout}
+	base := strings.TrimSuffix(c.BaseURL, "/")
+
+	t.Run("health", func(t *testing.T) {
+		resp, err := client.Get(base + rabbitmq.HASHER_HEALTH_PATH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected a healthy hasher. Obtained HTTP status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("image", func(t *testing.T) {
+		var first types.ImageHashResponse
+		for i := 0; i < 2; i++ {
+			status, body := post(t, client, base+rabbitmq.IMAGE_HASHER_PATH, c.ImageURL, c.Cert)
+			if status != http.StatusOK {
+				t.Fatalf("Expected HTTP status 200. Obtained %d %s", status, body)
+			}
+			var resp types.ImageHashResponse
+			if err := json.Unmarshal(body, &resp); err != nil {
+				t.Fatalf("Expected an image hash response. Obtained %v decoding %s", err, body)
+			}
+			if resp.StatusCode != rabbitmq.HASH_SUCCESS_STATUS_CODE {
+				t.Fatalf("Expected status code %d. Obtained %d %q", rabbitmq.HASH_SUCCESS_STATUS_CODE, resp.StatusCode, resp.StatusMessage)
+			}
+			if resp.URL != "" && resp.URL != c.ImageURL {
+				t.Errorf("Expected the URL %s to be echoed. Obtained %s", c.ImageURL, resp.URL)
+			}
+			checkHex(t, "MD5", resp.Hashes.MD5, 16)
+			checkHex(t, "SHA1", resp.Hashes.SHA1, 20)
+			if _, err := pdna.Parse(resp.Hashes.PDNA); err != nil {
+				t.Errorf("Expected a PhotoDNA hash. Obtained %v parsing %q", err, resp.Hashes.PDNA)
+			}
+			for _, model := range resp.MlScores {
+				if model.Model == "" {
+					t.Errorf("Expected every model result to name its model. Obtained %+v", model)
+				}
+			}
+			if i == 0 {
+				first = resp
+			} else if resp.Hashes != first.Hashes {
+				t.Errorf("Expected the same hashes for the same image. Obtained %+v and %+v", first.Hashes, resp.Hashes)
+			}
+		}
+	})
+
+	t.Run("missing image", func(t *testing.T) {
+		status, body := post(t, client, base+rabbitmq.IMAGE_HASHER_PATH, c.MissingURL, c.Cert)
+		var resp types.ImageHashResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("Expected an image hash response with HTTP status %d. Obtained %v decoding %s", status, err, body)
+		}
+		if resp.StatusCode != rabbitmq.DOWNLOAD_FAILED_FILE_NOT_FOUND_CODE {
+			t.Errorf("Expected status code %d. Obtained %d %q", rabbitmq.DOWNLOAD_FAILED_FILE_NOT_FOUND_CODE, resp.StatusCode, resp.StatusMessage)
+		}
+		if resp.Hashes.MD5 != "" || resp.Hashes.PDNA != "" {
+			t.Errorf("Expected no hashes. Obtained %+v", resp.Hashes)
+		}
+	})
+
+	t.Run("malformed request", func(t *testing.T) {
+		resp, err := client.Post(base+rabbitmq.IMAGE_HASHER_PATH, "application/json", strings.NewReader(`{"URL": `))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 400 || resp.StatusCode > 499 {
+			t.Errorf("Expected a client error. Obtained HTTP status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("video", func(t *testing.T) {
+		if c.VideoURL == "" {
+			t.Skip("no video URL configured")
+		}
+		status, body := post(t, client, base+rabbitmq.VIDEO_HASHER_PATH, c.VideoURL, c.Cert)
+		if status != http.StatusOK {
+			t.Fatalf("Expected HTTP status 200. Obtained %d %s", status, body)
+		}
+		var resp types.VideoHashResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("Expected a video hash response. Obtained %v decoding %s", err, body)
+		}
+		checkHex(t, "MD5", resp.MD5, 16)
+		checkHex(t, "SHA1", resp.SHA1, 20)
+	})
+}
+
+// post sends the hash request hashserve would send for url.
+func post(t *testing.T, client *http.Client, endpoint string, url string, cert string) (int, []byte) {
+	t.Helper()
+	reqJson, err := json.Marshal(types.HashRequest{URL: url, Cert: cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(reqJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func checkHex(t *testing.T, name string, value string, size int) {
+	t.Helper()
+	if b, err := hex.DecodeString(value); err != nil || len(b) != size {
+		t.Errorf("Expected a hex encoded %s of %d bytes. Obtained %q", name, size, value)
+	}
+}
@@ -0,0 +1,46 @@
+package contract
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/fakehasher"
+)
+
+// TestFakeHasher checks the fake hasher honours the contract.
+func TestFakeHasher(t *testing.T) {
+	h := fakehasher.New(fakehasher.DefaultBehaviour())
+	h.SetScript(&fakehasher.Script{Rules: []fakehasher.Rule{{
+		URL:       "https://example.com/missing/*",
+		Responses: []fakehasher.Response{{StatusCode: fakehasher.StatusDownloadNotFound, HTTPStatus: 200}},
+	}}})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	Run(t, Config{
+		BaseURL:    srv.URL,
+		ImageURL:   "https://example.com/a.jpg",
+		VideoURL:   "https://example.com/a.mp4",
+		MissingURL: "https://example.com/missing/a.jpg",
+	})
+}
+
+// TestHasher checks a real hasher honours the contract. It is skipped unless
+// HASHER_CONTRACT_URL is set, e.g.
+//
+//	HASHER_CONTRACT_URL=http://localhost:8080 \
+//	HASHER_CONTRACT_IMAGE_URL=https://... HASHER_CONTRACT_MISSING_URL=https://... \
+//	go test ./pkg/fakehasher/contract -run TestHasher
+func TestHasher(t *testing.T) {
+	url := os.Getenv("HASHER_CONTRACT_URL")
+	if url == "" {
+		t.Skip("HASHER_CONTRACT_URL is not set")
+	}
+	Run(t, Config{
+		BaseURL:    url,
+		ImageURL:   os.Getenv("HASHER_CONTRACT_IMAGE_URL"),
+		VideoURL:   os.Getenv("HASHER_CONTRACT_VIDEO_URL"),
+		MissingURL: os.Getenv("HASHER_CONTRACT_MISSING_URL"),
+		Cert:       os.Getenv("HASHER_CONTRACT_CERT"),
+	})
+}
@@ -0,0 +1,282 @@
+package fakehasher
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/pdna"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// Paths served by the hasher service.
+const (
+	ImagePath  = "/v1/hash/image"
+	VideoPath  = "/v1/hash/video"
+	HealthPath = "/health"
+
+	// Paths of the Behaviour and Script of the Hasher, which are not part of the hasher service.
+	BehaviourPath = "/behaviour"
+	ScriptPath    = "/script"
+)
+
+// Hasher status codes of image responses.
+const (
+	StatusSuccess          = 1
+	StatusDownloadNotFound = 4
+)
+
+// Behaviour controls the responses of a Hasher to URLs its Script has no
+// response for.
+type Behaviour struct {
+	// Hasher status code of image responses, 1 is success and 4 a download failure
+	StatusCode int `json:"statusCode"`
+
+	// HTTP status of hash responses
+	HTTPStatus int `json:"httpStatus"`
+
+	// Delay before every hash response
+	LatencyMs int `json:"latencyMs"`
+
+	// Distribution of a delay added to LatencyMs, see ParseLatency
+	Latency string `json:"latency,omitempty"`
+
+	// Set to make the health check fail
+	Unhealthy bool `json:"unhealthy"`
+}
+
+// DefaultBehaviour hashes every URL successfully without delay.
+func DefaultBehaviour() Behaviour {
+	return Behaviour{StatusCode: StatusSuccess, HTTPStatus: http.StatusOK}
+}
+
+// Hasher is a stand-in for the hasher service. It never downloads the URLs it
+// is asked to hash and returns hashes derived from the URL instead, so the same
+// URL always gets the same hashes, unless its Script says otherwise. It is safe
+// for concurrent use.
+type Hasher struct {
+	mu        sync.Mutex
+	behaviour Behaviour
+	latency   Latency
+	script    *Script
+	mux       *http.ServeMux
+
+	// Number of responses the script gave per rule and URL, and of health checks
+	calls  map[string]int
+	health int
+}
+
+// New creates a Hasher responding as b.
+func New(b Behaviour) *Hasher {
+	h := &Hasher{script: &Script{}, mux: http.NewServeMux(), calls: map[string]int{}}
+	h.SetBehaviour(b)
+	h.mux.HandleFunc(ImagePath, h.hashImage)
+	h.mux.HandleFunc(VideoPath, h.hashVideo)
+	h.mux.HandleFunc(HealthPath, h.serveHealth)
+	h.mux.HandleFunc(BehaviourPath, h.serveBehaviour)
+	h.mux.HandleFunc(ScriptPath, h.serveScript)
+	return h
+}
+
+// Behaviour returns the current behaviour.
+func (h *Hasher) Behaviour() Behaviour {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.behaviour
+}
+
+// SetBehaviour changes the responses of subsequent requests. A latency
+// distribution that does not parse adds no delay.
+func (h *Hasher) SetBehaviour(b Behaviour) {
+	latency, _ := ParseLatency(b.Latency)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.behaviour = b
+	h.latency = latency
+}
+
+// Script returns the current script.
+func (h *Hasher) Script() *Script {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.script
+}
+
+// SetScript replaces the script and restarts its response sequences.
+func (h *Hasher) SetScript(s *Script) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.script = s
+	h.calls = map[string]int{}
+	h.health = 0
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Hasher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(rw, r)
+}
+
+// Hashes returns the hashes the Hasher returns for url without a fixture.
+func Hashes(url string) types.Hashes {
+	md5Sum := md5.Sum([]byte(url))
+	sha1Sum := sha1.Sum([]byte(url))
+	var photoDNA []byte
+	for block := sha256.Sum256([]byte(url)); len(photoDNA) < pdna.HashSize; block = sha256.Sum256(block[:]) {
+		photoDNA = append(photoDNA, block[:]...)
+	}
+	return types.Hashes{
+		PDNA: base64.StdEncoding.EncodeToString(photoDNA[:pdna.HashSize]),
+		MD5:  hex.EncodeToString(md5Sum[:]),
+		SHA1: hex.EncodeToString(sha1Sum[:]),
+	}
+}
+
+// respond returns the next response for url, from the script if it has one
+// and from the behaviour otherwise.
+func (h *Hasher) respond(url string) Response {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key, responses, cycle := h.script.responses(url)
+	if len(responses) == 0 {
+		latencyMs := h.behaviour.LatencyMs + int(h.latency.Sample()/time.Millisecond)
+		return Response{StatusCode: h.behaviour.StatusCode, HTTPStatus: h.behaviour.HTTPStatus, LatencyMs: latencyMs}
+	}
+	n := h.calls[key]
+	h.calls[key]++
+	return pick(responses, n, cycle)
+}
+
+// decode reads the hash request of r and returns its scripted response once
+// its latency has passed. It writes an error response and returns false when
+// the request is invalid.
+func (h *Hasher) decode(rw http.ResponseWriter, r *http.Request) (types.HashRequest, Response, bool) {
+	var req types.HashRequest
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return req, Response{}, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return req, Response{}, false
+	}
+	resp := h.respond(req.URL)
+	select {
+	case <-time.After(time.Duration(resp.LatencyMs) * time.Millisecond):
+	case <-r.Context().Done():
+		return req, resp, false
+	}
+	return req, resp, true
+}
+
+// write writes the raw body of resp, if any, or v as JSON.
+func write(rw http.ResponseWriter, resp Response, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(resp.HTTPStatus)
+	if resp.Body != nil {
+		rw.Write([]byte(*resp.Body))
+		return
+	}
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (h *Hasher) hashImage(rw http.ResponseWriter, r *http.Request) {
+	req, resp, ok := h.decode(rw, r)
+	if !ok {
+		return
+	}
+	hashed := types.ImageHashResponse{URL: req.URL, StatusCode: resp.StatusCode, StatusMessage: "fake hasher", MlScores: resp.Scores}
+	if resp.StatusCode == StatusSuccess {
+		hashed.Hashes = Hashes(req.URL)
+		if resp.Hashes != nil {
+			hashed.Hashes = *resp.Hashes
+		}
+	}
+	write(rw, resp, hashed)
+}
+
+func (h *Hasher) hashVideo(rw http.ResponseWriter, r *http.Request) {
+	req, resp, ok := h.decode(rw, r)
+	if !ok {
+		return
+	}
+	hashes := Hashes(req.URL)
+	if resp.Hashes != nil {
+		hashes = *resp.Hashes
+	}
+	write(rw, resp, types.VideoHashResponse{URL: req.URL, MD5: hashes.MD5, SHA1: hashes.SHA1})
+}
+
+func (h *Hasher) serveHealth(rw http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	status := http.StatusOK
+	if h.behaviour.Unhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	if health := h.script.Health; len(health) > 0 {
+		status = health[len(health)-1]
+		if h.health < len(health) {
+			status = health[h.health]
+		}
+		h.health++
+	}
+	h.mu.Unlock()
+	rw.WriteHeader(status)
+	rw.Write([]byte(strconv.Itoa(status)))
+}
+
+// serveBehaviour reports the behaviour on GET and replaces it on PUT.
+func (h *Hasher) serveBehaviour(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		b := DefaultBehaviour()
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !validHTTPStatus(b.HTTPStatus) {
+			http.Error(rw, "invalid httpStatus", http.StatusBadRequest)
+			return
+		}
+		if _, err := ParseLatency(b.Latency); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.SetBehaviour(b)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(h.Behaviour())
+}
+
+// serveScript reports the script on GET and replaces it on PUT.
+func (h *Hasher) serveScript(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		s, err := ParseScript(r.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.SetScript(s)
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(h.Script())
+}
+
+func validHTTPStatus(status int) bool {
+	return status >= 100 && status <= 999
+}
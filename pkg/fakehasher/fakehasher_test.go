@@ -0,0 +1,270 @@
+package fakehasher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/pdna"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+func hashImage(t *testing.T, srv *httptest.Server, url string) (types.ImageHashResponse, int) {
+	body, _ := json.Marshal(types.HashRequest{URL: url})
+	resp, err := http.Post(srv.URL+ImagePath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var hashed types.ImageHashResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hashed); err != nil {
+		t.Fatal(err)
+	}
+	return hashed, resp.StatusCode
+}
+
+func TestHashImage(t *testing.T) {
+	h := New(DefaultBehaviour())
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	a, status := hashImage(t, srv, "https://example.com/a.jpg")
+	if status != http.StatusOK || a.StatusCode != 1 || a.URL != "https://example.com/a.jpg" {
+		t.Fatalf("Expected a successful response. Obtained %d %+v", status, a)
+	}
+	if _, err := pdna.Parse(a.Hashes.PDNA); err != nil {
+		t.Errorf("Expected a valid PhotoDNA hash. Obtained %v", err)
+	}
+	again, _ := hashImage(t, srv, "https://example.com/a.jpg")
+	b, _ := hashImage(t, srv, "https://example.com/b.jpg")
+	if again.Hashes != a.Hashes || b.Hashes.MD5 == a.Hashes.MD5 || b.Hashes.PDNA == a.Hashes.PDNA {
+		t.Errorf("Expected hashes to depend on the URL only. Obtained %+v, %+v and %+v", a.Hashes, again.Hashes, b.Hashes)
+	}
+
+	h.SetBehaviour(Behaviour{StatusCode: 4, HTTPStatus: http.StatusInternalServerError})
+	failed, status := hashImage(t, srv, "https://example.com/a.jpg")
+	if status != http.StatusInternalServerError || failed.StatusCode != 4 || failed.Hashes.MD5 != "" {
+		t.Errorf("Expected a failed response without hashes. Obtained %d %+v", status, failed)
+	}
+}
+
+func TestBehaviourEndpoint(t *testing.T) {
+	h := New(DefaultBehaviour())
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tests := []struct {
+		body   string
+		status int
+		health int
+	}{
+		{`{"statusCode": 4, "latencyMs": 1}`, http.StatusOK, http.StatusOK},
+		{`{"unhealthy": true}`, http.StatusOK, http.StatusServiceUnavailable},
+		{`{"httpStatus": 42}`, http.StatusBadRequest, http.StatusServiceUnavailable},
+		{`{`, http.StatusBadRequest, http.StatusServiceUnavailable},
+		{`{"latency": "gamma:1ms"}`, http.StatusBadRequest, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+BehaviourPath, strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("Expected status %d for %s. Obtained %d", tt.status, tt.body, resp.StatusCode)
+		}
+		resp, err = http.Get(srv.URL + HealthPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.health {
+			t.Errorf("Expected health %d after %s. Obtained %d", tt.health, tt.body, resp.StatusCode)
+		}
+	}
+	if b := h.Behaviour(); !b.Unhealthy || b.StatusCode != 1 || b.HTTPStatus != http.StatusOK {
+		t.Errorf("Expected unset fields to keep their defaults. Obtained %+v", b)
+	}
+}
+
+func TestParseLatency(t *testing.T) {
+	tests := []struct {
+		latency string
+		min     time.Duration
+		max     time.Duration
+		mean    time.Duration
+		err     bool
+	}{
+		{"", 0, 0, 0, false},
+		{"20ms", 20 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond, false},
+		{"fixed:20ms", 20 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond, false},
+		{"uniform:10ms-30ms", 10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond, false},
+		{"exp:20ms", 0, time.Hour, 20 * time.Millisecond, false},
+		{"normal:20ms,2ms", 0, time.Hour, 20 * time.Millisecond, false},
+		{"uniform:30ms-10ms", 0, 0, 0, true},
+		{"uniform:10ms", 0, 0, 0, true},
+		{"normal:20ms", 0, 0, 0, true},
+		{"exp:-1ms", 0, 0, 0, true},
+		{"gamma:1ms", 0, 0, 0, true},
+		{"fast", 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		l, err := ParseLatency(tt.latency)
+		if (err != nil) != tt.err {
+			t.Errorf("Expected error %v parsing %q. Obtained %v", tt.err, tt.latency, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var sum time.Duration
+		const n = 10000
+		for i := 0; i < n; i++ {
+			d := l.Sample()
+			if d < tt.min || d > tt.max {
+				t.Fatalf("Expected %q samples within [%s, %s]. Obtained %s", tt.latency, tt.min, tt.max, d)
+			}
+			sum += d
+		}
+		if mean := sum / n; mean < tt.mean*9/10 || mean > tt.mean*11/10 {
+			t.Errorf("Expected a mean of %s for %q. Obtained %s", tt.mean, tt.latency, mean)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	s, err := ParseScript(strings.NewReader(`{
+		"rules": [
+			{"url": "https://example.com/flaky/*", "responses": [{"httpStatus": 502, "body": "bad gateway"}, {"statusCode": 4}, {}]},
+			{"url": "https://example.com/cycle.jpg", "cycle": true, "responses": [{"statusCode": 4}, {}]},
+			{"url": "https://example.com/fixture.jpg", "responses": [{"hashes": {"MD5": "fixture"}}]}
+		],
+		"default": [{"body": "{"}],
+		"health": [503, 200]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(DefaultBehaviour())
+	h.SetScript(s)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tests := []struct {
+		url        string
+		httpStatus int
+		statusCode int
+		md5        string
+	}{
+		{"https://example.com/flaky/a.jpg", 502, 0, ""},
+		{"https://example.com/flaky/b.jpg", 502, 0, ""},
+		{"https://example.com/flaky/a.jpg", 200, 4, ""},
+		{"https://example.com/flaky/a.jpg", 200, 1, Hashes("https://example.com/flaky/a.jpg").MD5},
+		{"https://example.com/flaky/a.jpg", 200, 1, Hashes("https://example.com/flaky/a.jpg").MD5},
+		{"https://example.com/cycle.jpg", 200, 4, ""},
+		{"https://example.com/cycle.jpg", 200, 1, Hashes("https://example.com/cycle.jpg").MD5},
+		{"https://example.com/cycle.jpg", 200, 4, ""},
+		{"https://example.com/fixture.jpg", 200, 1, "fixture"},
+	}
+	for i, tt := range tests {
+		body, _ := json.Marshal(types.HashRequest{URL: tt.url})
+		resp, err := http.Post(srv.URL+ImagePath, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hashed types.ImageHashResponse
+		json.NewDecoder(resp.Body).Decode(&hashed)
+		resp.Body.Close()
+		if resp.StatusCode != tt.httpStatus || hashed.StatusCode != tt.statusCode || hashed.Hashes.MD5 != tt.md5 {
+			t.Errorf("Expected response %d for %s to be %d %d %q. Obtained %d %+v", i+1, tt.url, tt.httpStatus, tt.statusCode, tt.md5, resp.StatusCode, hashed)
+		}
+	}
+
+	body, _ := json.Marshal(types.HashRequest{URL: "https://example.com/other.jpg"})
+	resp, err := http.Post(srv.URL+ImagePath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(raw) != "{" {
+		t.Errorf("Expected the malformed default body. Obtained %q", raw)
+	}
+
+	for _, want := range []int{503, 200, 200} {
+		resp, err := http.Get(srv.URL + HealthPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Expected health %d. Obtained %d", want, resp.StatusCode)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	tests := []struct {
+		script string
+		err    bool
+	}{
+		{`{}`, false},
+		{`{"rules": [{"url": "https://example.com/*", "responses": [{}]}]}`, false},
+		{`{"rules": [{"url": "https://example.com/[", "responses": [{}]}]}`, true},
+		{`{"rules": [{"url": "https://example.com/a.jpg"}]}`, true},
+		{`{"default": [{"httpStatus": 42}]}`, true},
+		{`{"default": [{"latencyMs": -1}]}`, true},
+		{`{"health": [0]}`, true},
+		{`{"defaults": []}`, true},
+	}
+	for _, tt := range tests {
+		if _, err := ParseScript(strings.NewReader(tt.script)); (err != nil) != tt.err {
+			t.Errorf("Expected error %v parsing %s. Obtained %v", tt.err, tt.script, err)
+		}
+	}
+}
+
+func TestScriptEndpoint(t *testing.T) {
+	h := New(DefaultBehaviour())
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+ScriptPath, strings.NewReader(`{"default": [{"statusCode": 4}]}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the script to be accepted. Obtained %d", resp.StatusCode)
+	}
+	if hashed, _ := hashImage(t, srv, "https://example.com/a.jpg"); hashed.StatusCode != 4 {
+		t.Errorf("Expected the scripted status code. Obtained %+v", hashed)
+	}
+	req, _ = http.NewRequest(http.MethodPut, srv.URL+ScriptPath, strings.NewReader(`{"health": [0]}`))
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || len(h.Script().Default) != 1 {
+		t.Errorf("Expected an invalid script to be refused and the previous one kept. Obtained %d", resp.StatusCode)
+	}
+}
+
+func TestLoadScript(t *testing.T) {
+	s, err := LoadScript("testdata/script.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Rules) != 4 || s.Rules[1].Responses[1].StatusCode != StatusSuccess || s.Rules[1].Responses[1].HTTPStatus != http.StatusOK {
+		t.Errorf("Expected 4 rules with response defaults filled in. Obtained %+v", s.Rules)
+	}
+	if _, err := LoadScript("testdata/missing.json"); err == nil {
+		t.Error("Expected an error loading a missing script")
+	}
+}
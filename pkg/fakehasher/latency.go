@@ -0,0 +1,87 @@
+package fakehasher
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Latency is a distribution of response latencies.
+type Latency struct {
+	kind string
+	a, b time.Duration
+}
+
+// Kinds of latency distributions.
+const (
+	latencyFixed       = "fixed"
+	latencyUniform     = "uniform"
+	latencyExponential = "exp"
+	latencyNormal      = "normal"
+)
+
+// ParseLatency parses a latency distribution: a duration for a fixed latency,
+// uniform:<min>-<max>, exp:<mean> or normal:<mean>,<stddev>, e.g. exp:50ms.
+// The empty string is no latency.
+func ParseLatency(s string) (Latency, error) {
+	if s == "" {
+		return Latency{}, nil
+	}
+	kind, params := latencyFixed, s
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, params = s[:i], s[i+1:]
+	}
+	var sep string
+	switch kind {
+	case latencyFixed, latencyExponential:
+	case latencyUniform:
+		sep = "-"
+	case latencyNormal:
+		sep = ","
+	default:
+		return Latency{}, errors.Errorf("unknown latency distribution %q", kind)
+	}
+	values := []string{params}
+	if sep != "" {
+		if values = strings.SplitN(params, sep, 2); len(values) != 2 {
+			return Latency{}, errors.Errorf("invalid %s latency %q", kind, s)
+		}
+	}
+	l := Latency{kind: kind}
+	for i, v := range values {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d < 0 {
+			return Latency{}, errors.Errorf("invalid %s latency %q", kind, s)
+		}
+		if i == 0 {
+			l.a = d
+		} else {
+			l.b = d
+		}
+	}
+	if kind == latencyUniform && l.b < l.a {
+		return Latency{}, errors.Errorf("invalid %s latency %q", kind, s)
+	}
+	return l, nil
+}
+
+// Sample returns a latency drawn from the distribution, never negative.
+func (l Latency) Sample() time.Duration {
+	var d time.Duration
+	switch l.kind {
+	case latencyFixed:
+		d = l.a
+	case latencyUniform:
+		d = l.a + time.Duration(rand.Int63n(int64(l.b-l.a)+1))
+	case latencyExponential:
+		d = time.Duration(rand.ExpFloat64() * float64(l.a))
+	case latencyNormal:
+		d = l.a + time.Duration(rand.NormFloat64()*float64(l.b))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
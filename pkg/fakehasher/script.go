@@ -0,0 +1,147 @@
+package fakehasher
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// Response is a scripted hash response.
+type Response struct {
+	// Hasher status code of image responses, defaults to 1 (success)
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// HTTP status, defaults to 200
+	HTTPStatus int `json:"httpStatus,omitempty"`
+
+	// Delay before the response
+	LatencyMs int `json:"latencyMs,omitempty"`
+
+	// Hashes of a successful response instead of the hashes derived from the URL
+	Hashes *types.Hashes `json:"hashes,omitempty"`
+
+	// ML scores of image responses
+	Scores types.MlScores `json:"scores,omitempty"`
+
+	// Raw body sent instead of the JSON response, e.g. to send malformed bodies
+	Body *string `json:"body,omitempty"`
+}
+
+// Rule scripts the responses to the URLs matching URL.
+type Rule struct {
+	// URL, or path.Match pattern of URLs, the rule applies to
+	URL string `json:"url"`
+
+	// Successive responses to each URL, the last one repeats
+	Responses []Response `json:"responses"`
+
+	// Start over after the last response instead of repeating it
+	Cycle bool `json:"cycle,omitempty"`
+}
+
+// Script scripts the responses of a Hasher. The sequences of responses are
+// followed per URL, so concurrent requests for other URLs do not advance them.
+type Script struct {
+	// Rules in order of precedence
+	Rules []Rule `json:"rules,omitempty"`
+
+	// Successive responses to each URL no rule matches, the Behaviour of the
+	// Hasher applies when empty
+	Default []Response `json:"default,omitempty"`
+
+	// HTTP statuses of successive health checks, the last one repeats
+	Health []int `json:"health,omitempty"`
+}
+
+// LoadScript loads a JSON script file.
+func LoadScript(path string) (*Script, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ParseScript(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid script %s", path)
+	}
+	return s, nil
+}
+
+// ParseScript decodes and validates a JSON script and fills in the defaults of
+// its responses.
+func ParseScript(r io.Reader) (*Script, error) {
+	s := &Script{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, err
+	}
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+		if _, err := path.Match(rule.URL, ""); err != nil {
+			return nil, errors.Wrapf(err, "rule %d", i+1)
+		}
+		if len(rule.Responses) == 0 {
+			return nil, errors.Errorf("rule %d has no responses", i+1)
+		}
+		if err := normalise(rule.Responses); err != nil {
+			return nil, errors.Wrapf(err, "rule %d", i+1)
+		}
+	}
+	if err := normalise(s.Default); err != nil {
+		return nil, errors.Wrap(err, "default")
+	}
+	for _, status := range s.Health {
+		if !validHTTPStatus(status) {
+			return nil, errors.Errorf("invalid health status %d", status)
+		}
+	}
+	return s, nil
+}
+
+func normalise(responses []Response) error {
+	for i := range responses {
+		resp := &responses[i]
+		if resp.StatusCode == 0 {
+			resp.StatusCode = StatusSuccess
+		}
+		if resp.HTTPStatus == 0 {
+			resp.HTTPStatus = 200
+		}
+		if !validHTTPStatus(resp.HTTPStatus) {
+			return errors.Errorf("response %d has an invalid httpStatus %d", i+1, resp.HTTPStatus)
+		}
+		if resp.LatencyMs < 0 {
+			return errors.Errorf("response %d has a negative latencyMs", i+1)
+		}
+	}
+	return nil
+}
+
+// responses returns the responses scripted for url and the key its sequence is
+// counted under.
+func (s *Script) responses(url string) (string, []Response, bool) {
+	for i, rule := range s.Rules {
+		if ok, _ := path.Match(rule.URL, url); ok || rule.URL == url {
+			return strconv.Itoa(i) + " " + url, rule.Responses, rule.Cycle
+		}
+	}
+	return "default " + url, s.Default, false
+}
+
+// pick returns response n of a sequence.
+func pick(responses []Response, n int, cycle bool) Response {
+	if cycle {
+		return responses[n%len(responses)]
+	}
+	if n >= len(responses) {
+		return responses[len(responses)-1]
+	}
+	return responses[n]
+}
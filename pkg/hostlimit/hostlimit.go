@@ -0,0 +1,132 @@
+package hostlimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// idleTimeout is how long a host without requests is tracked before its
+// state is discarded.
+const idleTimeout = 5 * time.Minute
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hashserve_host_requests_total",
+		Help: "Number of hasher requests per scanned host, by admission outcome.",
+	}, []string{"host", "outcome"})
+	inFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hashserve_host_inflight",
+		Help: "Number of in-flight hasher requests per scanned host.",
+	}, []string{"host"})
+)
+
+type hostState struct {
+	inFlight int
+
+	// Token bucket of the rate limit, refilled since last.
+	tokens float64
+	last   time.Time
+
+	// Last time a request to the host started or completed.
+	seen time.Time
+}
+
+// Limiter bounds the number of concurrent requests and the request rate
+// towards any single host. It never blocks, callers are expected to defer
+// work for a saturated host. It is safe for concurrent use.
+type Limiter struct {
+	// Maximum concurrent requests per host, 0 for no limit.
+	maxConcurrent int
+
+	// Sustained requests per second per host, 0 for no limit.
+	rate float64
+
+	// Number of requests a host may receive in a burst above rate.
+	burst float64
+
+	now func() time.Time
+
+	mu        sync.Mutex
+	hosts     map[string]*hostState
+	lastSweep time.Time
+}
+
+// New creates a Limiter. A zero maxConcurrent or rate disables that limit.
+func New(maxConcurrent int, rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		maxConcurrent: maxConcurrent,
+		rate:          rate,
+		burst:         float64(burst),
+		now:           time.Now,
+		hosts:         map[string]*hostState{},
+	}
+}
+
+// TryAcquire admits a request to host if neither its concurrency nor its rate
+// limit is exhausted. On success the returned release func must be called
+// once the request has completed.
+func (l *Limiter) TryAcquire(host string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	st, found := l.hosts[host]
+	if !found {
+		st = &hostState{tokens: l.burst, last: now}
+		l.hosts[host] = st
+	}
+	if l.rate > 0 {
+		st.tokens += now.Sub(st.last).Seconds() * l.rate
+		if st.tokens > l.burst {
+			st.tokens = l.burst
+		}
+	}
+	st.last = now
+	st.seen = now
+
+	if (l.maxConcurrent > 0 && st.inFlight >= l.maxConcurrent) || (l.rate > 0 && st.tokens < 1) {
+		requests.WithLabelValues(host, "deferred").Inc()
+		return nil, false
+	}
+	if l.rate > 0 {
+		st.tokens--
+	}
+	st.inFlight++
+	requests.WithLabelValues(host, "admitted").Inc()
+	inFlight.WithLabelValues(host).Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			st.inFlight--
+			st.seen = l.now()
+			l.mu.Unlock()
+			inFlight.WithLabelValues(host).Dec()
+		})
+	}, true
+}
+
+// sweep forgets idle hosts and their metric series so neither grows with every
+// host ever seen.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for host, st := range l.hosts {
+		if st.inFlight == 0 && now.Sub(st.seen) > idleTimeout {
+			delete(l.hosts, host)
+			inFlight.DeleteLabelValues(host)
+			requests.DeleteLabelValues(host, "admitted")
+			requests.DeleteLabelValues(host, "deferred")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package hostlimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTryAcquireConcurrency(t *testing.T) {
+	l := New(2, 0, 0)
+	r1, ok1 := l.TryAcquire("a.example.com")
+	_, ok2 := l.TryAcquire("a.example.com")
+	if !ok1 || !ok2 {
+		t.Fatal("Expected first two requests to be admitted")
+	}
+	if _, ok := l.TryAcquire("a.example.com"); ok {
+		t.Error("Expected third concurrent request to be deferred")
+	}
+	if _, ok := l.TryAcquire("b.example.com"); !ok {
+		t.Error("Expected request to another host to be admitted")
+	}
+	r1()
+	r1()
+	if _, ok := l.TryAcquire("a.example.com"); !ok {
+		t.Error("Expected request to be admitted after release")
+	}
+	if _, ok := l.TryAcquire("a.example.com"); ok {
+		t.Error("Expected double release to free a single slot")
+	}
+}
+
+func TestTryAcquireRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(0, 2, 2)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if _, ok := l.TryAcquire("a.example.com"); !ok {
+			t.Fatalf("Expected burst request %d to be admitted", i)
+		}
+	}
+	if _, ok := l.TryAcquire("a.example.com"); ok {
+		t.Error("Expected request above burst to be deferred")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if _, ok := l.TryAcquire("a.example.com"); !ok {
+		t.Error("Expected request to be admitted once a token refilled")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(1, 0, 0)
+	l.now = func() time.Time { return now }
+	series := countSeries(requests)
+	release, _ := l.TryAcquire("idle.example.com")
+	l.TryAcquire("idle.example.com")
+	release()
+	if n := countSeries(requests); n != series+2 {
+		t.Fatalf("Expected 2 request series for the host. Obtained %d", n-series)
+	}
+	now = now.Add(2 * idleTimeout)
+	l.sweep(now)
+	if len(l.hosts) != 0 {
+		t.Errorf("Expected the idle host to be forgotten. Obtained %d hosts", len(l.hosts))
+	}
+	if n := countSeries(requests); n != series {
+		t.Errorf("Expected the request series of the idle host to be deleted. Obtained %d left", n-series)
+	}
+}
+
+func countSeries(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,114 @@
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// Kind is the content type of a generated scan, which hashserve detects from
+// the extension of its URL.
+type Kind string
+
+// Kinds of generated scans.
+const (
+	Image Kind = "image"
+	Video Kind = "video"
+	Misc  Kind = "misc"
+)
+
+// Kinds lists every Kind in report order.
+var Kinds = []Kind{Image, Video, Misc}
+
+var extensions = map[Kind]string{Image: ".jpg", Video: ".mp4", Misc: ".pdf"}
+
+// Mix is the relative weight of each kind of generated scan.
+type Mix map[Kind]int
+
+// ParseMix parses comma separated kind=weight pairs, e.g. image=90,video=5,misc=5.
+// Kinds that are not listed are not generated.
+func ParseMix(s string) (Mix, error) {
+	mix := Mix{}
+	total := 0
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid mix weight %q", pair)
+		}
+		kind := Kind(strings.TrimSpace(kv[0]))
+		if _, ok := extensions[kind]; !ok {
+			return nil, errors.Errorf("unknown scan kind %q", kind)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || weight < 0 {
+			return nil, errors.Errorf("invalid mix weight %q", pair)
+		}
+		mix[kind] = weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.New("the mix has no positive weight")
+	}
+	return mix, nil
+}
+
+// String formats the mix as ParseMix parses it.
+func (m Mix) String() string {
+	var pairs []string
+	for _, kind := range Kinds {
+		if m[kind] > 0 {
+			pairs = append(pairs, fmt.Sprintf("%s=%d", kind, m[kind]))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Generator generates scan requests of a mix of kinds for a round robin of
+// products. Every URL is unique, so scans can be told apart by URL.
+type Generator struct {
+	mix      Mix
+	total    int
+	products []string
+	prefix   string
+	rng      *rand.Rand
+	n        int
+}
+
+// NewGenerator creates a Generator of scans whose URLs start with prefix. The
+// sequence of kinds is determined by seed.
+func NewGenerator(mix Mix, products []string, prefix string, seed int64) *Generator {
+	total := 0
+	for _, weight := range mix {
+		total += weight
+	}
+	if len(products) == 0 {
+		products = []string{""}
+	}
+	return &Generator{mix: mix, total: total, products: products, prefix: strings.TrimSuffix(prefix, "/"), rng: rand.New(rand.NewSource(seed))}
+}
+
+// Next returns the next scan request and its kind.
+func (g *Generator) Next() (types.ScanRequest, Kind) {
+	kind := Image
+	r := g.rng.Intn(g.total)
+	for _, k := range Kinds {
+		if r < g.mix[k] {
+			kind = k
+			break
+		}
+		r -= g.mix[k]
+	}
+	g.n++
+	return types.ScanRequest{
+		URL:     fmt.Sprintf("%s/%d%s", g.prefix, g.n, extensions[kind]),
+		Product: g.products[(g.n-1)%len(g.products)],
+	}, kind
+}
@@ -0,0 +1,101 @@
+package loadgen
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	tests := []struct {
+		mix  string
+		want string
+		err  bool
+	}{
+		{"image=90,video=5,misc=5", "image=90,video=5,misc=5", false},
+		{" misc=1 , image=3 ", "image=3,misc=1", false},
+		{"image=1,video=0", "image=1", false},
+		{"image=0", "", true},
+		{"", "", true},
+		{"audio=1", "", true},
+		{"image", "", true},
+		{"image=-1,video=2", "", true},
+	}
+	for _, tt := range tests {
+		mix, err := ParseMix(tt.mix)
+		if (err != nil) != tt.err {
+			t.Errorf("Expected error %v parsing %q. Obtained %v", tt.err, tt.mix, err)
+			continue
+		}
+		if err == nil && mix.String() != tt.want {
+			t.Errorf("Expected mix %s for %q. Obtained %s", tt.want, tt.mix, mix)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	g := NewGenerator(Mix{Image: 8, Video: 1, Misc: 1}, []string{"websites", "hosting"}, "https://loadtest.example.com/run/", 1)
+	counts := map[Kind]int{}
+	urls := map[string]bool{}
+	const n = 10000
+	for i := 0; i < n; i++ {
+		scan, kind := g.Next()
+		counts[kind]++
+		if urls[scan.URL] {
+			t.Fatalf("Expected unique URLs. Obtained %s twice", scan.URL)
+		}
+		urls[scan.URL] = true
+		if want := map[Kind]string{Image: ".jpg", Video: ".mp4", Misc: ".pdf"}[kind]; !strings.HasPrefix(scan.URL, "https://loadtest.example.com/run/") || !strings.HasSuffix(scan.URL, want) {
+			t.Errorf("Expected a %s URL ending with %s. Obtained %s", kind, want, scan.URL)
+		}
+		if want := []string{"websites", "hosting"}[i%2]; scan.Product != want {
+			t.Errorf("Expected product %s for scan %d. Obtained %s", want, i+1, scan.Product)
+		}
+	}
+	if counts[Image] < n*75/100 || counts[Image] > n*85/100 || counts[Video] < n*7/100 || counts[Misc] < n*7/100 {
+		t.Errorf("Expected about 80%% images and 10%% of each other kind. Obtained %v", counts)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	r := NewRecorder(start)
+	r.Published("a.jpg", Image, at(0))
+	r.Published("b.jpg", Image, at(0))
+	r.Published("c.mp4", Video, at(100))
+	r.Published("d.jpg", Image, at(100))
+	r.Published("e.jpg", Image, at(200))
+
+	r.Output("a.jpg", Fingerprinted)
+	r.Settled("a.jpg", false, at(100))
+	r.Settled("b.jpg", true, at(150))
+	r.Output("b.jpg", Retried)
+	r.Settled("b.jpg", false, at(400))
+	r.Settled("c.mp4", false, at(300))
+	r.Settled("missing.jpg", false, at(300))
+
+	first := r.Interval(at(500), 7)
+	if first.Published != 5 || first.Completed != 3 || first.Requeued != 1 || first.Throughput != 6 || r.InFlight() != 2 {
+		t.Errorf("Expected 5 published, 3 completed at 6/s and 1 requeue. Obtained %+v with %d in flight", first, r.InFlight())
+	}
+	if first.Outcomes[Fingerprinted] != 1 || first.Outcomes[Retried] != 1 || first.Outcomes[Acknowledged] != 1 || first.RetryRate != 1.0/3 {
+		t.Errorf("Expected one fingerprinted, retried and acknowledged scan. Obtained %v", first.Outcomes)
+	}
+	if want := (Percentiles{P50: 200 * time.Millisecond, P90: 400 * time.Millisecond, P99: 400 * time.Millisecond, Max: 400 * time.Millisecond}); first.Latency != want {
+		t.Errorf("Expected latencies %+v. Obtained %+v", want, first.Latency)
+	}
+
+	r.Output("d.jpg", Parked)
+	r.Settled("d.jpg", false, at(600))
+	r.Settled("e.jpg", false, at(1000))
+	second := r.Interval(at(1000), 3)
+	if second.Published != 0 || second.Completed != 2 || second.Outcomes[Parked] != 1 || second.Outcomes[Dropped] != 1 || second.Elapsed != 500*time.Millisecond {
+		t.Errorf("Expected a parked and a dropped scan over 500ms. Obtained %+v", second)
+	}
+
+	total := r.Total(at(1000))
+	if total.Published != 5 || total.Completed != 5 || total.Backlog != 7 || total.Throughput != 5 || total.Latency.Max != 800*time.Millisecond {
+		t.Errorf("Expected 5 scans completed at 5/s with a max backlog of 7. Obtained %+v", total)
+	}
+}
@@ -0,0 +1,200 @@
+package loadgen
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outcome is what became of a scan once hashserve settled it.
+type Outcome string
+
+// Outcomes of scans. Scans without a message published for them are dropped
+// images or acknowledged videos and miscellaneous files.
+const (
+	Fingerprinted Outcome = "fingerprinted"
+	Retried       Outcome = "retried"
+	Parked        Outcome = "parked"
+	Dropped       Outcome = "dropped"
+	Acknowledged  Outcome = "acknowledged"
+)
+
+// Outcomes lists every Outcome in report order.
+var Outcomes = []Outcome{Fingerprinted, Retried, Parked, Dropped, Acknowledged}
+
+// Percentiles of scan latencies.
+type Percentiles struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Report summarizes the scans completed over a period.
+type Report struct {
+	// Length of the period
+	Elapsed time.Duration
+
+	// Scans published and completed during the period, and times scans were
+	// requeued to be delivered again
+	Published int
+	Completed int
+	Requeued  int
+	Outcomes  map[Outcome]int
+
+	// Completed scans per second
+	Throughput float64
+
+	// Time from publishing to settling the completed scans
+	Latency Percentiles
+
+	// Fraction of completed scans that were retried
+	RetryRate float64
+
+	// Scans in the hashserve queue at the end of an interval, or the most at
+	// the end of any interval for a total
+	Backlog int
+}
+
+type scan struct {
+	kind    Kind
+	at      time.Time
+	outcome Outcome
+}
+
+type tally struct {
+	published int
+	requeued  int
+	outcomes  map[Outcome]int
+	latencies []time.Duration
+}
+
+func newTally() tally {
+	return tally{outcomes: map[Outcome]int{}}
+}
+
+func (t tally) report(elapsed time.Duration, backlog int) Report {
+	completed := len(t.latencies)
+	r := Report{
+		Elapsed:   elapsed,
+		Published: t.published,
+		Completed: completed,
+		Requeued:  t.requeued,
+		Outcomes:  t.outcomes,
+		Latency:   percentiles(t.latencies),
+		Backlog:   backlog,
+	}
+	if elapsed > 0 {
+		r.Throughput = float64(completed) / elapsed.Seconds()
+	}
+	if completed > 0 {
+		r.RetryRate = float64(t.outcomes[Retried]) / float64(completed)
+	}
+	return r
+}
+
+// Recorder follows scans from publishing to settling and reports throughput,
+// latencies and outcomes over intervals and in total. Scans are identified by
+// their URL. It is safe for concurrent use.
+type Recorder struct {
+	mu         sync.Mutex
+	start      time.Time
+	last       time.Time
+	inFlight   map[string]*scan
+	total      tally
+	interval   tally
+	maxBacklog int
+}
+
+// NewRecorder creates a Recorder whose first interval begins at start.
+func NewRecorder(start time.Time) *Recorder {
+	return &Recorder{start: start, last: start, inFlight: map[string]*scan{}, total: newTally(), interval: newTally()}
+}
+
+// Published records a scan published at the given time.
+func (r *Recorder) Published(url string, kind Kind, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inFlight[url] = &scan{kind: kind, at: at}
+	r.total.published++
+	r.interval.published++
+}
+
+// Output records the outcome of a scan in flight that hashserve published a
+// message for before settling it.
+func (r *Recorder) Output(url string, outcome Outcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.inFlight[url]; ok {
+		s.outcome = outcome
+	}
+}
+
+// Settled records a scan hashserve acknowledged or rejected at the given time,
+// which completes it unless it was requeued.
+func (r *Recorder) Settled(url string, requeued bool, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.inFlight[url]
+	if !ok {
+		return
+	}
+	if requeued {
+		r.total.requeued++
+		r.interval.requeued++
+		return
+	}
+	delete(r.inFlight, url)
+	outcome := s.outcome
+	if outcome == "" {
+		outcome = Acknowledged
+		if s.kind == Image {
+			outcome = Dropped
+		}
+	}
+	for _, t := range []*tally{&r.total, &r.interval} {
+		t.outcomes[outcome]++
+		t.latencies = append(t.latencies, at.Sub(s.at))
+	}
+}
+
+// InFlight returns the number of scans published and not completed yet.
+func (r *Recorder) InFlight() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.inFlight)
+}
+
+// Interval reports the scans of the interval ending at the given time, with
+// the scans in the hashserve queue at its end, and begins the next interval.
+func (r *Recorder) Interval(at time.Time, backlog int) Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := r.interval.report(at.Sub(r.last), backlog)
+	r.last = at
+	r.interval = newTally()
+	if backlog > r.maxBacklog {
+		r.maxBacklog = backlog
+	}
+	return report
+}
+
+// Total reports every scan completed from the start until the given time.
+func (r *Recorder) Total(at time.Time) Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total.report(at.Sub(r.start), r.maxBacklog)
+}
+
+func percentiles(latencies []time.Duration) Percentiles {
+	if len(latencies) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: sorted[len(sorted)-1]}
+}
@@ -0,0 +1,167 @@
+package pdna
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Reference is a single entry of the locally loaded reference set, e.g. a
+// previously confirmed image.
+type Reference struct {
+	ID   string `json:"id"`
+	PDNA string `json:"pdna"`
+}
+
+// Candidate is a reference entry found within the match threshold of a hash.
+type Candidate struct {
+	ID       string  `json:"id"`
+	Distance float64 `json:"distance"`
+}
+
+type entry struct {
+	id   string
+	hash Hash
+}
+
+// node is a vantage point tree node. Entries closer to the vantage point than
+// radius live in the inside subtree, the remainder in the outside subtree.
+type node struct {
+	vantage entry
+	radius  float64
+	inside  *node
+	outside *node
+}
+
+// Index is an in-memory vantage point tree over a reference set which answers
+// near-duplicate queries without comparing against every reference.
+type Index struct {
+	root *node
+	size int
+
+	// Maximum distance at which a reference is reported as a candidate.
+	threshold float64
+
+	// Maximum number of candidates returned by Match, 0 for no limit.
+	limit int
+}
+
+// NewIndex builds an Index from refs. References with an unparsable hash
+// are returned as an error.
+func NewIndex(refs []Reference, threshold float64, limit int) (*Index, error) {
+	entries := make([]entry, 0, len(refs))
+	for _, ref := range refs {
+		h, err := Parse(ref.PDNA)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reference %q", ref.ID)
+		}
+		entries = append(entries, entry{id: ref.ID, hash: h})
+	}
+	return &Index{
+		root:      build(entries),
+		size:      len(entries),
+		threshold: threshold,
+		limit:     limit,
+	}, nil
+}
+
+// LoadIndex reads a JSON lines reference set from path and builds an Index from it.
+func LoadIndex(path string, threshold float64, limit int) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var refs []Reference
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var ref Reference
+		if err := json.Unmarshal([]byte(text), &ref); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+		refs = append(refs, ref)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewIndex(refs, threshold, limit)
+}
+
+// Len returns the number of references in the index.
+func (ix *Index) Len() int {
+	return ix.size
+}
+
+// Match returns every reference within the index threshold of h, nearest first.
+func (ix *Index) Match(h Hash) []Candidate {
+	var out []Candidate
+	search(ix.root, &h, ix.threshold, &out)
+	sort.Slice(out, func(i, j int) bool { return out[i].Distance < out[j].Distance })
+	if ix.limit > 0 && len(out) > ix.limit {
+		out = out[:ix.limit]
+	}
+	return out
+}
+
+// build recursively partitions entries around the first entry as vantage point,
+// splitting the remainder at the median distance.
+func build(entries []entry) *node {
+	if len(entries) == 0 {
+		return nil
+	}
+	n := &node{vantage: entries[0]}
+	rest := entries[1:]
+	if len(rest) == 0 {
+		return n
+	}
+	dist := make([]float64, len(rest))
+	for i := range rest {
+		dist[i] = Distance(&n.vantage.hash, &rest[i].hash)
+	}
+	sort.Sort(byDistance{rest, dist})
+	mid := len(rest) / 2
+	n.radius = dist[mid]
+	n.inside = build(rest[:mid])
+	n.outside = build(rest[mid:])
+	return n
+}
+
+func search(n *node, h *Hash, threshold float64, out *[]Candidate) {
+	if n == nil {
+		return
+	}
+	d := Distance(&n.vantage.hash, h)
+	if d <= threshold {
+		*out = append(*out, Candidate{ID: n.vantage.id, Distance: d})
+	}
+	// The triangle inequality bounds which subtrees can hold a reference within threshold.
+	if d-threshold <= n.radius {
+		search(n.inside, h, threshold, out)
+	}
+	if d+threshold >= n.radius {
+		search(n.outside, h, threshold, out)
+	}
+}
+
+// byDistance sorts entries and their precomputed distances together.
+type byDistance struct {
+	entries []entry
+	dist    []float64
+}
+
+func (b byDistance) Len() int           { return len(b.entries) }
+func (b byDistance) Less(i, j int) bool { return b.dist[i] < b.dist[j] }
+func (b byDistance) Swap(i, j int) {
+	b.entries[i], b.entries[j] = b.entries[j], b.entries[i]
+	b.dist[i], b.dist[j] = b.dist[j], b.dist[i]
+}
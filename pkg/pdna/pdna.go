@@ -0,0 +1,70 @@
+package pdna
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HashSize is the number of bytes in a PhotoDNA hash vector.
+const HashSize = 144
+
+// Hash is a decoded PhotoDNA hash vector.
+type Hash [HashSize]byte
+
+// Parse decodes a PhotoDNA hash string as returned by the hasher microservice.
+// Comma separated byte values, hex and base64 encodings are all accepted.
+func Parse(s string) (Hash, error) {
+	var h Hash
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return h, errors.New("empty photoDNA hash")
+	}
+
+	if strings.Contains(s, ",") {
+		parts := strings.Split(s, ",")
+		if len(parts) != HashSize {
+			return h, errors.Errorf("photoDNA hash has %d values, expected %d", len(parts), HashSize)
+		}
+		for i, p := range parts {
+			v, err := strconv.ParseUint(strings.TrimSpace(p), 10, 8)
+			if err != nil {
+				return h, errors.Wrapf(err, "invalid photoDNA value at position %d", i)
+			}
+			h[i] = byte(v)
+		}
+		return h, nil
+	}
+
+	if len(s) == hex.EncodedLen(HashSize) {
+		if b, err := hex.DecodeString(s); err == nil {
+			copy(h[:], b)
+			return h, nil
+		}
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return h, errors.Wrap(err, "unrecognised photoDNA hash encoding")
+	}
+	if len(b) != HashSize {
+		return h, errors.Errorf("photoDNA hash has %d bytes, expected %d", len(b), HashSize)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// Distance returns the euclidean distance between two PhotoDNA hash vectors.
+// Smaller distances indicate more visually similar images.
+func Distance(a, b *Hash) float64 {
+	var sum int64
+	for i := 0; i < HashSize; i++ {
+		d := int64(a[i]) - int64(b[i])
+		sum += d * d
+	}
+	return math.Sqrt(float64(sum))
+}
@@ -0,0 +1,87 @@
+package pdna
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func randomHash(r *rand.Rand) Hash {
+	var h Hash
+	r.Read(h[:])
+	return h
+}
+
+func TestParse(t *testing.T) {
+	h := randomHash(rand.New(rand.NewSource(1)))
+	values := make([]string, HashSize)
+	for i, b := range h {
+		values[i] = strconv.Itoa(int(b))
+	}
+	testCases := map[string]string{
+		"csv":    strings.Join(values, ","),
+		"hex":    hex.EncodeToString(h[:]),
+		"base64": base64.StdEncoding.EncodeToString(h[:]),
+	}
+	for name, s := range testCases {
+		got, err := Parse(s)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", name, err)
+			continue
+		}
+		if got != h {
+			t.Errorf("%s: decoded hash does not match", name)
+		}
+	}
+	for _, s := range []string{"", "1,2,3", "not a hash"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
+
+func TestIndexMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	base := randomHash(r)
+	var refs []Reference
+	var hashes []Hash
+	for i := 0; i < 500; i++ {
+		h := base
+		// Perturb a random number of positions so distances spread around the threshold.
+		for j := 0; j < r.Intn(HashSize); j++ {
+			h[r.Intn(HashSize)] = byte(r.Intn(256))
+		}
+		hashes = append(hashes, h)
+		refs = append(refs, Reference{ID: fmt.Sprintf("ref-%d", i), PDNA: base64.StdEncoding.EncodeToString(h[:])})
+	}
+	const threshold = 900
+	ix, err := NewIndex(refs, threshold, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for q := 0; q < 20; q++ {
+		query := hashes[r.Intn(len(hashes))]
+		query[r.Intn(HashSize)] ^= 0xff
+		var want []string
+		for i := range hashes {
+			if Distance(&hashes[i], &query) <= threshold {
+				want = append(want, refs[i].ID)
+			}
+		}
+		var got []string
+		for _, c := range ix.Match(query) {
+			got = append(got, c.ID)
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if strings.Join(want, ",") != strings.Join(got, ",") {
+			t.Errorf("Expected candidates %v. Obtained %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package rabbitmq
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+// BatchOutputs are the JSON lines outputs of RunBatch.
+type BatchOutputs struct {
+	// Fingerprints published to the thornworker exchange
+	Fingerprints io.Writer
+
+	// Scan requests the outcome policy retried or requeued, which can be fed to another batch run
+	Retries io.Writer
+
+	// Scans that were parked, dropped or rejected with the reason
+	Failures io.Writer
+}
+
+// BatchResult counts the lines read and written by RunBatch.
+type BatchResult struct {
+	// Lines read from the input, including skipped lines
+	Lines int
+
+	// Lines skipped because the checkpoint covered them
+	Skipped int
+
+	Fingerprints int
+	Retries      int
+	Failures     int
+}
+
+// BatchFailure is a line of the failures output.
+type BatchFailure struct {
+	Reason string `json:"reason"`
+	// The scan request, or the raw line when it is not valid JSON
+	Body interface{} `json:"body"`
+}
+
+// RunBatch runs the worker pool of the consumer over scan requests read as JSON
+// lines from in instead of RabbitMQ. Messages the workers would publish are
+// written to out, nothing is published to a broker.
+//
+// The number of leading input lines that were fully processed is written to the
+// checkpoint file, if any, and skipped when RunBatch is run again. Lines processed
+// after the last checkpoint write are processed again, so outputs may contain
+// duplicates after an interrupted run.
+func (c *Consumer) RunBatch(ctx context.Context, in io.Reader, out BatchOutputs, checkpoint string) (BatchResult, error) {
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b := &batch{
+		out:        out,
+		bodies:     map[uint64][]byte{},
+		settled:    map[uint64]bool{},
+		checkpoint: checkpoint,
+	}
+	skip, err := readCheckpoint(checkpoint)
+	if err != nil {
+		return b.snapshot(), err
+	}
+	b.done = skip
+
+	worker := c.newWorker(ctx, cancel)
+	// Batch input is provided by the operator, not by products, and carries no signatures.
+	worker.keyring = nil
+	worker.newPublisher = func() (Publisher, error) { return b, nil }
+	worker.dropped = b.drop
+	defer c.startWorkers(ctx, worker)()
+	if err := c.waitForHasher(ctx); err != nil {
+		return b.snapshot(), err
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+read:
+	for tag := uint64(1); scanner.Scan(); tag++ {
+		b.mu.Lock()
+		b.result.Lines++
+		b.mu.Unlock()
+		if tag <= skip {
+			b.mu.Lock()
+			b.result.Skipped++
+			b.mu.Unlock()
+			continue
+		}
+		body := append([]byte(nil), bytes.TrimSpace(scanner.Bytes())...)
+		b.track(tag, body)
+		if len(body) == 0 {
+			b.Ack(tag, false)
+			continue
+		}
+		select {
+		case worker.jobsChan <- amqp.Delivery{Acknowledger: b, DeliveryTag: tag, Body: body}:
+		case <-ctx.Done():
+			break read
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return b.snapshot(), err
+	}
+
+	// Wait until every line was settled or a worker gave up.
+	settled := make(chan struct{})
+	go func() {
+		b.pending.Wait()
+		close(settled)
+	}()
+	select {
+	case <-settled:
+	case <-ctx.Done():
+		if parentCtx.Err() != nil {
+			return b.snapshot(), parentCtx.Err()
+		}
+		return b.snapshot(), errors.New("batch aborted by a worker, see the log")
+	}
+	return b.snapshot(), b.writeCheckpoint(true)
+}
+
+// batch is the Publisher and amqp.Acknowledger of RunBatch. Delivery tags are
+// input line numbers.
+type batch struct {
+	mu     sync.Mutex
+	out    BatchOutputs
+	result BatchResult
+
+	// Bodies of lines that were not settled yet
+	bodies map[uint64][]byte
+
+	// Lines settled after the first unsettled line
+	settled map[uint64]bool
+
+	// Number of leading lines that were settled
+	done uint64
+
+	pending    sync.WaitGroup
+	checkpoint string
+	written    time.Time
+}
+
+func (b *batch) snapshot() BatchResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.result
+}
+
+func (b *batch) track(tag uint64, body []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending.Add(1)
+	b.bodies[tag] = body
+}
+
+// settle marks line tag as processed and advances the checkpoint.
+func (b *batch) settle(tag uint64) error {
+	b.mu.Lock()
+	if _, ok := b.bodies[tag]; !ok {
+		b.mu.Unlock()
+		return errors.Errorf("line %d already settled", tag)
+	}
+	delete(b.bodies, tag)
+	b.settled[tag] = true
+	for b.settled[b.done+1] {
+		delete(b.settled, b.done+1)
+		b.done++
+	}
+	b.mu.Unlock()
+	b.pending.Done()
+	return b.writeCheckpoint(false)
+}
+
+// writeCheckpoint writes the number of settled leading lines at most once a
+// second unless forced. The file is replaced atomically.
+func (b *batch) writeCheckpoint(force bool) error {
+	if b.checkpoint == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !force && time.Since(b.written) < time.Second {
+		return nil
+	}
+	b.written = time.Now()
+	tmp, err := ioutil.TempFile(filepath.Dir(b.checkpoint), filepath.Base(b.checkpoint)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatUint(b.done, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.checkpoint)
+}
+
+// readCheckpoint returns the number of lines a previous run processed, 0 if
+// there is no checkpoint yet.
+func readCheckpoint(path string) (uint64, error) {
+	if path == "" {
+		return 0, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid checkpoint %s", path)
+	}
+	return n, nil
+}
+
+// write appends body to w as a single line and counts it.
+func (b *batch) write(w io.Writer, count *int, body []byte) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, body); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if w != nil {
+		if _, err := w.Write(line.Bytes()); err != nil {
+			return err
+		}
+	}
+	*count++
+	return nil
+}
+
+func (b *batch) fail(reason string, body []byte) error {
+	f := BatchFailure{Reason: reason, Body: string(body)}
+	if json.Valid(body) {
+		f.Body = json.RawMessage(body)
+	}
+	line, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return b.write(b.out.Failures, &b.result.Failures, line)
+}
+
+// Publish implements Publisher by writing the message to the output of its exchange.
+func (b *batch) Publish(ctx context.Context, messageContent []byte, exchangeName string, opts ...PublishOption) error {
+	message := amqp.Publishing{Headers: amqp.Table{}}
+	for _, opt := range opts {
+		opt(&message)
+	}
+	switch exchangeName {
+	case IMAGEEXCHANGENAME:
+		return b.write(b.out.Fingerprints, &b.result.Fingerprints, messageContent)
+	case RETRYEXCHANGE:
+		return b.write(b.out.Retries, &b.result.Retries, messageContent)
+	case PARKINGEXCHANGE:
+		reason, _ := message.Headers[PARK_REASON_HEADER].(string)
+		return b.fail("park: "+reason, messageContent)
+	}
+	logger.Debug(ctx, "Batch mode does not write messages to "+exchangeName)
+	return nil
+}
+
+// Close implements Publisher.
+func (b *batch) Close() error {
+	return nil
+}
+
+// drop records a scan the outcome policy dropped.
+func (b *batch) drop(msg amqp.Delivery, reason string) {
+	if err := b.fail("drop: "+reason, msg.Body); err != nil {
+		logger.Error(context.Background(), "unable to write batch failure", zap.Error(err))
+	}
+}
+
+// Ack implements amqp.Acknowledger.
+func (b *batch) Ack(tag uint64, multiple bool) error {
+	return b.settle(tag)
+}
+
+// Nack implements amqp.Acknowledger. Requeued lines are written to the retries
+// output unchanged, the others are failures.
+func (b *batch) Nack(tag uint64, multiple bool, requeue bool) error {
+	b.mu.Lock()
+	body := b.bodies[tag]
+	b.mu.Unlock()
+	var err error
+	if requeue {
+		err = b.write(b.out.Retries, &b.result.Retries, body)
+	} else {
+		err = b.fail("rejected", body)
+	}
+	if err != nil {
+		return err
+	}
+	return b.settle(tag)
+}
+
+// Reject implements amqp.Acknowledger.
+func (b *batch) Reject(tag uint64, requeue bool) error {
+	return b.Nack(tag, false, requeue)
+}
@@ -0,0 +1,197 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/breaker"
+	"github.com/gdcorp-infosec/hashserve/pkg/fakehasher"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+func newTestBatch(t *testing.T, checkpoint string, lines ...string) (*batch, *bytes.Buffer, *bytes.Buffer, *bytes.Buffer) {
+	fingerprints, retries, failures := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	b := &batch{
+		out:        BatchOutputs{Fingerprints: fingerprints, Retries: retries, Failures: failures},
+		bodies:     map[uint64][]byte{},
+		settled:    map[uint64]bool{},
+		checkpoint: checkpoint,
+	}
+	for i, line := range lines {
+		b.track(uint64(i+1), []byte(line))
+	}
+	return b, fingerprints, retries, failures
+}
+
+func TestBatchPublish(t *testing.T) {
+	b, fingerprints, retries, failures := newTestBatch(t, "")
+	ctx := context.Background()
+	tests := []struct {
+		exchange string
+		opts     []PublishOption
+	}{
+		{IMAGEEXCHANGENAME, nil},
+		{RETRYEXCHANGE, nil},
+		{PARKINGEXCHANGE, []PublishOption{WithHeader(PARK_REASON_HEADER, "transport error")}},
+		{ESCALATIONEXCHANGE, nil},
+	}
+	for _, tt := range tests {
+		if err := b.Publish(ctx, []byte("{\n  \"url\": \"https://example.com/a.jpg\"\n}"), tt.exchange, tt.opts...); err != nil {
+			t.Errorf("Expected no error publishing to %s. Obtained %v", tt.exchange, err)
+		}
+	}
+	line := `{"url":"https://example.com/a.jpg"}` + "\n"
+	if fingerprints.String() != line {
+		t.Errorf("Expected fingerprint %q. Obtained %q", line, fingerprints.String())
+	}
+	if retries.String() != line {
+		t.Errorf("Expected retry %q. Obtained %q", line, retries.String())
+	}
+	failure := `{"reason":"park: transport error","body":{"url":"https://example.com/a.jpg"}}` + "\n"
+	if failures.String() != failure {
+		t.Errorf("Expected failure %q. Obtained %q", failure, failures.String())
+	}
+	result := b.snapshot()
+	if result.Fingerprints != 1 || result.Retries != 1 || result.Failures != 1 {
+		t.Errorf("Expected one line in each output. Obtained %+v", result)
+	}
+}
+
+func TestBatchSettle(t *testing.T) {
+	b, _, retries, failures := newTestBatch(t, "", `{"url":"a"}`, `{"url":"b"}`, `not json`, `{"url":"d"}`)
+	if err := b.Nack(2, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Reject(3, false); err != nil {
+		t.Fatal(err)
+	}
+	b.drop(amqp.Delivery{Body: []byte(`{"url":"d"}`)}, "allowlisted")
+	if err := b.Ack(4, false); err != nil {
+		t.Fatal(err)
+	}
+	if b.done != 0 {
+		t.Errorf("Expected no line done before line 1 is settled. Obtained %d", b.done)
+	}
+	if err := b.Ack(1, false); err != nil {
+		t.Fatal(err)
+	}
+	if b.done != 4 {
+		t.Errorf("Expected 4 lines done. Obtained %d", b.done)
+	}
+	if err := b.Ack(1, false); err == nil {
+		t.Error("Expected an error settling a line twice")
+	}
+	if retries.String() != `{"url":"b"}`+"\n" {
+		t.Errorf("Expected the requeued line in retries. Obtained %q", retries.String())
+	}
+	want := `{"reason":"rejected","body":"not json"}` + "\n" + `{"reason":"drop: allowlisted","body":{"url":"d"}}` + "\n"
+	if failures.String() != want {
+		t.Errorf("Expected failures %q. Obtained %q", want, failures.String())
+	}
+}
+
+func TestBatchCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if n, err := readCheckpoint(path); n != 0 || err != nil {
+		t.Errorf("Expected 0 lines for a missing checkpoint. Obtained %d, %v", n, err)
+	}
+	b, _, _, _ := newTestBatch(t, path, `{}`, `{}`, `{}`)
+	for _, tag := range []uint64{1, 3} {
+		if err := b.Ack(tag, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.writeCheckpoint(true); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := readCheckpoint(path); n != 1 || err != nil {
+		t.Errorf("Expected 1 line in the checkpoint. Obtained %d, %v", n, err)
+	}
+	if _, err := readCheckpoint("batch_test.go"); err == nil || !strings.Contains(err.Error(), "invalid checkpoint") {
+		t.Errorf("Expected an invalid checkpoint error. Obtained %v", err)
+	}
+}
+
+func TestRunBatchInvalidScores(t *testing.T) {
+	script, err := fakehasher.ParseScript(strings.NewReader(`{"default": [{"scores": [
+		{"model": "thorn", "scores": {"csam": 0.2}},
+		{"model": "", "scores": {"csam": 2}}
+	]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := fakehasher.New(fakehasher.DefaultBehaviour())
+	h.SetScript(script)
+	hasher := httptest.NewServer(h)
+	defer hasher.Close()
+
+	fingerprints, retries, failures := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	c := NewConsumer("dev", "", 1, 3, WithHasherURL(hasher.URL))
+	in := strings.NewReader(`{"url": "https://example.com/a.jpg", "product": "websites"}`)
+	if _, err := c.RunBatch(context.Background(), in, BatchOutputs{fingerprints, retries, failures}, ""); err != nil {
+		t.Fatal(err)
+	}
+	var published types.Fingerprints
+	if err := json.Unmarshal(fingerprints.Bytes(), &published); err != nil || len(published.Fingerprints) != 1 {
+		t.Fatalf("Expected the fingerprint to be published. Obtained %q %v, failures %q", fingerprints, err, failures)
+	}
+	fp := published.Fingerprints[0]
+	if fp.MD5 != fakehasher.Hashes("https://example.com/a.jpg").MD5 || len(fp.MlScores) != 1 || fp.MlScores[0].Model != "thorn" {
+		t.Errorf("Expected the hashes with only the valid model result. Obtained %+v", fp)
+	}
+}
+
+func TestRunBatchPublishesWithOpenBreaker(t *testing.T) {
+	script, err := fakehasher.ParseScript(strings.NewReader(`{"default": [{"latencyMs": 200}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := fakehasher.New(fakehasher.DefaultBehaviour())
+	h.SetScript(script)
+	hasher := httptest.NewServer(h)
+	defer hasher.Close()
+
+	// The breaker opens while the scan is in flight, e.g. on failures of other workers.
+	b := breaker.New(1, time.Hour)
+	time.AfterFunc(50*time.Millisecond, b.Failure)
+	fingerprints, retries, failures := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	c := NewConsumer("dev", "", 1, 3, WithHasherURL(hasher.URL), WithBreaker(b))
+	in := strings.NewReader(`{"url": "https://example.com/a.jpg", "product": "websites"}`)
+	if _, err := c.RunBatch(context.Background(), in, BatchOutputs{fingerprints, retries, failures}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if fingerprints.Len() == 0 || retries.Len() != 0 {
+		t.Errorf("Expected the hashed scan to be published. Obtained fingerprints %q, retries %q", fingerprints, retries)
+	}
+}
+
+func TestRunBatchParksUnencryptableIdentifiers(t *testing.T) {
+	hasher := httptest.NewServer(fakehasher.New(fakehasher.DefaultBehaviour()))
+	defer hasher.Close()
+	k, err := types.NewIdentifierKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints, retries, failures := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	c := NewConsumer("dev", "", 1, 3, WithHasherURL(hasher.URL), WithIdentifierEncryption(k, []string{"shopperID"}))
+	in := strings.NewReader(`{"url": "https://example.com/a.jpg", "product": "websites", "accountIdentifiers": {"shopperID": "1", "encryption": {"keyID": "k1"}}}
+{"url": "https://example.com/b.jpg", "product": "websites", "accountIdentifiers": {"shopperID": "2"}}`)
+	if _, err := c.RunBatch(context.Background(), in, BatchOutputs{fingerprints, retries, failures}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(failures.String(), `"reason":"park: encryption`) || !strings.Contains(failures.String(), "a.jpg") {
+		t.Errorf("Expected the scan with encrypted identifiers to be parked. Obtained %q", failures)
+	}
+	if !strings.Contains(fingerprints.String(), "b.jpg") {
+		t.Errorf("Expected the other scan to be published. Obtained %q", fingerprints)
+	}
+}
@@ -0,0 +1,271 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"github.com/gdcorp-infosec/hashserve/pkg/breaker"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// Pseudo exchanges under which the Bus records scans that were not published.
+const (
+	// Scans rejected without requeue, which RabbitMQ discards
+	BUS_REJECTED string = "(rejected)"
+
+	// Scans the outcome policy dropped
+	BUS_DROPPED string = "(dropped)"
+
+	// Header of the rejection or drop reason
+	BUS_REASON_HEADER string = "x-reason"
+)
+
+// BusMessage is a message published to the Bus.
+type BusMessage struct {
+	Seq      uint64          `json:"seq"`
+	Time     time.Time       `json:"time"`
+	Exchange string          `json:"exchange"`
+	Headers  amqp.Table      `json:"headers,omitempty"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Bus is an in-process stand-in for RabbitMQ used by the dev mode. Scans
+// published to the hashserve exchange are delivered to the workers of
+// ServeBus, scans published to the retry exchange are delivered again after
+// the retry delay, as the TTL of the retry queue would, and every message is
+// recorded so it can be observed.
+//
+// It is the Publisher of every worker and the amqp.Acknowledger of every
+// delivery. It is safe for concurrent use.
+type Bus struct {
+	retryDelay time.Duration
+	capacity   int
+
+	mu       sync.Mutex
+	seq      uint64
+	tag      uint64
+	messages []BusMessage
+	unacked  map[uint64]amqp.Delivery
+	queue    []amqp.Delivery
+
+	// Signalled when queue is no longer empty
+	ready chan struct{}
+
+	// Closed and replaced on every publish
+	published chan struct{}
+}
+
+// NewBus creates a Bus recording the last capacity messages.
+func NewBus(capacity int, retryDelay time.Duration) *Bus {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Bus{
+		retryDelay: retryDelay,
+		capacity:   capacity,
+		unacked:    map[uint64]amqp.Delivery{},
+		ready:      make(chan struct{}, 1),
+		published:  make(chan struct{}),
+	}
+}
+
+// record appends a message and wakes up Wait. It must be called with b.mu held.
+func (b *Bus) record(exchange string, headers amqp.Table, body []byte) uint64 {
+	b.seq++
+	raw := json.RawMessage(body)
+	if !json.Valid(body) {
+		raw, _ = json.Marshal(string(body))
+	}
+	b.messages = append(b.messages, BusMessage{Seq: b.seq, Time: time.Now(), Exchange: exchange, Headers: headers, Body: raw})
+	if len(b.messages) > b.capacity {
+		b.messages = b.messages[len(b.messages)-b.capacity:]
+	}
+	close(b.published)
+	b.published = make(chan struct{})
+	return b.seq
+}
+
+// deliver queues body for the workers. It must be called with b.mu held.
+func (b *Bus) deliver(headers amqp.Table, body []byte, redelivered bool) {
+	b.tag++
+	d := amqp.Delivery{
+		Acknowledger: b,
+		Headers:      headers,
+		Body:         body,
+		DeliveryTag:  b.tag,
+		Redelivered:  redelivered,
+		Exchange:     SCANEXCHANGE,
+	}
+	b.unacked[b.tag] = d
+	b.queue = append(b.queue, d)
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next delivery, blocking until there is one or ctx is done.
+func (b *Bus) next(ctx context.Context) (amqp.Delivery, bool) {
+	for {
+		b.mu.Lock()
+		if len(b.queue) > 0 {
+			d := b.queue[0]
+			b.queue = b.queue[1:]
+			b.mu.Unlock()
+			return d, true
+		}
+		b.mu.Unlock()
+		select {
+		case <-b.ready:
+		case <-ctx.Done():
+			return amqp.Delivery{}, false
+		}
+	}
+}
+
+// Publish implements Publisher.
+func (b *Bus) Publish(ctx context.Context, messageContent []byte, exchangeName string, opts ...PublishOption) error {
+	message := amqp.Publishing{Headers: amqp.Table{}}
+	for _, opt := range opts {
+		opt(&message)
+	}
+	body := append([]byte(nil), messageContent...)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.record(exchangeName, message.Headers, body)
+	switch exchangeName {
+	case SCANEXCHANGE:
+		b.deliver(message.Headers, body, false)
+	case RETRYEXCHANGE:
+		time.AfterFunc(b.retryDelay, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.deliver(message.Headers, body, false)
+		})
+	}
+	return nil
+}
+
+// Close implements Publisher. The Bus is shared by every worker and stays open.
+func (b *Bus) Close() error {
+	return nil
+}
+
+// Messages returns the recorded messages after seq, of exchange unless it is empty.
+func (b *Bus) Messages(after uint64, exchange string) []BusMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	messages := []BusMessage{}
+	for _, m := range b.messages {
+		if m.Seq > after && (exchange == "" || m.Exchange == exchange) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// Wait blocks until a message after seq was recorded or ctx is done.
+func (b *Bus) Wait(ctx context.Context, after uint64) {
+	for {
+		b.mu.Lock()
+		seq, published := b.seq, b.published
+		b.mu.Unlock()
+		if seq > after {
+			return
+		}
+		select {
+		case <-published:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drop records a scan the outcome policy dropped.
+func (b *Bus) drop(msg amqp.Delivery, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.record(BUS_DROPPED, amqp.Table{BUS_REASON_HEADER: reason}, msg.Body)
+}
+
+// settle removes the unacknowledged delivery tag.
+func (b *Bus) settle(tag uint64) (amqp.Delivery, error) {
+	d, ok := b.unacked[tag]
+	if !ok {
+		return d, errors.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(b.unacked, tag)
+	return d, nil
+}
+
+// Ack implements amqp.Acknowledger.
+func (b *Bus) Ack(tag uint64, multiple bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.settle(tag)
+	return err
+}
+
+// Nack implements amqp.Acknowledger. Requeued scans are delivered again
+// immediately, the others are recorded as rejected.
+func (b *Bus) Nack(tag uint64, multiple bool, requeue bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d, err := b.settle(tag)
+	if err != nil {
+		return err
+	}
+	if requeue {
+		b.deliver(d.Headers, d.Body, true)
+		return nil
+	}
+	b.record(BUS_REJECTED, amqp.Table{BUS_REASON_HEADER: "rejected"}, d.Body)
+	return nil
+}
+
+// Reject implements amqp.Acknowledger.
+func (b *Bus) Reject(tag uint64, requeue bool) error {
+	return b.Nack(tag, false, requeue)
+}
+
+// ServeBus runs the worker pool of the consumer over the scans published to
+// bus instead of RabbitMQ until ctx is done.
+func (c *Consumer) ServeBus(ctx context.Context, bus *Bus) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	worker := c.newWorker(ctx, cancel)
+	// Scans are submitted by the developer, not by products, and carry no signatures.
+	worker.keyring = nil
+	worker.newPublisher = func() (Publisher, error) { return bus, nil }
+	worker.dropped = bus.drop
+	defer c.startWorkers(ctx, worker)()
+	if err := c.waitForHasher(ctx); err != nil {
+		return err
+	}
+
+	logger.Info(ctx, "Consuming from the in-process bus")
+	for {
+		// Hold scans back while the hasher circuit breaker is open, as Serve
+		// pauses consumption, rather than requeueing them in a loop.
+		for c.breaker != nil && c.breaker.State() == breaker.Open {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		msg, ok := bus.next(ctx)
+		if !ok {
+			return nil
+		}
+		select {
+		case worker.jobsChan <- msg:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
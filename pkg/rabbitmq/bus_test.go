@@ -0,0 +1,108 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestBusDelivery(t *testing.T) {
+	bus := NewBus(10, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := bus.Publish(ctx, []byte(`{"url":"a"}`), SCANEXCHANGE); err != nil {
+		t.Fatal(err)
+	}
+	d, ok := bus.next(ctx)
+	if !ok || string(d.Body) != `{"url":"a"}` || d.Redelivered {
+		t.Fatalf("Expected the published scan to be delivered. Obtained %+v", d)
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d, ok = bus.next(ctx)
+	if !ok || !d.Redelivered {
+		t.Fatalf("Expected the requeued scan to be redelivered. Obtained %+v", d)
+	}
+	if err := d.Reject(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(false); err == nil {
+		t.Error("Expected an error acknowledging a settled delivery")
+	}
+
+	if err := bus.Publish(ctx, []byte(`{"url":"b"}`), RETRYEXCHANGE); err != nil {
+		t.Fatal(err)
+	}
+	d, ok = bus.next(ctx)
+	if !ok || string(d.Body) != `{"url":"b"}` {
+		t.Fatalf("Expected the retried scan to be delivered after the retry delay. Obtained %+v", d)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	bus.drop(amqp.Delivery{Body: []byte(`{"url":"c"}`)}, "allowlisted")
+
+	want := []string{SCANEXCHANGE, BUS_REJECTED, RETRYEXCHANGE, BUS_DROPPED}
+	messages := bus.Messages(0, "")
+	if len(messages) != len(want) {
+		t.Fatalf("Expected %d messages. Obtained %+v", len(want), messages)
+	}
+	for i, m := range messages {
+		if m.Exchange != want[i] || m.Seq != uint64(i+1) {
+			t.Errorf("Expected message %d on %s. Obtained %d on %s", i+1, want[i], m.Seq, m.Exchange)
+		}
+	}
+	if dropped := bus.Messages(2, BUS_DROPPED); len(dropped) != 1 || dropped[0].Headers[BUS_REASON_HEADER] != "allowlisted" {
+		t.Errorf("Expected the dropped scan with its reason. Obtained %+v", dropped)
+	}
+}
+
+func TestBusMessages(t *testing.T) {
+	bus := NewBus(2, time.Second)
+	ctx := context.Background()
+	for _, body := range []string{`{"n":1}`, `{"n":2}`, `not json`} {
+		bus.Publish(ctx, []byte(body), IMAGEEXCHANGENAME)
+	}
+	messages := bus.Messages(0, IMAGEEXCHANGENAME)
+	if len(messages) != 2 || messages[0].Seq != 2 {
+		t.Fatalf("Expected the last 2 messages. Obtained %+v", messages)
+	}
+	if string(messages[1].Body) != `"not json"` {
+		t.Errorf("Expected a body that is not JSON to be recorded as a string. Obtained %s", messages[1].Body)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		bus.Wait(ctx, 3)
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Expected Wait to block until a new message is published")
+	case <-time.After(10 * time.Millisecond):
+	}
+	bus.Publish(ctx, []byte(`{}`), IMAGEEXCHANGENAME)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Wait to return once a new message is published")
+	}
+}
+
+func TestServeBusHasherDown(t *testing.T) {
+	hasher := httptest.NewServer(http.NotFoundHandler())
+	hasher.Close()
+	c := NewConsumer("dev", "", 1, 3, WithHasherURL(hasher.URL))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.ServeBus(ctx, NewBus(10, time.Second)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected ServeBus to stop with the context while waiting for the hasher. Obtained %v", err)
+	}
+}
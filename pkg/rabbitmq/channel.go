@@ -1,9 +1,24 @@
 package rabbitmq
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/streadway/amqp"
 )
 
+// consumerTag identifies the consumer of this process, so it can be cancelled
+// and re-created when consumption is paused.
+var consumerTag = fmt.Sprintf("hashserve-%s-%d", hostname(), os.Getpid())
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
 // Channel serves as a simple wrapper around an amqp.Channel.
 // It provides additional functionality for initializing the required RabbitMQ topology.
 type Channel struct {
@@ -29,17 +44,63 @@ func (ch *Channel) Initialize(env string, prefetchCount int) (<-chan amqp.Delive
 		return nil, err
 	}
 
+	return ch.consume(q.Name)
+}
+
+// Pause cancels the consumer so the broker stops delivering messages. Messages
+// already delivered can still be acknowledged or rejected. The deliveries
+// channel returned by Initialize or Resume is closed.
+func (ch *Channel) Pause() error {
+	return ch.Cancel(consumerTag, false)
+}
+
+// Resume starts consuming from the environment queue again after Pause.
+func (ch *Channel) Resume(env string) (<-chan amqp.Delivery, error) {
+	return ch.consume("hashserve-" + env)
+}
+
+func (ch *Channel) consume(queue string) (<-chan amqp.Delivery, error) {
 	return ch.Consume(
-		q.Name, // Queue
-		"",     // Consumer
-		false,  // AutoAck
-		false,  // Exclusive
-		false,  // NoLocal
-		false,  // NoWait
-		nil,    // Args
+		queue,       // Queue
+		consumerTag, // Consumer
+		false,       // AutoAck
+		false,       // Exclusive
+		false,       // NoLocal
+		false,       // NoWait
+		nil,         // Args
 	)
 }
 
+// DeclareTopology declares the exchanges, queues and bindings of env without consuming.
+func (ch *Channel) DeclareTopology(env string) error {
+	_, err := ch.queueDeclareAndBind(env)
+	return err
+}
+
+// Binding is a queue declared by DeclareTopology and the exchange and key it is bound with.
+type Binding struct {
+	Exchange string
+	Key      string
+	Queue    string
+}
+
+// EscalationMaxPriority is the highest priority of the escalation queue. The
+// broker treats escalations published with a higher one as this one.
+const EscalationMaxPriority = 10
+
+// ExternalExchanges are the exchanges hashserve consumes from or publishes to
+// that are provisioned outside hashserve and not declared by DeclareTopology.
+var ExternalExchanges = []string{SCANEXCHANGE, IMAGEEXCHANGENAME, VIDEOEXCHANGE, MISCEXCHANGE, RETRYEXCHANGE}
+
+// Topology returns the bindings DeclareTopology declares for env.
+func Topology(env string) []Binding {
+	return []Binding{
+		{SCANEXCHANGE, "#." + env, "hashserve-" + env},
+		{PARKINGEXCHANGE, "#." + env + "-v2", PARKINGEXCHANGE + "-" + env},
+		{ESCALATIONEXCHANGE, "#." + env + "-v2", ESCALATIONEXCHANGE + "-" + env},
+	}
+}
+
 func (ch *Channel) queueDeclareAndBind(env string) (amqp.Queue, error) {
 
 	args := make(amqp.Table)
@@ -70,5 +131,89 @@ func (ch *Channel) queueDeclareAndBind(env string) (amqp.Queue, error) {
 		return amqp.Queue{}, err
 	}
 
+	if err := ch.parkingLotDeclare(env, args); err != nil {
+		return amqp.Queue{}, err
+	}
+
+	if err := ch.escalationDeclare(env); err != nil {
+		return amqp.Queue{}, err
+	}
+
 	return q, nil
 }
+
+// parkingLotDeclare declares the parking lot exchange and the environment queue
+// holding scans that the outcome policy parked for manual inspection.
+func (ch *Channel) parkingLotDeclare(env string, args amqp.Table) error {
+	err := ch.ExchangeDeclare(
+		PARKINGEXCHANGE, // Name
+		"topic",         // Kind
+		true,            // Durable
+		false,           // AutoDelete
+		false,           // Internal
+		false,           // NoWait
+		nil,             // Args
+	)
+	if err != nil {
+		return err
+	}
+
+	q, err := ch.QueueDeclare(
+		PARKINGEXCHANGE+"-"+env, // Name
+		true,                    // Durable
+		false,                   // AutoDelete
+		false,                   // Exclusive
+		false,                   // NoWait
+		args,                    // Args
+	)
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(
+		q.Name,          // Name
+		"#."+env+"-v2",  // Key
+		PARKINGEXCHANGE, // Exchange
+		false,           // NoWait
+		nil,             // Args
+	)
+}
+
+// escalationDeclare declares the escalation exchange and the environment queue
+// holding escalated fingerprints. Quorum queues ignore message priorities, so
+// it is a classic queue with priorities up to EscalationMaxPriority.
+func (ch *Channel) escalationDeclare(env string) error {
+	err := ch.ExchangeDeclare(
+		ESCALATIONEXCHANGE, // Name
+		"topic",            // Kind
+		true,               // Durable
+		false,              // AutoDelete
+		false,              // Internal
+		false,              // NoWait
+		nil,                // Args
+	)
+	if err != nil {
+		return err
+	}
+
+	args := amqp.Table{"x-max-priority": int32(EscalationMaxPriority)}
+	q, err := ch.QueueDeclare(
+		ESCALATIONEXCHANGE+"-"+env, // Name
+		true,                       // Durable
+		false,                      // AutoDelete
+		false,                      // Exclusive
+		false,                      // NoWait
+		args,                       // Args
+	)
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(
+		q.Name,             // Name
+		"#."+env+"-v2",     // Key
+		ESCALATIONEXCHANGE, // Exchange
+		false,              // NoWait
+		nil,                // Args
+	)
+}
@@ -2,15 +2,30 @@ package rabbitmq
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gdcorp-infosec/cset-go-common/utilities"
 	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"github.com/gdcorp-infosec/hashserve/pkg/adaptive"
+	"github.com/gdcorp-infosec/hashserve/pkg/allowlist"
+	"github.com/gdcorp-infosec/hashserve/pkg/breaker"
+	"github.com/gdcorp-infosec/hashserve/pkg/clientcert"
+	"github.com/gdcorp-infosec/hashserve/pkg/escalation"
+	"github.com/gdcorp-infosec/hashserve/pkg/fairqueue"
+	"github.com/gdcorp-infosec/hashserve/pkg/hostlimit"
+	"github.com/gdcorp-infosec/hashserve/pkg/pdna"
+	"github.com/gdcorp-infosec/hashserve/pkg/redact"
+	"github.com/gdcorp-infosec/hashserve/pkg/signing"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+	"github.com/gdcorp-infosec/hashserve/pkg/urlpolicy"
 	"github.com/streadway/amqp"
 	"go.uber.org/zap"
 )
@@ -29,18 +44,232 @@ type Consumer struct {
 	// Number of image worker go routines
 	nImageThreads int
 
-	// Max retry count
-	maxRetrycount int
+	// Max retry count, accessed atomically as it may change while serving
+	maxRetrycount int64
+
+	// Optional PhotoDNA reference index used to annotate image fingerprints
+	// with near-duplicate matches.
+	matcher *pdna.Index
+
+	// Optional known-benign allowlist. Its URL prefix, host and asset ID rules
+	// are consulted before hashing images, its digest rules after.
+	allowlist *allowlist.List
+
+	// Optional ML score thresholds above which image fingerprints are
+	// additionally published to the escalation exchange.
+	escalation *escalation.Policy
+
+	// Optional per host concurrency and rate limits applied before hashing.
+	hostLimiter *hostlimit.Limiter
+
+	// Per product scheduler between content type detection and the image workers.
+	imageQueue *fairqueue.Queue
+
+	// Limits the number of image workers calling the hasher at the same time,
+	// adjusted every concurrencyWindow.
+	concurrency       *adaptive.Controller
+	concurrencyWindow time.Duration
+
+	// Optional circuit breaker around hasher calls which pauses consumption while open.
+	breaker *breaker.Breaker
+
+	// Decides what happens to scans that could not be fingerprinted.
+	policy *Policy
+
+	// Optional policy of URLs the hasher may fetch, violations are parked.
+	urlPolicy *urlpolicy.Policy
+
+	// Validates scan client certificates before they are sent to the hasher.
+	certs *clientcert.Validator
+
+	// Redacts scan data attached to traces.
+	redactor *redact.Redactor
+
+	// Optional keyring incoming scans are verified and published messages signed with.
+	keyring *signing.Keyring
+
+	// Optional keyring the encryptedFields of published account identifiers are encrypted with.
+	identifierKeyring *types.IdentifierKeyring
+	encryptedFields   []string
+
+	// Base URL of the hasher service, defaults to DEFAULT_HASHER_URL.
+	hasherURL string
+
+	// Messages prefetched per active image worker, defaults to DEFAULT_PREFETCH_PER_WORKER.
+	prefetchPerWorker int
+
+	// Starts an image worker go routine while the workers run, so that
+	// SetWorkers can raise the maximum concurrency limit.
+	workersMu        sync.Mutex
+	startImageWorker func()
+	imageWorkers     int
+}
+
+// ConsumerOption configures optional Consumer behaviour.
+type ConsumerOption func(*Consumer)
+
+// WithMatcher annotates every image fingerprint with the references in ix
+// that are within its match threshold.
+func WithMatcher(ix *pdna.Index) ConsumerOption {
+	return func(c *Consumer) {
+		c.matcher = ix
+	}
+}
+
+// WithAllowlist fast-acks image scans matching the known-benign list l
+// instead of hashing and publishing them.
+func WithAllowlist(l *allowlist.List) ConsumerOption {
+	return func(c *Consumer) {
+		c.allowlist = l
+	}
+}
+
+// WithEscalation additionally publishes image fingerprints whose ML scores
+// exceed the thresholds of p to the escalation exchange.
+func WithEscalation(p *escalation.Policy) ConsumerOption {
+	return func(c *Consumer) {
+		c.escalation = p
+	}
+}
+
+// WithHostLimiter defers image scans of hosts that are saturated according to l
+// to the retry queue instead of requesting them from the hasher.
+func WithHostLimiter(l *hostlimit.Limiter) ConsumerOption {
+	return func(c *Consumer) {
+		c.hostLimiter = l
+	}
+}
+
+// WithImageQueue schedules the prefetched image scans between products using
+// q. By default every product has the same weight and no priority.
+func WithImageQueue(q *fairqueue.Queue) ConsumerOption {
+	return func(c *Consumer) {
+		c.imageQueue = q
+	}
+}
+
+// WithConcurrency lets ctrl adapt the number of active image workers and the
+// prefetch count to the hasher latency, re-evaluated every window. By default
+// exactly nImageThreads image workers are active.
+func WithConcurrency(ctrl *adaptive.Controller, window time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.concurrency = ctrl
+		c.concurrencyWindow = window
+	}
+}
+
+// WithBreaker stops consuming scans while b is open and resumes once a
+// health probe of the hasher succeeds.
+func WithBreaker(b *breaker.Breaker) ConsumerOption {
+	return func(c *Consumer) {
+		c.breaker = b
+	}
+}
+
+// WithPolicy replaces the default outcome policy for scans that could not be fingerprinted.
+func WithPolicy(p *Policy) ConsumerOption {
+	return func(c *Consumer) {
+		c.policy = p
+	}
+}
+
+// WithURLPolicy parks image scans whose URL violates p instead of hashing them.
+func WithURLPolicy(p *urlpolicy.Policy) ConsumerOption {
+	return func(c *Consumer) {
+		c.urlPolicy = p
+	}
+}
+
+// WithRedactor replaces the default redaction rules of scan data attached to traces.
+func WithRedactor(r *redact.Redactor) ConsumerOption {
+	return func(c *Consumer) {
+		c.redactor = r
+	}
+}
+
+// WithKeyring parks scans without a valid signature of their product and
+// signs published messages with the signing key of k.
+func WithKeyring(k *signing.Keyring) ConsumerOption {
+	return func(c *Consumer) {
+		c.keyring = k
+	}
+}
+
+// WithIdentifierEncryption encrypts the named account identifier fields of
+// published fingerprints with the current key of k.
+func WithIdentifierEncryption(k *types.IdentifierKeyring, fields []string) ConsumerOption {
+	return func(c *Consumer) {
+		c.identifierKeyring = k
+		c.encryptedFields = fields
+	}
+}
+
+// WithHasherURL calls the hasher service at url instead of DEFAULT_HASHER_URL.
+func WithHasherURL(url string) ConsumerOption {
+	return func(c *Consumer) {
+		c.hasherURL = url
+	}
+}
+
+// WithPrefetchPerWorker prefetches n messages per active image worker instead
+// of DEFAULT_PREFETCH_PER_WORKER.
+func WithPrefetchPerWorker(n int) ConsumerOption {
+	return func(c *Consumer) {
+		c.prefetchPerWorker = n
+	}
+}
+
+// hasherHealthCheck returns an error unless the hasher reports itself healthy.
+func (c *Consumer) hasherHealthCheck(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.hasherURL, "/")+HASHER_HEALTH_PATH, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hasher health status %d", resp.StatusCode)
+	}
+	return nil
 }
 
 // NewConsumer creates a new RabbitMQ Consumer.
-func NewConsumer(env string, rmqURI string, nImageThreads int, maxRetrycount int) *Consumer {
-	return &Consumer{
+func NewConsumer(env string, rmqURI string, nImageThreads int, maxRetrycount int, opts ...ConsumerOption) *Consumer {
+	c := &Consumer{
 		env:           env,
 		uri:           rmqURI,
 		nImageThreads: nImageThreads,
-		maxRetrycount: maxRetrycount,
+		maxRetrycount: int64(maxRetrycount),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.policy == nil {
+		c.policy = DefaultPolicy()
+	}
+	if c.certs == nil {
+		c.certs = clientcert.New(1024)
+	}
+	if c.redactor == nil {
+		c.redactor = redact.New(redact.DefaultRules(), nil)
+	}
+	if c.imageQueue == nil {
+		c.imageQueue = fairqueue.New(nil, nil, 1)
+	}
+	if c.hasherURL == "" {
+		c.hasherURL = DEFAULT_HASHER_URL
+	}
+	if c.prefetchPerWorker <= 0 {
+		c.prefetchPerWorker = DEFAULT_PREFETCH_PER_WORKER
+	}
+	if c.concurrency == nil {
+		c.concurrency = adaptive.New(nImageThreads, nImageThreads, nImageThreads, time.Minute, 1)
+		c.concurrencyWindow = time.Minute
 	}
+	return c
 }
 
 // Serve creates a new Connection and opens a new Channel to a RabbitMQ Broker.
@@ -49,7 +278,7 @@ Over view of functionality:
 1. Serve creates an amqp consumer and listens to sigint signal.
 2. Serve also starts 4 additional go routines.
 3. StartWorker go routine listens to amqp messages passed to the jobs chan by serve,
-detects the content type and routes it to one of image ingest channel,
+detects the content type and routes it to one of the per product image queue,
 video ingest channel or miscellaneous ingest channel.
 4. imageWorkerFunc, videoWorkerFunc and miscWorkerFunc go routines listens to the appropriate channel,
 executes content type specific logic and publishes to its respective rabbitmq queue
@@ -70,55 +299,125 @@ func (c *Consumer) Serve(parentCtx context.Context) error {
 		return err
 	}
 	defer ch.Close()
-	deliveries, err := ch.Initialize(c.env, c.nImageThreads*2)
+	deliveries, err := ch.Initialize(c.env, c.concurrency.Limit()*c.prefetchPerWorker)
 	if err != nil {
 		return err
 	}
+	// Keep prefetching per active image worker as the limit adapts.
+	limits := make(chan int, 16)
+	c.concurrency.OnChange(func(limit int) {
+		select {
+		case limits <- limit:
+		case <-ctx.Done():
+		}
+	})
+	go c.concurrency.Run(ctx, c.concurrencyWindow)
+
+	// Wait for hasher and hasher pdna before consuming messages
+	if err := c.waitForHasher(ctx); err != nil {
+		return err
+	}
 
 	// Handle sigterm signal
 	termChan := make(chan os.Signal)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 
 	//Initialize the worker pool with all required channels. New amqp messages are fed to the jobschan, which distributes the job appropriately to image, video or text chan.
-	worker := Worker{
-		imageIngestChan: make(chan amqp.Delivery, c.nImageThreads),
-		videoIngestChan: make(chan amqp.Delivery, c.nImageThreads),
-		miscIngestChan:  make(chan amqp.Delivery, c.nImageThreads),
-		jobsChan:        make(chan amqp.Delivery, c.nImageThreads),
-		ctx:             ctx,
-		cancelFunc:      cancel,
-		env:             c.env,
-		uri:             c.uri,
-		conn:            conn,
-		maxRetryCount:   c.maxRetrycount,
+	worker := c.newWorker(ctx, cancel)
+	worker.conn = conn
+	worker.newPublisher = func() (Publisher, error) {
+		p, err := NewProducer(ctx, c.env, conn, WithSigner(c.keyring))
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
 	}
 	wg := &sync.WaitGroup{}
 	// a single go routine for image and misc content and twice the number of
 	//image threads for image worker and content type detection worker
-	wg.Add(3 + c.nImageThreads)
+	wg.Add(3)
 	go worker.videoWorkerFunc(wg)
 	go worker.miscWorkerFunc(wg)
 	go worker.contentTypeWorker(wg)
-	for iter := 0; iter < c.nImageThreads; iter++ {
+	c.startImageWorkers(func() {
+		wg.Add(1)
 		go worker.imageWorkerFunc(wg)
+	})
+	// Pause consumption while the hasher circuit breaker is open. In-flight scans
+	// are requeued by the image workers without counting a retry.
+	breakerStates := make(chan breaker.State, 16)
+	paused := false
+	if c.breaker != nil {
+		c.breaker.OnStateChange(func(state breaker.State) {
+			select {
+			case breakerStates <- state:
+			case <-ctx.Done():
+			}
+		})
 	}
-	// Wait for hasher and hasher pdna before consuming messages
-	for {
-		respHasher, errHasher := http.Get("http://127.0.0.1:8080/health")
-		if errHasher != nil || respHasher.StatusCode != 200 {
-			logger.Info(ctx, "Hasher service is not up, sleeping for 5 seconds")
-			time.Sleep(5 * time.Second)
-		} else {
-			break
-		}
-	}
+
+	// The prefetch count only applies to consumers created after it is set, so
+	// the consumer is re-subscribed when it changes. Messages delivered to the
+	// previous consumer are still processed, and it is not re-subscribed again
+	// until they have all been received.
+	var draining <-chan amqp.Delivery
+	resubscribe := false
+
 	logger.Info(ctx, "Consuming from rabbitmq")
 	for {
+		if resubscribe && !paused && draining == nil {
+			resubscribe = false
+			if err := ch.Pause(); err != nil {
+				logger.Error(ctx, "unable to re-subscribe with the new prefetch count", zap.Error(err))
+				cancel()
+			} else {
+				draining = deliveries
+				if deliveries, err = ch.Resume(c.env); err != nil {
+					logger.Error(ctx, "unable to re-subscribe with the new prefetch count", zap.Error(err))
+					cancel()
+				}
+			}
+		}
 		select {
+		case limit := <-limits:
+			logger.Info(ctx, "image worker limit changed", zap.Int("limit", limit))
+			if err := ch.Qos(limit*c.prefetchPerWorker, 0, false); err != nil {
+				logger.Error(ctx, "unable to update prefetch count", zap.Error(err))
+				continue
+			}
+			resubscribe = true
+		case msg, ok := <-draining:
+			if !ok {
+				draining = nil
+				continue
+			}
+			worker.jobsChan <- msg
+		case state := <-breakerStates:
+			if state == breaker.Open && !paused {
+				logger.Error(ctx, "Hasher circuit breaker open, pausing consumption")
+				if err := ch.Pause(); err != nil {
+					logger.Error(ctx, "unable to pause consumption", zap.Error(err))
+					cancel()
+					continue
+				}
+				paused = true
+			} else if state == breaker.Closed && paused {
+				logger.Info(ctx, "Hasher circuit breaker closed, resuming consumption")
+				deliveries, err = ch.Resume(c.env)
+				if err != nil {
+					logger.Error(ctx, "unable to resume consumption", zap.Error(err))
+					cancel()
+					continue
+				}
+				// The resumed consumer already has the current prefetch count.
+				paused, resubscribe = false, false
+			}
 		case <-termChan:
 			logger.Info(ctx, "SIGINT signal caught")
+			c.startImageWorkers(nil)
 			ch.Close()
-			close(worker.imageIngestChan)
+			worker.imageQueue.Close()
+			worker.concurrency.Close()
 			close(worker.videoIngestChan)
 			close(worker.miscIngestChan)
 			close(worker.jobsChan)
@@ -127,7 +426,9 @@ func (c *Consumer) Serve(parentCtx context.Context) error {
 			return nil
 		case <-ctx.Done():
 			logger.Info(ctx, "Done signal caught")
-			close(worker.imageIngestChan)
+			c.startImageWorkers(nil)
+			worker.imageQueue.Close()
+			worker.concurrency.Close()
 			close(worker.videoIngestChan)
 			close(worker.miscIngestChan)
 			close(worker.jobsChan)
@@ -135,9 +436,130 @@ func (c *Consumer) Serve(parentCtx context.Context) error {
 			wg.Wait()
 			logger.Info(ctx, "Workers exited gracefully")
 			return nil
-		case msg := <-deliveries:
+		case msg, ok := <-deliveries:
+			if !ok {
+				// A paused consumer closes its deliveries, otherwise the channel was lost.
+				deliveries = nil
+				if !paused {
+					logger.Error(ctx, "amqp deliveries channel closed")
+					cancel()
+				}
+				continue
+			}
 			logger.Debug(ctx, "Message received")
 			worker.jobsChan <- msg
 		}
 	}
 }
+
+// SetMaxRetryCount changes the number of retries after which scans are parked.
+func (c *Consumer) SetMaxRetryCount(n int) {
+	atomic.StoreInt64(&c.maxRetrycount, int64(n))
+}
+
+// SetWorkers resets the number of active image workers to initial and bounds
+// its adaptation by min and max, starting more image workers while serving if
+// max grew beyond those already started.
+func (c *Consumer) SetWorkers(initial, min, max int) {
+	c.concurrency.SetBounds(initial, min, max)
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+	c.growImageWorkers()
+}
+
+// startImageWorkers starts as many image workers with start as the maximum
+// concurrency limit allows. A nil start stops SetWorkers from starting more
+// once the workers are stopping.
+func (c *Consumer) startImageWorkers(start func()) {
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+	c.startImageWorker = start
+	c.imageWorkers = 0
+	c.growImageWorkers()
+}
+
+// growImageWorkers starts image workers up to the maximum concurrency limit.
+// It is called with workersMu held.
+func (c *Consumer) growImageWorkers() {
+	if c.startImageWorker == nil {
+		return
+	}
+	for ; c.imageWorkers < c.concurrency.Max(); c.imageWorkers++ {
+		c.startImageWorker()
+	}
+}
+
+// newWorker creates the worker pool of the consumer, which still needs a publisher.
+func (c *Consumer) newWorker(ctx context.Context, cancel context.CancelFunc) Worker {
+	return Worker{
+		imageQueue:      c.imageQueue,
+		videoIngestChan: make(chan amqp.Delivery, c.nImageThreads),
+		miscIngestChan:  make(chan amqp.Delivery, c.nImageThreads),
+		jobsChan:        make(chan amqp.Delivery, c.nImageThreads),
+		ctx:             ctx,
+		cancelFunc:      cancel,
+		env:             c.env,
+		uri:             c.uri,
+		maxRetryCount:   &c.maxRetrycount,
+		matcher:         c.matcher,
+		allowlist:       c.allowlist,
+		escalation:      c.escalation,
+		hostLimiter:     c.hostLimiter,
+		concurrency:     c.concurrency,
+		breaker:         c.breaker,
+		policy:          c.policy,
+		urlPolicy:       c.urlPolicy,
+		certs:           c.certs,
+		redactor:        c.redactor,
+		keyring:         c.keyring,
+
+		identifierKeyring: c.identifierKeyring,
+		encryptedFields:   c.encryptedFields,
+		hasherURL:         c.hasherURL,
+	}
+}
+
+// startWorkers starts the worker go routines without a broker, as in batch and
+// dev mode, and returns a function stopping them once the scans in flight were
+// processed.
+func (c *Consumer) startWorkers(ctx context.Context, worker Worker) func() {
+	go c.concurrency.Run(ctx, c.concurrencyWindow)
+	wg, detectWG := &sync.WaitGroup{}, &sync.WaitGroup{}
+	wg.Add(2)
+	detectWG.Add(1)
+	go worker.videoWorkerFunc(wg)
+	go worker.miscWorkerFunc(wg)
+	go worker.contentTypeWorker(detectWG)
+	c.startImageWorkers(func() {
+		wg.Add(1)
+		go worker.imageWorkerFunc(wg)
+	})
+	// Content type detection feeds the other workers, so it stops first.
+	return func() {
+		close(worker.jobsChan)
+		detectWG.Wait()
+		c.startImageWorkers(nil)
+		worker.imageQueue.Close()
+		worker.concurrency.Close()
+		close(worker.videoIngestChan)
+		close(worker.miscIngestChan)
+		wg.Wait()
+	}
+}
+
+// waitForHasher blocks until the hasher is healthy, then starts the circuit
+// breaker probes, if any.
+func (c *Consumer) waitForHasher(ctx context.Context) error {
+	for c.hasherHealthCheck(ctx) != nil {
+		logger.Info(ctx, "Hasher service is not up, sleeping for 5 seconds")
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if c.breaker != nil {
+		go c.breaker.Run(ctx, time.Second, c.hasherHealthCheck)
+	}
+	return nil
+}
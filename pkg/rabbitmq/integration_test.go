@@ -0,0 +1,264 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/amqptest"
+	"github.com/gdcorp-infosec/hashserve/pkg/escalation"
+	"github.com/gdcorp-infosec/hashserve/pkg/fakehasher"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+	"github.com/streadway/amqp"
+)
+
+// newBroker starts an in-process broker with the given exchanges, as provisioned
+// outside hashserve, and a queue bound to each of them, named after the exchange.
+func newBroker(t *testing.T, exchanges ...string) *amqptest.Server {
+	s, err := amqptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for _, name := range exchanges {
+		if err := s.DeclareExchange(name, amqptest.Topic); err != nil {
+			t.Fatal(err)
+		}
+		s.DeclareQueue(name)
+		if err := s.Bind(name, name, "#"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestProducerConfirms(t *testing.T) {
+	s := newBroker(t, IMAGEEXCHANGENAME)
+	conn, err := Dial(s.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx := context.Background()
+	p, err := NewProducer(ctx, "dev", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.Publish(ctx, []byte(`{"url":"a"}`), IMAGEEXCHANGENAME, WithHeader("x-test", "a")); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := s.Messages(IMAGEEXCHANGENAME)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Expected 1 published message. Obtained %+v %v", messages, err)
+	}
+	if m := messages[0]; m.RoutingKey != "#.dev-v2" || m.ContentType != "application/json" || m.DeliveryMode != amqp.Persistent || m.Headers["x-test"] != "a" {
+		t.Errorf("Expected a persistent JSON message with key #.dev-v2. Obtained %+v", m)
+	}
+
+	s.NackPublishes(IMAGEEXCHANGENAME, true)
+	if err := p.Publish(ctx, []byte(`{"url":"b"}`), IMAGEEXCHANGENAME); err != ErrNack {
+		t.Errorf("Expected %v. Obtained %v", ErrNack, err)
+	}
+	s.NackPublishes(IMAGEEXCHANGENAME, false)
+	if err := p.Publish(ctx, []byte(`{"url":"c"}`), "missing"); err == nil {
+		t.Error("Expected an error publishing to a missing exchange")
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	s := newBroker(t)
+	conn, err := Dial(s.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.Initialize("dev", 2); err == nil {
+		t.Fatal("Expected Initialize to fail without the hashserve exchange")
+	}
+
+	if err := s.DeclareExchange(SCANEXCHANGE, amqptest.Topic); err != nil {
+		t.Fatal(err)
+	}
+	if ch, err = conn.Channel(); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := ch.Initialize("dev", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range Topology("dev") {
+		if _, err := s.Publish(b.Exchange, strings.Replace(b.Key, "#", "scan", 1), amqp.Publishing{Body: []byte(b.Queue)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case d := <-deliveries:
+		if string(d.Body) != "hashserve-dev" {
+			t.Errorf("Expected the scan published to the hashserve exchange. Obtained %s", d.Body)
+		}
+		d.Ack(false)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a delivery. Obtained none")
+	}
+	for _, queue := range []string{PARKINGEXCHANGE + "-dev", ESCALATIONEXCHANGE + "-dev"} {
+		if _, err := s.WaitMessages(queue, 1, 5*time.Second); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := ch.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-deliveries; ok || s.Consumers("hashserve-dev") != 0 {
+		t.Error("Expected Pause to cancel the consumer")
+	}
+	if _, err := ch.Resume("dev"); err != nil || s.Consumers("hashserve-dev") != 1 {
+		t.Errorf("Expected Resume to consume again. Obtained %v", err)
+	}
+}
+
+// TestServe runs the consumer against the in-process broker and a scripted
+// fake hasher. Serve registers metrics, so it may only run once per test binary.
+func TestServe(t *testing.T) {
+	script, err := fakehasher.ParseScript(strings.NewReader(`{"rules": [
+		{"url": "https://example.com/retry.jpg", "responses": [{"httpStatus": 502, "body": "bad gateway"}]},
+		{"url": "https://example.com/missing.jpg", "responses": [{"statusCode": 4}]},
+		{"url": "https://example.com/escalate.jpg", "responses": [{"scores": [{"model": "thorn", "scores": {"csam": 0.95}}]}]},
+		{"url": "https://example.com/slow-*.jpg", "responses": [{"latencyMs": 200}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := fakehasher.New(fakehasher.DefaultBehaviour())
+	h.SetScript(script)
+	hasher := httptest.NewServer(h)
+	defer hasher.Close()
+
+	s := newBroker(t, ExternalExchanges...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	escalations, err := escalation.NewPolicy(map[string]escalation.Thresholds{"*": {"csam": 0.9}}, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The escalation exchange is declared by Serve, not by the broker.
+	c := NewConsumer("dev", s.URL(), 2, 3, WithHasherURL(hasher.URL), WithEscalation(escalations))
+	go func() { served <- c.Serve(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Consumers("hashserve-dev") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected Serve to consume from hashserve-dev")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, body := range []string{
+		`{"url": "https://example.com/a.jpg", "product": "websites"}`,
+		`{"url": "https://example.com/retry.jpg", "product": "websites"}`,
+		`{"url": "https://example.com/missing.jpg", "product": "websites"}`,
+		`{"url": "https://example.com/escalate.jpg", "product": "websites"}`,
+		`{"url": `,
+	} {
+		if _, err := s.Publish(SCANEXCHANGE, "scan.dev", amqp.Publishing{ContentType: "application/json", Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fingerprints, err := s.WaitMessages(IMAGEEXCHANGENAME, 2, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5s := map[string]bool{}
+	for _, f := range fingerprints {
+		var published types.Fingerprints
+		if err := json.Unmarshal(f.Body, &published); err != nil || len(published.Fingerprints) != 1 {
+			t.Fatalf("Expected a single fingerprint. Obtained %s %v", f.Body, err)
+		}
+		md5s[published.Fingerprints[0].MD5] = true
+	}
+	for _, url := range []string{"https://example.com/a.jpg", "https://example.com/escalate.jpg"} {
+		if !md5s[fakehasher.Hashes(url).MD5] {
+			t.Errorf("Expected the fingerprint of %s. Obtained %v", url, md5s)
+		}
+	}
+	escalated, err := s.WaitMessages(ESCALATIONEXCHANGE+"-dev", 1, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request types.EscalationRequest
+	if err := json.Unmarshal(escalated[0].Body, &request); err != nil || len(request.Fingerprints) != 1 || escalated[0].Priority != 9 {
+		t.Errorf("Expected escalate.jpg to be escalated with priority 9. Obtained %s %d %v", escalated[0].Body, escalated[0].Priority, err)
+	}
+	retries, err := s.WaitMessages(RETRYEXCHANGE, 1, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var retry types.ScanRequest
+	if err := json.Unmarshal(retries[0].Body, &retry); err != nil || retry.URL != "https://example.com/retry.jpg" || retry.RetryCount != 1 {
+		t.Errorf("Expected retry.jpg to be retried once. Obtained %s %v", retries[0].Body, err)
+	}
+	parked, err := s.WaitMessages(PARKINGEXCHANGE+"-dev", 1, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(parked[0].Body) != `{"url": ` || parked[0].Headers[PARK_REASON_HEADER] == nil {
+		t.Errorf("Expected the invalid scan to be parked with a reason. Obtained %s %v", parked[0].Body, parked[0].Headers)
+	}
+
+	// The dropped scan only shows as settled, like every other one.
+	for s.Unacked("hashserve-dev") != 0 {
+		if time.Now().After(deadline.Add(10 * time.Second)) {
+			t.Fatalf("Expected every scan to be settled. Obtained %d unacked", s.Unacked("hashserve-dev"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if messages, _ := s.Messages("hashserve-dev"); len(messages) != 0 {
+		t.Errorf("Expected no scan left in hashserve-dev. Obtained %d", len(messages))
+	}
+	if fingerprints, _ := s.Messages(IMAGEEXCHANGENAME); len(fingerprints) != 2 {
+		t.Errorf("Expected only a.jpg and escalate.jpg to be fingerprinted. Obtained %d fingerprints", len(fingerprints))
+	}
+
+	// The broker fixes the prefetch count of a consumer when it subscribes, so
+	// a changed image worker limit only applies once Serve re-subscribed.
+	waitUnacked := func(n int) {
+		deadline := time.Now().Add(10 * time.Second)
+		for s.Unacked("hashserve-dev") != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d unacked scans. Obtained %d", n, s.Unacked("hashserve-dev"))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	for i := 0; i < 40; i++ {
+		body := fmt.Sprintf(`{"url": "https://example.com/slow-%d.jpg", "product": "websites"}`, i)
+		if _, err := s.Publish(SCANEXCHANGE, "scan.dev", amqp.Publishing{ContentType: "application/json", Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUnacked(2 * DEFAULT_PREFETCH_PER_WORKER)
+	c.SetWorkers(4, 1, 6)
+	waitUnacked(4 * DEFAULT_PREFETCH_PER_WORKER)
+	waitUnacked(0)
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected Serve to return without error. Obtained %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected Serve to return once cancelled")
+	}
+}
@@ -0,0 +1,218 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// Outcome classifies the result of handling a single scan request.
+type Outcome int
+
+const (
+	// OutcomeSuccess means the hasher returned hashes for the content.
+	OutcomeSuccess Outcome = iota
+	// OutcomeTransportError means no response was received from the hasher,
+	// e.g. a timeout or a refused connection.
+	OutcomeTransportError
+	// OutcomeHTTPError means the hasher answered with a non 2xx HTTP status
+	// and no decodable body.
+	OutcomeHTTPError
+	// OutcomeMalformedResponse means the hasher body could not be decoded or
+	// lacked the fields required to publish a fingerprint.
+	OutcomeMalformedResponse
+	// OutcomeHasherStatus means the hasher reported a status code other than success.
+	OutcomeHasherStatus
+	// OutcomeInvalidRequest means the scan request itself cannot be hashed,
+	// e.g. it is not valid JSON or its URL cannot be parsed.
+	OutcomeInvalidRequest
+)
+
+var outcomeNames = map[Outcome]string{
+	OutcomeSuccess:           "success",
+	OutcomeTransportError:    "transport",
+	OutcomeHTTPError:         "http",
+	OutcomeMalformedResponse: "malformed",
+	OutcomeHasherStatus:      "status",
+	OutcomeInvalidRequest:    "invalid",
+}
+
+func (o Outcome) String() string {
+	return outcomeNames[o]
+}
+
+// hasherFailure reports whether the outcome indicates the hasher itself is unhealthy.
+func (o Outcome) hasherFailure() bool {
+	return o == OutcomeTransportError || o == OutcomeHTTPError || o == OutcomeMalformedResponse
+}
+
+// Action is what a content worker does with a scan request after classifying its outcome.
+type Action int
+
+const (
+	// ActionPublish publishes the fingerprint, only used for OutcomeSuccess.
+	ActionPublish Action = iota
+	// ActionRetry republishes the scan to the retry exchange counting a retry.
+	ActionRetry
+	// ActionRequeue republishes the scan to the retry exchange without counting a retry.
+	ActionRequeue
+	// ActionPark publishes the scan to the parking lot exchange with the failure reason.
+	ActionPark
+	// ActionDrop acknowledges the scan without any further processing.
+	ActionDrop
+)
+
+var actionNames = map[Action]string{
+	ActionPublish: "publish",
+	ActionRetry:   "retry",
+	ActionRequeue: "requeue",
+	ActionPark:    "park",
+	ActionDrop:    "drop",
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// Policy maps outcomes to actions.
+type Policy struct {
+	outcomes map[Outcome]Action
+
+	// Overrides for OutcomeHasherStatus by hasher status code.
+	statusCodes map[int]Action
+
+	// Action taken instead of ActionRetry once the maximum retry count is reached.
+	exhausted Action
+}
+
+// DefaultPolicy retries every hasher failure, drops scans of files that do not
+// exist, parks invalid requests and drops scans that exhausted their retries.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		outcomes: map[Outcome]Action{
+			OutcomeTransportError:    ActionRetry,
+			OutcomeHTTPError:         ActionRetry,
+			OutcomeMalformedResponse: ActionRetry,
+			OutcomeHasherStatus:      ActionRetry,
+			OutcomeInvalidRequest:    ActionPark,
+		},
+		statusCodes: map[int]Action{
+			DOWNLOAD_FAILED_FILE_NOT_FOUND_CODE: ActionDrop,
+		},
+		exhausted: ActionDrop,
+	}
+}
+
+// ParsePolicy overrides the default policy with comma separated key=action pairs.
+// Keys are outcome names, status:<code> for a single hasher status code and
+// exhausted, e.g. "transport=requeue,malformed=park,status:4=drop,exhausted=park".
+func ParsePolicy(s string) (*Policy, error) {
+	p := DefaultPolicy()
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid outcome policy %q", pair)
+		}
+		key, name := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		action, ok := parseAction(name)
+		if !ok || action == ActionPublish {
+			return nil, fmt.Errorf("invalid action %q for %s", name, key)
+		}
+		switch {
+		case key == "exhausted":
+			if action == ActionRetry {
+				return nil, errors.New("exhausted retries cannot be retried")
+			}
+			p.exhausted = action
+		case strings.HasPrefix(key, "status:"):
+			code, err := strconv.Atoi(strings.TrimPrefix(key, "status:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid hasher status code in %q", key)
+			}
+			p.statusCodes[code] = action
+		default:
+			outcome, ok := parseOutcome(key)
+			if !ok || outcome == OutcomeSuccess {
+				return nil, fmt.Errorf("invalid outcome %q", key)
+			}
+			if outcome == OutcomeInvalidRequest && action != ActionPark && action != ActionDrop {
+				return nil, errors.New("invalid requests can only be parked or dropped")
+			}
+			p.outcomes[outcome] = action
+		}
+	}
+	return p, nil
+}
+
+func parseAction(name string) (Action, bool) {
+	for a, n := range actionNames {
+		if n == name {
+			return a, true
+		}
+	}
+	return 0, false
+}
+
+func parseOutcome(name string) (Outcome, bool) {
+	for o, n := range outcomeNames {
+		if n == name {
+			return o, true
+		}
+	}
+	return 0, false
+}
+
+// decide returns the action for a classified scan outcome.
+func decide(p *Policy, outcome Outcome, statusCode int, retryCount int, maxRetryCount int) Action {
+	if outcome == OutcomeSuccess {
+		return ActionPublish
+	}
+	action, ok := Action(0), false
+	if outcome == OutcomeHasherStatus {
+		action, ok = p.statusCodes[statusCode]
+	}
+	if !ok {
+		action, ok = p.outcomes[outcome]
+	}
+	if !ok {
+		action = ActionRetry
+	}
+	if action == ActionRetry && retryCount >= maxRetryCount {
+		return p.exhausted
+	}
+	return action
+}
+
+// errInvalidRequest marks errors caused by the scan request rather than the hasher.
+var errInvalidRequest = errors.New("invalid scan request")
+
+// classifyImageResponse decodes the result of a hasher image call and
+// classifies its outcome. httpStatus is 0 when no response was received.
+func classifyImageResponse(body []byte, httpStatus int, err error) (types.ImageHashResponse, Outcome) {
+	var resp types.ImageHashResponse
+	if errors.Is(err, errInvalidRequest) {
+		return resp, OutcomeInvalidRequest
+	}
+	if err != nil {
+		return resp, OutcomeTransportError
+	}
+	// A body following the hasher contract carries a status code of its own,
+	// which takes precedence over the HTTP status.
+	if json.Unmarshal(body, &resp) != nil || resp.StatusCode == 0 {
+		if httpStatus < 200 || httpStatus > 299 {
+			return resp, OutcomeHTTPError
+		}
+		return resp, OutcomeMalformedResponse
+	}
+	if resp.StatusCode != HASH_SUCCESS_STATUS_CODE {
+		return resp, OutcomeHasherStatus
+	}
+	return resp, OutcomeSuccess
+}
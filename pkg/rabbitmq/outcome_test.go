@@ -0,0 +1,84 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyImageResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		httpStatus int
+		err        error
+		want       Outcome
+	}{
+		{"success", `{"statusCode":1,"statusMessage":"ok"}`, 200, nil, OutcomeSuccess},
+		{"transport", "", 0, errors.New("connection refused"), OutcomeTransportError},
+		{"invalid request", "", 0, fmt.Errorf("%w: bad url", errInvalidRequest), OutcomeInvalidRequest},
+		{"http error", "bad gateway", 502, nil, OutcomeHTTPError},
+		{"malformed", "{", 200, nil, OutcomeMalformedResponse},
+		{"missing status", `{}`, 200, nil, OutcomeMalformedResponse},
+		{"hasher status", `{"statusCode":4}`, 200, nil, OutcomeHasherStatus},
+		{"hasher status on http error", `{"statusCode":4}`, 500, nil, OutcomeHasherStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := classifyImageResponse([]byte(tt.body), tt.httpStatus, tt.err)
+			if got != tt.want {
+				t.Errorf("Expected outcome %s. Obtained %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	policy, err := ParsePolicy("transport=requeue,malformed=park,status:5=park,exhausted=park")
+	if err != nil {
+		t.Fatalf("Unable to parse policy: %s", err)
+	}
+	tests := []struct {
+		name       string
+		policy     *Policy
+		outcome    Outcome
+		statusCode int
+		retryCount int
+		want       Action
+	}{
+		{"success", DefaultPolicy(), OutcomeSuccess, 1, 0, ActionPublish},
+		{"default retry", DefaultPolicy(), OutcomeHTTPError, 0, 0, ActionRetry},
+		{"default exhausted", DefaultPolicy(), OutcomeHTTPError, 0, 3, ActionDrop},
+		{"default file not found", DefaultPolicy(), OutcomeHasherStatus, DOWNLOAD_FAILED_FILE_NOT_FOUND_CODE, 0, ActionDrop},
+		{"default invalid", DefaultPolicy(), OutcomeInvalidRequest, 0, 0, ActionPark},
+		{"override outcome", policy, OutcomeTransportError, 0, 3, ActionRequeue},
+		{"override status", policy, OutcomeHasherStatus, 5, 0, ActionPark},
+		{"unlisted status", policy, OutcomeHasherStatus, 6, 0, ActionRetry},
+		{"override exhausted", policy, OutcomeHTTPError, 0, 3, ActionPark},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decide(tt.policy, tt.outcome, tt.statusCode, tt.retryCount, 3)
+			if got != tt.want {
+				t.Errorf("Expected action %s. Obtained %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, s := range []string{
+		"transport",
+		"transport=explode",
+		"success=retry",
+		"unknown=drop",
+		"status:x=drop",
+		"invalid=retry",
+		"exhausted=retry",
+		"http=publish",
+	} {
+		if _, err := ParsePolicy(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package rabbitmq
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
+	"github.com/gdcorp-infosec/hashserve/pkg/signing"
+	"github.com/gdcorp-infosec/hashserve/pkg/tracing"
 	"github.com/streadway/amqp"
 	"go.uber.org/zap"
 )
@@ -22,13 +25,48 @@ type Producer struct {
 	ch *Channel
 
 	confirms chan amqp.Confirmation
+
+	// Optional keyring published messages are signed with.
+	signer *signing.Keyring
+
+	// Routing key of published messages, defaults to #.<env>-v2
+	routingKey string
+}
+
+// Publisher publishes messages to an exchange. Producer publishes to RabbitMQ,
+// the batch mode writes to files instead.
+type Publisher interface {
+	Publish(ctx context.Context, messageContent []byte, exchangeName string, opts ...PublishOption) error
+	Close() error
+}
+
+// ProducerOption configures optional Producer behaviour.
+type ProducerOption func(*Producer)
+
+// WithSigner signs every published message with the signing key of k, if any.
+func WithSigner(k *signing.Keyring) ProducerOption {
+	return func(p *Producer) {
+		p.signer = k
+	}
+}
+
+// WithRoutingKey publishes messages with key instead of #.<env>-v2, e.g. #.<env>
+// to publish scan requests to hashserve itself.
+func WithRoutingKey(key string) ProducerOption {
+	return func(p *Producer) {
+		p.routingKey = key
+	}
 }
 
 // NewProducer creates a new RabbitMQ Producer.
-func NewProducer(ctx context.Context, env string, connection *Connection) (*Producer, error) {
+func NewProducer(ctx context.Context, env string, connection *Connection, opts ...ProducerOption) (*Producer, error) {
 	p := Producer{
-		env:  env,
-		conn: connection,
+		env:        env,
+		conn:       connection,
+		routingKey: "#." + env + "-v2",
+	}
+	for _, opt := range opts {
+		opt(&p)
 	}
 	ch, err := p.conn.Channel()
 	if err != nil {
@@ -44,7 +82,30 @@ func NewProducer(ctx context.Context, env string, connection *Connection) (*Prod
 	return &p, nil
 }
 
-func (p *Producer) Publish(ctx context.Context, messageContent []byte, exchangeName string) error {
+// Close closes the channel of the producer.
+func (p *Producer) Close() error {
+	return p.ch.Close()
+}
+
+// PublishOption modifies a message before it is published.
+type PublishOption func(*amqp.Publishing)
+
+// WithPriority sets the AMQP priority of the published message.
+func WithPriority(priority uint8) PublishOption {
+	return func(msg *amqp.Publishing) {
+		msg.Priority = priority
+	}
+}
+
+// WithHeader sets an AMQP header on the published message.
+func WithHeader(key string, value interface{}) PublishOption {
+	return func(msg *amqp.Publishing) {
+		msg.Headers[key] = value
+	}
+}
+
+// Publish publishes messageContent to exchangeName and waits for the broker to confirm it.
+func (p *Producer) Publish(ctx context.Context, messageContent []byte, exchangeName string, opts ...PublishOption) error {
 	message := amqp.Publishing{
 		Headers:      amqp.Table{},
 		ContentType:  "application/json",
@@ -52,20 +113,38 @@ func (p *Producer) Publish(ctx context.Context, messageContent []byte, exchangeN
 		Timestamp:    time.Time{},
 		Body:         messageContent,
 	}
-	logger.Debug(ctx, "About to publish")
-	for {
-		err := p.ch.Publish(exchangeName,
-			"#."+p.env+"-v2",
-			false,
-			false,
-			message)
-		confirmed := <-p.confirms
-		if confirmed.Ack {
-			break
-		} else {
-			logger.Error(ctx, "Publish failed", zap.Error(err))
-			return err
+	ctx, span := tracing.Default().Start(ctx, "publish", tracing.KindProducer)
+	defer span.End()
+	span.SetAttribute("exchange", exchangeName)
+	injectTraceContext(ctx, message.Headers)
+	for _, opt := range opts {
+		opt(&message)
+	}
+	if p.signer != nil {
+		if keyID, signature, ok := p.signer.Sign(messageContent); ok {
+			message.Headers[signing.KeyIDHeader] = keyID
+			message.Headers[signing.SignatureHeader] = signature
 		}
 	}
+	logger.Debug(ctx, "About to publish")
+	err := p.ch.Publish(exchangeName,
+		p.routingKey,
+		false,
+		false,
+		message)
+	if err != nil {
+		// No confirmation follows a message that was not sent.
+		logger.Error(ctx, "Publish failed", zap.Error(err))
+		span.SetOutcome("failure")
+		return err
+	}
+	if confirmed := <-p.confirms; !confirmed.Ack {
+		logger.Error(ctx, "Publish failed", zap.Error(ErrNack))
+		span.SetOutcome("nack")
+		return ErrNack
+	}
 	return nil
 }
+
+// ErrNack is returned by Publish when the broker refuses a message.
+var ErrNack = errors.New("message nacked by the broker")
@@ -0,0 +1,57 @@
+package rabbitmq
+
+import (
+	"context"
+	"strings"
+
+	"github.com/streadway/amqp"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/tracing"
+)
+
+// AMQP headers carrying the trace context of a message, the W3C trace context
+// headers and their Elastic APM equivalent.
+const (
+	TRACEPARENT_HEADER         string = tracing.TraceparentHeader
+	TRACESTATE_HEADER          string = tracing.TracestateHeader
+	ELASTIC_TRACEPARENT_HEADER string = tracing.ElasticTraceparentHeader
+)
+
+// tableCarrier adapts the headers of a message to a tracing.Carrier.
+type tableCarrier amqp.Table
+
+// Get looks up a string header case insensitively, publishers differ in
+// how they spell e.g. Traceparent.
+func (t tableCarrier) Get(key string) string {
+	for k, v := range t {
+		if s, ok := v.(string); ok && strings.EqualFold(k, key) {
+			return s
+		}
+	}
+	return ""
+}
+
+func (t tableCarrier) Set(key, value string) {
+	t[key] = value
+}
+
+func (t tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startSpan starts a consumer span continuing the trace of msg, if any.
+func startSpan(ctx context.Context, name string, msg amqp.Delivery) (context.Context, tracing.Span) {
+	tracer := tracing.Default()
+	ctx = tracer.Extract(ctx, tableCarrier(msg.Headers))
+	return tracer.Start(ctx, name, tracing.KindConsumer)
+}
+
+// injectTraceContext adds the trace context of the current span of ctx to
+// the headers of a published message.
+func injectTraceContext(ctx context.Context, headers amqp.Table) {
+	tracing.Default().Inject(ctx, tableCarrier(headers))
+}
@@ -0,0 +1,122 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"go.elastic.co/apm/module/apmhttp/v2"
+	"go.elastic.co/apm/v2"
+	"go.elastic.co/apm/v2/transport"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/fairqueue"
+	"github.com/gdcorp-infosec/hashserve/pkg/tracing"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// useTracer replaces the default tracer for the duration of a test.
+func useTracer(t *testing.T, tracer tracing.Tracer) {
+	previous := tracing.Default()
+	tracing.SetDefault(tracer)
+	t.Cleanup(func() { tracing.SetDefault(previous) })
+}
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	apmTracer, err := apm.NewTracerOptions(apm.TracerOptions{Transport: transport.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apmTracer.Close()
+	useTracer(t, tracing.NewElasticTracer(apmTracer))
+
+	consumed := amqp.Delivery{Headers: amqp.Table{
+		"Traceparent": "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01",
+		"tracestate":  "vendor=abc",
+	}}
+	ctx, span := startSpan(context.Background(), "process image", consumed)
+	defer span.End()
+
+	headers := amqp.Table{}
+	injectTraceContext(ctx, headers)
+	for _, h := range []string{TRACEPARENT_HEADER, ELASTIC_TRACEPARENT_HEADER, TRACESTATE_HEADER} {
+		if _, ok := headers[h]; !ok {
+			t.Errorf("Expected header %s to be injected. Obtained %v", h, headers)
+		}
+	}
+	tc, err := apmhttp.ParseTraceparentHeader(headers[TRACEPARENT_HEADER].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.Trace.String() != "0102030405060708090a0b0c0d0e0f10" {
+		t.Errorf("Expected the consumed trace to continue. Obtained %s", tc.Trace)
+	}
+	if headers[TRACESTATE_HEADER] != "vendor=abc" {
+		t.Errorf("Expected trace state vendor=abc. Obtained %v", headers[TRACESTATE_HEADER])
+	}
+}
+
+func TestTableCarrierGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		value   string
+	}{
+		{"none", amqp.Table{}, ""},
+		{"exact", amqp.Table{"traceparent": "a"}, "a"},
+		{"case insensitive", amqp.Table{"Traceparent": "b"}, "b"},
+		{"not a string", amqp.Table{"traceparent": int32(1)}, ""},
+	}
+	for _, tt := range tests {
+		if value := tableCarrier(tt.headers).Get(TRACEPARENT_HEADER); value != tt.value {
+			t.Errorf("%s: expected %q. Obtained %q", tt.name, tt.value, value)
+		}
+	}
+}
+
+func TestDetectContentTypeSpans(t *testing.T) {
+	recorder := tracing.NewRecorder()
+	useTracer(t, recorder)
+
+	body, _ := json.Marshal(types.ScanRequest{URL: "https://example.com/image.jpeg", Product: "websites"})
+	w := Worker{ctx: context.Background(), imageQueue: fairqueue.New(nil, nil, 1)}
+	w.detectContentType(nil, amqp.Delivery{
+		Body:    body,
+		Headers: amqp.Table{"elastic-apm-traceparent": "00-1112131415161718191a1b1c1d1e1f20-0102030405060708-01"},
+	})
+
+	consume, ok := recorder.Span("consume")
+	if !ok {
+		t.Fatalf("Expected a consume span. Obtained %+v", recorder.Spans())
+	}
+	if consume.TraceID != "1112131415161718191a1b1c1d1e1f20" || consume.ParentID != "0102030405060708" || consume.Kind != tracing.KindConsumer {
+		t.Errorf("Expected a consumer span continuing the message trace. Obtained %+v", consume)
+	}
+	detect, ok := recorder.Span("detect")
+	if !ok {
+		t.Fatalf("Expected a detect span. Obtained %+v", recorder.Spans())
+	}
+	if detect.ParentID != consume.SpanID || detect.Attributes["content_type"] != string(IMAGE_CONTENT) {
+		t.Errorf("Expected an image detect span below the consume span. Obtained %+v", detect)
+	}
+}
+
+func TestGetHashesSpans(t *testing.T) {
+	recorder := tracing.NewRecorder()
+	useTracer(t, recorder)
+
+	ctx, span := recorder.Start(context.Background(), "process image", tracing.KindConsumer)
+	_, _, err := getHashes(ctx, DEFAULT_HASHER_URL, "", "", IMAGE_CONTENT)
+	span.End()
+	if err == nil || !strings.Contains(err.Error(), errInvalidRequest.Error()) {
+		t.Fatalf("Expected an invalid request error. Obtained %v", err)
+	}
+	validate, ok := recorder.Span("validate")
+	if !ok || validate.ParentID == "" {
+		t.Errorf("Expected a child validate span. Obtained %+v", recorder.Spans())
+	}
+	if _, ok := recorder.Span("hash"); ok {
+		t.Error("Expected no hash span for an invalid request")
+	}
+}
@@ -8,87 +8,124 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gdcorp-infosec/cset-go-common/utilities"
 	"github.com/gdcorp-infosec/dcu-structured-logging-go/logger"
 	"github.com/streadway/amqp"
-	"go.elastic.co/apm/module/apmhttp/v2"
-	"go.elastic.co/apm/v2"
 
+	"github.com/gdcorp-infosec/hashserve/pkg/adaptive"
+	"github.com/gdcorp-infosec/hashserve/pkg/allowlist"
+	"github.com/gdcorp-infosec/hashserve/pkg/breaker"
+	"github.com/gdcorp-infosec/hashserve/pkg/clientcert"
+	"github.com/gdcorp-infosec/hashserve/pkg/escalation"
+	"github.com/gdcorp-infosec/hashserve/pkg/fairqueue"
+	"github.com/gdcorp-infosec/hashserve/pkg/hostlimit"
+	"github.com/gdcorp-infosec/hashserve/pkg/pdna"
+	"github.com/gdcorp-infosec/hashserve/pkg/redact"
+	"github.com/gdcorp-infosec/hashserve/pkg/signing"
+	"github.com/gdcorp-infosec/hashserve/pkg/tracing"
 	"github.com/gdcorp-infosec/hashserve/pkg/types"
+	"github.com/gdcorp-infosec/hashserve/pkg/urlpolicy"
 	"go.uber.org/zap"
 )
 
 type ContentType string
 
 const (
+	SCANEXCHANGE                        string      = "hashserve"
 	IMAGEEXCHANGENAME                   string      = "pdna-processor"
 	VIDEOEXCHANGE                       string      = "video-processor"
 	MISCEXCHANGE                        string      = "misc-processor"
 	RETRYEXCHANGE                       string      = "hashserve-dlq"
+	ESCALATIONEXCHANGE                  string      = "hashserve-escalation"
+	PARKINGEXCHANGE                     string      = "hashserve-parking"
+	PARK_REASON_HEADER                  string      = "x-park-reason"
 	IMAGE_CONTENT                       ContentType = "image"
 	VIDEO_CONTENT                       ContentType = "video"
 	MISC_CONTENT                        ContentType = "miscellaneous"
-	VIDEO_HASHER_URL                    string      = "http://localhost:8080/v1/hash/video"
-	IMAGE_HASHER_URL                    string      = "http://localhost:8080/v1/hash/image"
+	DEFAULT_HASHER_URL                  string      = "http://localhost:8080"
+	VIDEO_HASHER_PATH                   string      = "/v1/hash/video"
+	IMAGE_HASHER_PATH                   string      = "/v1/hash/image"
+	HASHER_HEALTH_PATH                  string      = "/health"
 	DOWNLOAD_FAILED_FILE_NOT_FOUND_CODE int         = 4
 	HASH_SUCCESS_STATUS_CODE            int         = 1
+	DEFAULT_PREFETCH_PER_WORKER         int         = 2
 )
 
-//getHashes accepts the url as input, calls the hasher service and
-//returns the response as a byte sequence
-func getHashes(ctx context.Context, url string, cert string, contentType ContentType) ([]byte, error) {
+//getHashes accepts the url as input, calls the hasher service at hasher and
+//returns the response as a byte sequence together with the HTTP status code.
+//Errors caused by the request itself wrap errInvalidRequest.
+func getHashes(ctx context.Context, hasher string, url string, cert string, contentType ContentType) ([]byte, int, error) {
 	var hasherURL string
 	if contentType == VIDEO_CONTENT {
-		hasherURL = VIDEO_HASHER_URL
+		hasherURL = strings.TrimSuffix(hasher, "/") + VIDEO_HASHER_PATH
 	} else if contentType == IMAGE_CONTENT {
-		hasherURL = IMAGE_HASHER_URL
+		hasherURL = strings.TrimSuffix(hasher, "/") + IMAGE_HASHER_PATH
 	} else {
-		return nil, errors.New("Unsupported file type by hasher microservice")
+		return nil, 0, fmt.Errorf("%w: unsupported file type by hasher microservice", errInvalidRequest)
 	}
 	hashRequest := types.HashRequest{
 		URL:  url,
 		Cert: cert,
 	}
+	_, validateSpan := tracing.Default().Start(ctx, "validate", tracing.KindInternal)
 	err := hashRequest.ValidateRequiredFields()
+	validateSpan.End()
 	if err != nil {
 		logger.Error(ctx, "invalid URL", zap.Error(err))
-		return nil, err
+		return nil, 0, fmt.Errorf("%w: %s", errInvalidRequest, err)
 	}
 
 	// Marshal hashRequest to json
 	reqJson, err := json.Marshal(hashRequest)
 	if err != nil {
 		logger.Error(ctx, "failed to unmarshall json string into hashRequest struct", zap.Error(err))
-		return nil, err
+		return nil, 0, fmt.Errorf("%w: %s", errInvalidRequest, err)
 	}
 
 	//Get hashses from hashser micro service
+	ctx, span := tracing.Default().Start(ctx, "hash", tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("content_type", string(contentType))
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hasherURL, bytes.NewBuffer(reqJson))
 	if err != nil {
 		logger.Error(ctx, "Error in creating a request to hasher service", zap.Error(err))
-		return nil, err
+		return nil, 0, err
 	}
-	httpClient := apmhttp.WrapClient(&http.Client{
+	tracing.Default().Inject(ctx, tracing.HeaderCarrier(req.Header))
+	httpClient := &http.Client{
 		Timeout: 2 * time.Minute,
-	})
+	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("failed getting a response from hasher microservice. Request JSON: %s", string(reqJson)), zap.Error(err))
-		return nil, err
+		span.SetOutcome("transport error")
+		// The request JSON holds the client certificate and is never logged.
+		logger.Error(ctx, fmt.Sprintf("failed getting a response from hasher microservice for %s", url), zap.Error(err))
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
+	span.SetAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
 	body, err := ioutil.ReadAll(resp.Body)
 	logger.Debug(ctx, fmt.Sprintf("Hasher status code: %d, Body: %s", resp.StatusCode, string(body)))
 	if err != nil {
 		logger.Error(ctx, "Unable to convert response to byte sequence", zap.Error(err))
-		return nil, err
+		return nil, resp.StatusCode, err
 	}
-	return body, nil
+	return body, resp.StatusCode, nil
+}
+
+// HashURL calls the hasher service at hasher for the content type of url and
+// returns its response body and HTTP status.
+func HashURL(ctx context.Context, hasher string, url string, cert string) ([]byte, int, error) {
+	return getHashes(ctx, hasher, url, cert, getContentType(ctx, url))
 }
 
 // getContentType checks if the file extension in url matches the miscellaneous or video extension
@@ -111,18 +148,39 @@ func getContentType(ctx context.Context, Url string) ContentType {
 
 /*Worker is a wrapper around the different worker go routines.
 amqp messages are fed to the jobsChan where the content type is detected
-and routed appropriately to imageIngestChan, videoIngestChan or miscIngestChan.*/
+and routed appropriately to imageQueue, videoIngestChan or miscIngestChan.
+imageQueue schedules image scans fairly between products.*/
 type Worker struct {
-	imageIngestChan chan amqp.Delivery
-	videoIngestChan chan amqp.Delivery
-	miscIngestChan  chan amqp.Delivery
-	jobsChan        chan amqp.Delivery
-	ctx             context.Context
-	cancelFunc      context.CancelFunc
-	env             string
-	uri             string
-	conn            *Connection
-	maxRetryCount   int
+	imageQueue        *fairqueue.Queue
+	videoIngestChan   chan amqp.Delivery
+	miscIngestChan    chan amqp.Delivery
+	jobsChan          chan amqp.Delivery
+	ctx               context.Context
+	cancelFunc        context.CancelFunc
+	env               string
+	uri               string
+	conn              *Connection
+	maxRetryCount     *int64
+	matcher           *pdna.Index
+	allowlist         *allowlist.List
+	escalation        *escalation.Policy
+	hostLimiter       *hostlimit.Limiter
+	concurrency       *adaptive.Controller
+	breaker           *breaker.Breaker
+	policy            *Policy
+	urlPolicy         *urlpolicy.Policy
+	certs             *clientcert.Validator
+	redactor          *redact.Redactor
+	keyring           *signing.Keyring
+	identifierKeyring *types.IdentifierKeyring
+	encryptedFields   []string
+	hasherURL         string
+
+	// Creates the publisher of each worker go routine
+	newPublisher func() (Publisher, error)
+
+	// Optional hook called for scans the outcome policy drops
+	dropped func(msg amqp.Delivery, reason string)
 }
 
 //ackMessage acknowledges the given amqp message
@@ -134,6 +192,15 @@ func (w Worker) ackMessage(msg amqp.Delivery) {
 	}
 }
 
+//requeueMessage returns the given amqp message to its queue without counting a retry
+func (w Worker) requeueMessage(msg amqp.Delivery) {
+	if objErr := msg.Nack(false, true); objErr != nil {
+		//A failure to nack, we send the cancel signal requesting all go routines to stop
+		logger.Error(w.ctx, "error requeueing message", zap.Error(objErr))
+		w.cancelFunc()
+	}
+}
+
 //rejectMessageWithoutRequeue rejects the given amqp message
 func (w Worker) rejectMessageWithoutRequeue(msg amqp.Delivery) {
 	if objErr := msg.Reject(false); objErr != nil {
@@ -143,24 +210,148 @@ func (w Worker) rejectMessageWithoutRequeue(msg amqp.Delivery) {
 	}
 }
 
-/*imageWorkerFunc listens to imageIngestChan, calls the hasher microservice to get hashes
+// retryLimit returns the max retry count, which may change while the workers run.
+func (w Worker) retryLimit() int {
+	return int(atomic.LoadInt64(w.maxRetryCount))
+}
+
+// urlPolicyAction parks scans violating the URL policy and applies the outcome
+// policy when their host could not be resolved, which may be transient.
+func (w Worker) urlPolicyAction(err error, retryCount int) Action {
+	var violation *urlpolicy.Violation
+	if errors.As(err, &violation) {
+		return ActionPark
+	}
+	return decide(w.policy, OutcomeTransportError, 0, retryCount, w.retryLimit())
+}
+
+// matchPhotoDNA looks up near-duplicates of the given PhotoDNA hash in the
+// reference index. A hash that cannot be decoded is logged and yields no matches.
+func (w Worker) matchPhotoDNA(ctx context.Context, photoDNA string) []types.PhotoDNAMatch {
+	_, span := tracing.Default().Start(ctx, "pdna match", tracing.KindInternal)
+	defer span.End()
+	h, err := pdna.Parse(photoDNA)
+	if err != nil {
+		logger.Error(ctx, "unable to decode photoDNA hash for matching", zap.Error(err))
+		return nil
+	}
+	var matches []types.PhotoDNAMatch
+	for _, c := range w.matcher.Match(h) {
+		matches = append(matches, types.PhotoDNAMatch{ReferenceID: c.ID, Distance: c.Distance})
+	}
+	if len(matches) > 0 {
+		logger.Info(ctx, "PhotoDNA near-duplicate found", zap.String("referenceID", matches[0].ReferenceID), zap.Float64("distance", matches[0].Distance))
+	}
+	return matches
+}
+
+// escalate publishes the fingerprint to the escalation exchange when its ML scores
+// exceed the thresholds of its product. Failures are logged only, the fingerprint
+// has already been published to the regular thornworker queue.
+func (w Worker) escalate(ctx context.Context, producer Publisher, fingerprint types.ImageFingerprintRequest) {
+	if err := fingerprint.MlScores.Validate(); err != nil {
+		logger.Error(ctx, "not escalating fingerprint with invalid ML scores", zap.Error(err))
+		return
+	}
+	reason, ok := w.escalation.Evaluate(fingerprint.Product, fingerprint.MlScores.Labels())
+	if !ok {
+		return
+	}
+	body, err := json.Marshal(types.EscalationRequest{
+		Fingerprints: []types.ImageFingerprintRequest{fingerprint},
+		Reason:       reason,
+	})
+	if err != nil {
+		logger.Error(ctx, "unable to marshal escalation request", zap.Error(err))
+		return
+	}
+	if err := producer.Publish(ctx, body, ESCALATIONEXCHANGE, WithPriority(w.escalation.Priority())); err != nil {
+		logger.Error(ctx, "failed publishing to the escalation exchange", zap.Error(err))
+		return
+	}
+	logger.Info(ctx, fmt.Sprintf("Escalated %s", fingerprint.Path), zap.String("reason", reason))
+}
+
+// applyAction carries out the outcome policy action for a scan that could not be
+// fingerprinted and settles the message. scanRequest is nil when the message body
+// could not be decoded, in which case the original body is parked.
+func (w Worker) applyAction(ctx context.Context, producer Publisher, msg amqp.Delivery, scanRequest *types.ScanRequest, action Action, reason string) {
+	var err error
+	switch action {
+	case ActionRetry:
+		scanRequest.RetryCount = scanRequest.RetryCount + 1
+		scanRequest.PublishTime = time.Now().Format(time.RFC3339)
+		body, _ := json.Marshal(scanRequest)
+		err = producer.Publish(ctx, body, RETRYEXCHANGE)
+	case ActionRequeue:
+		err = w.deferMessage(ctx, producer, *scanRequest)
+	case ActionPark:
+		body := msg.Body
+		if scanRequest != nil {
+			body, _ = json.Marshal(scanRequest)
+		}
+		err = producer.Publish(ctx, body, PARKINGEXCHANGE, WithHeader(PARK_REASON_HEADER, reason))
+	}
+	if err != nil {
+		logger.Error(ctx, fmt.Sprintf("failed to %s scan", action), zap.Error(err))
+		w.cancelFunc()
+		return
+	}
+	scanURL := ""
+	if scanRequest != nil {
+		scanURL = scanRequest.URL
+	}
+	logger.Error(ctx, fmt.Sprintf("Unable to fingerprint %s, action %s", scanURL, action), zap.String("reason", reason))
+	if action == ActionDrop && w.dropped != nil {
+		w.dropped(msg, reason)
+	}
+	w.ackMessage(msg)
+}
+
+// deferMessage republishes the scan request to the retry exchange without counting
+// a retry, so it is redelivered once the retry queue delay has passed.
+func (w Worker) deferMessage(ctx context.Context, producer Publisher, scanRequest types.ScanRequest) error {
+	scanRequest.PublishTime = time.Now().Format(time.RFC3339)
+	body, err := json.Marshal(scanRequest)
+	if err != nil {
+		return err
+	}
+	return producer.Publish(ctx, body, RETRYEXCHANGE)
+}
+
+/*imageWorkerFunc takes scans from the per product imageQueue, calls the hasher microservice to get hashes
 and routes response to image exchange.*/
 func (w Worker) imageWorkerFunc(wg *sync.WaitGroup) {
 	defer wg.Done()
 	logger.Info(w.ctx, "Image worker started")
-	objProducer, err := NewProducer(w.ctx, w.env, w.conn)
+	objProducer, err := w.newPublisher()
 	if err != nil {
 		logger.Error(w.ctx, "Unable to create a producer", zap.Error(err))
 		w.cancelFunc()
 		return
 	}
-	defer objProducer.ch.Close()
-	for imageMsg := range w.imageIngestChan {
+	defer objProducer.Close()
+	for {
+		item, done, ok := w.imageQueue.Pop()
+		if !ok {
+			break
+		}
+		imageMsg := item.(amqp.Delivery)
+		// Only as many image workers as the concurrency limit allows work at the
+		// same time. Idle workers do not hold a slot, so the limit only grows when
+		// scans use it.
+		if !w.concurrency.Acquire() {
+			// The limit only refuses work during shutdown, let the broker redeliver it.
+			w.requeueMessage(imageMsg)
+			done()
+			break
+		}
 		logger.Debug(w.ctx, "Image channel started")
 		func() {
-			tx := apm.DefaultTracer().StartTransaction("Hash image", "request")
-			defer tx.End()
-			ctx := apm.ContextWithTransaction(w.ctx, tx)
+			defer w.concurrency.Release()
+			defer done()
+			ctx, span := startSpan(w.ctx, "process image", imageMsg)
+			defer span.End()
 			utilities.StartMetrics("hash_image")
 			start := time.Now()
 			errmsg := "failure"
@@ -170,69 +361,156 @@ func (w Worker) imageWorkerFunc(wg *sync.WaitGroup) {
 			//If unable to unmarshal the message into scanRequestData, log the error.
 			if err != nil {
 				logger.Error(ctx, "failed to unmarshall json string into scanRequestData struct", zap.Error(err))
-				w.rejectMessageWithoutRequeue(imageMsg)
+				w.applyAction(ctx, objProducer, imageMsg, nil, decide(w.policy, OutcomeInvalidRequest, 0, 0, w.retryLimit()), fmt.Sprintf("%s: %s", OutcomeInvalidRequest, err))
 				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
 				return
 			}
-			hasherResponse, err := getHashes(ctx, scanRequestData.URL, scanRequestData.Cert, IMAGE_CONTENT)
-			var hashedData types.ImageHashResponse
-			errUnmarshal := json.Unmarshal(hasherResponse, &hashedData)
-			// We shouldn't encounter this error ideally
-			if errUnmarshal != nil {
-				logger.Error(ctx, "Failed to unmarshal JSON", zap.Error(err))
-				w.ackMessage(imageMsg)
-				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
-				return
+			if w.redactor != nil {
+				w.redactor.SetSpanAttributes(span, &scanRequestData)
 			}
-			// This section of the code deals with retrying using a dead letter queue.
-			// Reject message if hasher either returns a file not found error or if retry count is greater than or equal to max retry count.
-			// Reque if the retry count is below max retry count and hasher returns a status code other than file not found or hash success.
-			tx.Result = hashedData.StatusMessage
-			if err == nil && hashedData.StatusCode == DOWNLOAD_FAILED_FILE_NOT_FOUND_CODE {
-				logger.Error(ctx, fmt.Sprintf("Obtained file not found status code for %s. Rejecting message", scanRequestData.URL))
-				w.ackMessage(imageMsg)
-				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
-				return
-			} else if hashedData.StatusCode != HASH_SUCCESS_STATUS_CODE && scanRequestData.RetryCount >= w.maxRetryCount {
-				logger.Error(ctx, fmt.Sprintf("Max retry count reached for %s. Rejecting message", scanRequestData.URL))
-				w.ackMessage(imageMsg)
+			if w.allowlist != nil {
+				if rule, ok := w.allowlist.MatchRequest(&scanRequestData); ok {
+					logger.Debug(ctx, fmt.Sprintf("Skipping allowlisted image %s", scanRequestData.URL), zap.String("rule", rule))
+					span.SetOutcome("allowlisted")
+					w.ackMessage(imageMsg)
+					utilities.EndMetrics("hash_image", nil, time.Since(start).Seconds())
+					return
+				}
+			}
+			var vetted []net.IP
+			if w.urlPolicy != nil {
+				if vetted, err = w.urlPolicy.Check(ctx, scanRequestData.URL); err != nil {
+					span.SetOutcome("url policy")
+					w.applyAction(ctx, objProducer, imageMsg, &scanRequestData, w.urlPolicyAction(err, scanRequestData.RetryCount), err.Error())
+					utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
+					return
+				}
+			}
+			if scanRequestData.Cert != "" && w.certs != nil {
+				if _, err := w.certs.Validate(scanRequestData.Cert); err != nil {
+					span.SetOutcome("invalid certificate")
+					w.applyAction(ctx, objProducer, imageMsg, &scanRequestData, decide(w.policy, OutcomeInvalidRequest, 0, 0, w.retryLimit()), err.Error())
+					utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
+					return
+				}
+			}
+			if w.breaker != nil && !w.breaker.Allow() {
+				// The hasher is unavailable, return the scan without counting a retry.
+				logger.Debug(ctx, fmt.Sprintf("Hasher circuit breaker open, requeueing %s", scanRequestData.URL))
+				span.SetOutcome("circuit open")
+				w.requeueMessage(imageMsg)
 				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
 				return
-			} else if hashedData.StatusCode != HASH_SUCCESS_STATUS_CODE || err != nil {
-				// Requeue in dead letter queue
-				scanRequestData.RetryCount = scanRequestData.RetryCount + 1
-				scanRequestData.PublishTime = time.Now().Format(time.RFC3339)
-				json, _ := json.Marshal(scanRequestData)
-				err = objProducer.Publish(w.ctx, json, RETRYEXCHANGE)
-				if err != nil {
-					logger.Error(ctx, "failed publishing to the retry queue", zap.Error(err))
-					w.cancelFunc()
+			}
+			if w.hostLimiter != nil {
+				if u, err := url.Parse(scanRequestData.URL); err == nil {
+					release, ok := w.hostLimiter.TryAcquire(u.Hostname())
+					if !ok {
+						// The host is saturated, defer the scan through the retry queue instead of blocking this worker.
+						if err := w.deferMessage(ctx, objProducer, scanRequestData); err != nil {
+							logger.Error(ctx, "failed publishing to the retry queue", zap.Error(err))
+							w.cancelFunc()
+							utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
+							return
+						}
+						logger.Debug(ctx, fmt.Sprintf("Host %s saturated, deferred %s", u.Hostname(), scanRequestData.URL))
+						span.SetOutcome("deferred")
+						w.ackMessage(imageMsg)
+						utilities.EndMetrics("hash_image", nil, time.Since(start).Seconds())
+						return
+					}
+					defer release()
+				}
+			}
+			if w.urlPolicy != nil {
+				// The host may have changed its answers while the scan waited for the limits.
+				if err := w.urlPolicy.Confirm(ctx, scanRequestData.URL, vetted); err != nil {
+					span.SetOutcome("url policy")
+					w.applyAction(ctx, objProducer, imageMsg, &scanRequestData, w.urlPolicyAction(err, scanRequestData.RetryCount), err.Error())
+					utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
+					return
+				}
+			}
+			hashStart := time.Now()
+			hasherResponse, httpStatus, err := getHashes(ctx, w.hasherURL, scanRequestData.URL, scanRequestData.Cert, IMAGE_CONTENT)
+			hashedData, outcome := classifyImageResponse(hasherResponse, httpStatus, err)
+			w.concurrency.Observe(time.Since(hashStart), outcome.hasherFailure())
+			// Scans the hasher answered are handled whatever the breaker state, only
+			// hasher failures are requeued while it is open.
+			if w.breaker != nil && !outcome.hasherFailure() {
+				w.breaker.Success()
+			} else if w.breaker != nil {
+				w.breaker.Failure()
+				if !w.breaker.Allow() {
+					logger.Error(ctx, fmt.Sprintf("Hasher circuit breaker open, requeueing %s", scanRequestData.URL), zap.Error(err))
+					span.SetOutcome("circuit open")
+					w.requeueMessage(imageMsg)
 					utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
 					return
 				}
-				logger.Error(ctx, fmt.Sprintf("Obtained status message: %s.%s URL published for retry", hashedData.StatusMessage, scanRequestData.URL))
-				w.ackMessage(imageMsg)
+			}
+			// The outcome policy decides whether a failed scan is retried through the
+			// dead letter queue, requeued without counting a retry, parked or dropped.
+			span.SetOutcome(outcome.String())
+			if outcome != OutcomeSuccess {
+				reason := fmt.Sprintf("%s: hasher status %d %s, HTTP status %d", outcome, hashedData.StatusCode, hashedData.StatusMessage, httpStatus)
+				if err != nil {
+					reason = fmt.Sprintf("%s: %s", outcome, err)
+				}
+				action := decide(w.policy, outcome, hashedData.StatusCode, scanRequestData.RetryCount, w.retryLimit())
+				w.applyAction(ctx, objProducer, imageMsg, &scanRequestData, action, reason)
 				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
 				return
 			}
+			if w.allowlist != nil {
+				if rule, ok := w.allowlist.MatchHashes(scanRequestData.Product, hashedData.Hashes); ok {
+					logger.Debug(ctx, fmt.Sprintf("Not publishing image %s allowlisted after hashing", scanRequestData.URL), zap.String("rule", rule))
+					span.SetOutcome("allowlisted after hash")
+					w.ackMessage(imageMsg)
+					utilities.EndMetrics("hash_image", nil, time.Since(start).Seconds())
+					return
+				}
+			}
+			// ML scores are optional, an invalid model result must not cost the hashes.
+			scores, invalid := hashedData.MlScores.Valid()
+			for _, err := range invalid {
+				logger.Error(ctx, fmt.Sprintf("Dropping invalid ML scores of %s", scanRequestData.URL), zap.Error(err))
+			}
 			imageFingerprintRequest := types.ImageFingerprintRequest{
 				Path:        hashedData.URL,
 				MD5:         hashedData.Hashes.MD5,
 				SHA1:        hashedData.Hashes.SHA1,
 				PhotoDNA:    hashedData.Hashes.PDNA,
 				Product:     scanRequestData.Product,
-				MlScores:    hashedData.MlScores,
+				MlScores:    scores,
 				Source:      "scan",
 				Identifiers: scanRequestData.Identifiers,
 			}
+			if w.matcher != nil && imageFingerprintRequest.PhotoDNA != "" {
+				imageFingerprintRequest.Matches = w.matchPhotoDNA(ctx, imageFingerprintRequest.PhotoDNA)
+			}
 			err = imageFingerprintRequest.ValidateRequiredFields()
 			if err != nil {
 				logger.Error(ctx, "failed validating the FingerprintRequest attributes", zap.Error(err))
-				w.rejectMessageWithoutRequeue(imageMsg)
+				span.SetOutcome(OutcomeMalformedResponse.String())
+				action := decide(w.policy, OutcomeMalformedResponse, hashedData.StatusCode, scanRequestData.RetryCount, w.retryLimit())
+				w.applyAction(ctx, objProducer, imageMsg, &scanRequestData, action, fmt.Sprintf("%s: %s", OutcomeMalformedResponse, err))
 				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
 				return
 			}
 
+			if w.identifierKeyring != nil {
+				if err := imageFingerprintRequest.Identifiers.Encrypt(w.identifierKeyring, w.encryptedFields); err != nil {
+					// The identifiers of this scan cannot be encrypted, e.g. they already
+					// are, which retrying would not change.
+					logger.Error(ctx, "failed encrypting account identifiers", zap.Error(err))
+					span.SetOutcome("encryption failed")
+					w.applyAction(ctx, objProducer, imageMsg, &scanRequestData, ActionPark, fmt.Sprintf("encryption: %s", err))
+					utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
+					return
+				}
+			}
+
 			fingerprints := types.Fingerprints{
 				Fingerprints: []types.ImageFingerprintRequest{imageFingerprintRequest},
 			}
@@ -245,15 +523,16 @@ func (w Worker) imageWorkerFunc(wg *sync.WaitGroup) {
 				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
 				return
 			}
-			span, ctx := apm.StartSpan(ctx, "Hash publish", "amqp.publish")
 			err = objProducer.Publish(ctx, json, IMAGEEXCHANGENAME)
-			span.End()
 			if err != nil {
 				logger.Error(ctx, "failed publishing to the thornworker queue", zap.Error(err))
 				w.cancelFunc()
 				utilities.EndMetrics("hash_image", &errmsg, time.Since(start).Seconds())
 				return
 			}
+			if w.escalation != nil {
+				w.escalate(ctx, objProducer, imageFingerprintRequest)
+			}
 
 			w.ackMessage(imageMsg)
 			utilities.EndMetrics("hash_image", nil, time.Since(start).Seconds())
@@ -266,16 +545,17 @@ func (w Worker) imageWorkerFunc(wg *sync.WaitGroup) {
 and routes response to video exchange.*/
 func (w Worker) videoWorkerFunc(wg *sync.WaitGroup) {
 	defer wg.Done()
-	objProducer, err := NewProducer(w.ctx, w.env, w.conn)
+	objProducer, err := w.newPublisher()
 	if err != nil {
 		logger.Error(w.ctx, "Unable to create a producer", zap.Error(err))
 		w.cancelFunc()
 		return
 	}
-	defer objProducer.ch.Close()
+	defer objProducer.Close()
 	logger.Info(w.ctx, "Video worker started")
 	for videoMsg := range w.videoIngestChan {
 		logger.Debug(w.ctx, "Video channel started")
+		ctx, span := startSpan(w.ctx, "process video", videoMsg)
 		utilities.StartMetrics("hash_video")
 		start := time.Now()
 		errmsg := "failure"
@@ -284,12 +564,14 @@ func (w Worker) videoWorkerFunc(wg *sync.WaitGroup) {
 		err := json.Unmarshal(videoMsg.Body, &scanRequestData)
 		//If unable to unmarshal the message into scanRequestData, log the error.
 		if err != nil {
-			logger.Error(w.ctx, "failed to unmarshall json string into scanRequestData struct", zap.Error(err))
-			w.rejectMessageWithoutRequeue(videoMsg)
+			logger.Error(ctx, "failed to unmarshall json string into scanRequestData struct", zap.Error(err))
+			w.applyAction(ctx, objProducer, videoMsg, nil, decide(w.policy, OutcomeInvalidRequest, 0, 0, w.retryLimit()), fmt.Sprintf("%s: %s", OutcomeInvalidRequest, err))
 			utilities.EndMetrics("hash_video", &errmsg, time.Since(start).Seconds())
+			span.End()
 			continue
 		}
 		w.ackMessage(videoMsg)
+		span.End()
 		utilities.EndMetrics("hash_video", nil, time.Since(start).Seconds())
 		logger.Debug(w.ctx, fmt.Sprintf("Successfully processed %s video", scanRequestData.URL))
 	}
@@ -298,9 +580,17 @@ func (w Worker) videoWorkerFunc(wg *sync.WaitGroup) {
 //miscWorkerFunc listens to miscIngestChan
 func (w Worker) miscWorkerFunc(wg *sync.WaitGroup) {
 	defer wg.Done()
+	objProducer, err := w.newPublisher()
+	if err != nil {
+		logger.Error(w.ctx, "Unable to create a producer", zap.Error(err))
+		w.cancelFunc()
+		return
+	}
+	defer objProducer.Close()
 	logger.Info(w.ctx, "Misc worker started")
 	for miscMsg := range w.miscIngestChan {
 		logger.Debug(w.ctx, "Miscellaneous channel started")
+		ctx, span := startSpan(w.ctx, "process misc", miscMsg)
 		utilities.StartMetrics("hash_misc")
 		start := time.Now()
 		errmsg := "failure"
@@ -309,40 +599,70 @@ func (w Worker) miscWorkerFunc(wg *sync.WaitGroup) {
 		err := json.Unmarshal(miscMsg.Body, &scanRequestData)
 		if err != nil {
 			log.Printf("unable to marshal message %s", err)
-			w.rejectMessageWithoutRequeue(miscMsg)
+			w.applyAction(ctx, objProducer, miscMsg, nil, decide(w.policy, OutcomeInvalidRequest, 0, 0, w.retryLimit()), fmt.Sprintf("%s: %s", OutcomeInvalidRequest, err))
 			utilities.EndMetrics("hash_misc", &errmsg, time.Since(start).Seconds())
+			span.End()
 			continue
 		}
 		w.ackMessage(miscMsg)
+		span.End()
 		utilities.EndMetrics("hash_misc", nil, time.Since(start).Seconds())
 		logger.Debug(w.ctx, fmt.Sprintf("Successfully processed %s misc content", scanRequestData.URL))
 		continue
 	}
 }
 
-//contentTypeWorker listens to the job chan, detects the content type and routes the messages to imageIngestChan, videoIngestChan or miscIngestChan
+//contentTypeWorker listens to the job chan, detects the content type and routes the messages to imageQueue, videoIngestChan or miscIngestChan
 func (w Worker) contentTypeWorker(wg *sync.WaitGroup) {
 	defer wg.Done()
+	objProducer, err := w.newPublisher()
+	if err != nil {
+		logger.Error(w.ctx, "Unable to create a producer", zap.Error(err))
+		w.cancelFunc()
+		return
+	}
+	defer objProducer.Close()
 	logger.Info(w.ctx, "Content type worker started*")
 	for msg := range w.jobsChan {
-		scanRequestData := types.ScanRequest{}
-		err := json.Unmarshal(msg.Body, &scanRequestData)
-		if err != nil {
-			logger.Error(w.ctx, "failed to unmarshall json string into scanRequestData struct", zap.Error(err))
-			w.rejectMessageWithoutRequeue(msg)
-			continue
+		w.detectContentType(objProducer, msg)
+	}
+}
+
+// detectContentType verifies a consumed scan and routes it to the worker of its content type.
+func (w Worker) detectContentType(producer Publisher, msg amqp.Delivery) {
+	ctx, span := startSpan(w.ctx, "consume", msg)
+	defer span.End()
+	scanRequestData := types.ScanRequest{}
+	err := json.Unmarshal(msg.Body, &scanRequestData)
+	if err != nil {
+		logger.Error(ctx, "failed to unmarshall json string into scanRequestData struct", zap.Error(err))
+		w.applyAction(ctx, producer, msg, nil, decide(w.policy, OutcomeInvalidRequest, 0, 0, w.retryLimit()), fmt.Sprintf("%s: %s", OutcomeInvalidRequest, err))
+		return
+	}
+	if w.keyring != nil {
+		keyID, _ := msg.Headers[signing.KeyIDHeader].(string)
+		signature, _ := msg.Headers[signing.SignatureHeader].(string)
+		if err := w.keyring.Verify(scanRequestData.Product, msg.Body, keyID, signature); err != nil {
+			w.applyAction(ctx, producer, msg, nil, ActionPark, err.Error())
+			return
 		}
-		contentType := getContentType(w.ctx, scanRequestData.URL)
-		logger.Debug(w.ctx, fmt.Sprintf("Scan URL: %s, Content type: %s", scanRequestData.URL, contentType))
-		if contentType == IMAGE_CONTENT {
-			logger.Debug(w.ctx, "Image content detected")
-			w.imageIngestChan <- msg
-		} else if contentType == VIDEO_CONTENT {
-			logger.Debug(w.ctx, "Video content detected")
-			w.videoIngestChan <- msg
-		} else if contentType == MISC_CONTENT {
-			logger.Debug(w.ctx, "Misc content detected")
-			w.miscIngestChan <- msg
+	}
+	_, detectSpan := tracing.Default().Start(ctx, "detect", tracing.KindInternal)
+	contentType := getContentType(ctx, scanRequestData.URL)
+	detectSpan.SetAttribute("content_type", string(contentType))
+	detectSpan.End()
+	logger.Debug(ctx, fmt.Sprintf("Scan URL: %s, Content type: %s", scanRequestData.URL, contentType))
+	if contentType == IMAGE_CONTENT {
+		logger.Debug(ctx, "Image content detected")
+		if !w.imageQueue.Push(scanRequestData.Product, msg) {
+			// The image queue only refuses work during shutdown, let the broker redeliver it.
+			w.requeueMessage(msg)
 		}
+	} else if contentType == VIDEO_CONTENT {
+		logger.Debug(ctx, "Video content detected")
+		w.videoIngestChan <- msg
+	} else if contentType == MISC_CONTENT {
+		logger.Debug(ctx, "Misc content detected")
+		w.miscIngestChan <- msg
 	}
-}
+}
\ No newline at end of file
@@ -3,6 +3,9 @@ package rabbitmq
 import (
 	"context"
 	"testing"
+	"time"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/adaptive"
 )
 
 type ContentTypeTestCases struct {
@@ -33,3 +36,51 @@ func TestGetContentType(t *testing.T) {
 		}
 	}
 }
+
+func TestSetWorkers(t *testing.T) {
+	c := NewConsumer("dev", "", 2, 3)
+	started := 0
+	c.startImageWorkers(func() { started++ })
+	if started != 2 {
+		t.Errorf("Expected 2 image workers started. Obtained %d", started)
+	}
+	c.SetWorkers(4, 1, 6)
+	if started != 6 || c.concurrency.Limit() != 4 {
+		t.Errorf("Expected 6 image workers started with 4 active. Obtained %d with %d", started, c.concurrency.Limit())
+	}
+	c.SetWorkers(2, 1, 3)
+	if started != 6 || c.concurrency.Limit() != 2 {
+		t.Errorf("Expected the started image workers kept with 2 active. Obtained %d with %d", started, c.concurrency.Limit())
+	}
+	c.startImageWorkers(nil)
+	c.SetWorkers(8, 8, 8)
+	if started != 6 {
+		t.Errorf("Expected no image worker started once stopping. Obtained %d", started)
+	}
+
+	w := c.newWorker(context.Background(), func() {})
+	c.SetMaxRetryCount(5)
+	if w.retryLimit() != 5 {
+		t.Errorf("Expected the workers to see max retry count 5. Obtained %d", w.retryLimit())
+	}
+}
+
+func TestIdleImageWorkersKeepLimit(t *testing.T) {
+	ctrl := adaptive.New(2, 1, 4, time.Second, 0.5)
+	c := NewConsumer("dev", "", 2, 3, WithConcurrency(ctrl, 10*time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	worker := c.newWorker(ctx, cancel)
+	b, _, _, _ := newTestBatch(t, "")
+	worker.newPublisher = func() (Publisher, error) { return b, nil }
+	stop := c.startWorkers(ctx, worker)
+	defer stop()
+
+	// A fast hasher call with every image worker waiting for scans.
+	time.Sleep(20 * time.Millisecond)
+	ctrl.Observe(time.Millisecond, false)
+	time.Sleep(50 * time.Millisecond)
+	if ctrl.Limit() != 2 {
+		t.Errorf("Expected the limit to stay at 2 while the image queue is idle. Obtained %d", ctrl.Limit())
+	}
+}
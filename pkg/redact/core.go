@@ -0,0 +1,84 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Core wraps c so that every entry is redacted before it is written. It is
+// meant to be installed with zap.WrapCore.
+func (r *Redactor) Core(c zapcore.Core) zapcore.Core {
+	return &core{Core: c, r: r}
+}
+
+type core struct {
+	zapcore.Core
+	r *Redactor
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{Core: c.Core.With(c.r.fields(fields)), r: c.r}
+}
+
+func (c *core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *core) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.r.String(ent.Message)
+	return c.Core.Write(ent, c.r.fields(fields))
+}
+
+// fields redacts fields by key, and any other field whose value renders as text.
+func (r *Redactor) fields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, 0, len(fields))
+	for _, f := range fields {
+		value, ok := text(f)
+		if !ok {
+			redacted = append(redacted, f)
+			continue
+		}
+		if mode, ok := r.rules[strings.ToLower(f.Key)]; ok {
+			if mode == ModeDrop {
+				continue
+			}
+			// Structured values are redacted by their inner keys below.
+			if f.Type != zapcore.ReflectType {
+				value = r.apply(mode, value)
+			}
+		}
+		redacted = append(redacted, zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: r.String(value)})
+	}
+	return redacted
+}
+
+// text renders the value of fields that may carry sensitive text.
+func text(f zapcore.Field) (string, bool) {
+	switch f.Type {
+	case zapcore.StringType:
+		return f.String, true
+	case zapcore.ByteStringType:
+		return string(f.Interface.([]byte)), true
+	case zapcore.ErrorType:
+		if err, ok := f.Interface.(error); ok && err != nil {
+			return err.Error(), true
+		}
+	case zapcore.StringerType:
+		if s, ok := f.Interface.(fmt.Stringer); ok && s != nil {
+			return s.String(), true
+		}
+	case zapcore.ReflectType:
+		b, err := json.Marshal(f.Interface)
+		if err != nil {
+			return "", true
+		}
+		return string(b), true
+	}
+	return "", false
+}
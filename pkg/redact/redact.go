@@ -0,0 +1,203 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/gdcorp-infosec/hashserve/pkg/tracing"
+	"github.com/gdcorp-infosec/hashserve/pkg/types"
+)
+
+// Mode is how the value of a sensitive field is redacted.
+type Mode string
+
+const (
+	// ModeKeep emits the value unchanged.
+	ModeKeep Mode = "keep"
+	// ModeMask replaces all but the last four characters with asterisks.
+	ModeMask Mode = "mask"
+	// ModeHash replaces the value with a keyed hash, so equal values can
+	// still be correlated across log lines.
+	ModeHash Mode = "hash"
+	// ModeDrop removes the value.
+	ModeDrop Mode = "drop"
+	// ModeURL strips credentials, the query string and the fragment of a URL.
+	ModeURL Mode = "url"
+)
+
+// Placeholders emitted instead of removed values.
+const (
+	Dropped     = "[REDACTED]"
+	DroppedCert = "[REDACTED CERTIFICATE]"
+	InvalidURL  = "[REDACTED URL]"
+)
+
+var (
+	pemPattern  = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]+-----[\s\S]*?-----END [A-Z0-9 ]+-----`)
+	jsonPattern = regexp.MustCompile(`"(\w+)"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+	urlPattern  = regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.\-]*://[^\s"'<>]+`)
+)
+
+// Rules maps lower case field names to their redaction mode. Field names are
+// matched against log field keys and JSON object keys within log messages.
+type Rules map[string]Mode
+
+// DefaultRules hashes account identifiers, masks domains, strips URLs and
+// drops client certificates.
+func DefaultRules() Rules {
+	return Rules{
+		"shopperid":   ModeHash,
+		"containerid": ModeHash,
+		"guid":        ModeHash,
+		"xid":         ModeHash,
+		"domain":      ModeMask,
+		"cert":        ModeDrop,
+		"url":         ModeURL,
+		"uri":         ModeURL,
+		"path":        ModeURL,
+	}
+}
+
+// ParseRules overrides the default rules with comma separated field=mode
+// pairs, e.g. "domain=keep,shopperID=drop".
+func ParseRules(s string) (Rules, error) {
+	rules := DefaultRules()
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid redaction rule %q", pair)
+		}
+		mode := Mode(strings.TrimSpace(kv[1]))
+		switch mode {
+		case ModeKeep, ModeMask, ModeHash, ModeDrop, ModeURL:
+		default:
+			return nil, errors.Errorf("invalid redaction mode %q", mode)
+		}
+		rules[strings.ToLower(strings.TrimSpace(kv[0]))] = mode
+	}
+	return rules, nil
+}
+
+// Redactor removes sensitive data from log output and trace labels. It is
+// safe for concurrent use.
+type Redactor struct {
+	rules Rules
+	key   []byte
+}
+
+// New creates a Redactor. key is the HMAC key of ModeHash. Without a key,
+// hashes of identifiers of a small value space could be recovered by brute
+// force, so fields with ModeHash are masked instead.
+func New(rules Rules, key []byte) *Redactor {
+	if len(key) == 0 {
+		masked := make(Rules, len(rules))
+		for name, mode := range rules {
+			if mode == ModeHash {
+				mode = ModeMask
+			}
+			masked[name] = mode
+		}
+		rules = masked
+	}
+	return &Redactor{rules: rules, key: key}
+}
+
+// Field redacts value according to the rule for name. ok is false if the
+// field has no rule.
+func (r *Redactor) Field(name, value string) (redacted string, ok bool) {
+	mode, ok := r.rules[strings.ToLower(name)]
+	if !ok {
+		return value, false
+	}
+	return r.apply(mode, value), true
+}
+
+func (r *Redactor) apply(mode Mode, value string) string {
+	if value == "" {
+		return value
+	}
+	switch mode {
+	case ModeKeep:
+		return value
+	case ModeMask:
+		if len(value) <= 4 {
+			return strings.Repeat("*", len(value))
+		}
+		return strings.Repeat("*", len(value)-4) + value[len(value)-4:]
+	case ModeHash:
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(value))
+		return "h:" + hex.EncodeToString(mac.Sum(nil))[:16]
+	case ModeURL:
+		return URL(value)
+	}
+	return Dropped
+}
+
+// String redacts free text such as log messages: certificates, string values
+// of JSON keys with a rule and the credentials and query strings of URLs.
+func (r *Redactor) String(s string) string {
+	s = pemPattern.ReplaceAllString(s, DroppedCert)
+	s = jsonPattern.ReplaceAllStringFunc(s, func(pair string) string {
+		m := jsonPattern.FindStringSubmatch(pair)
+		mode, ok := r.rules[strings.ToLower(m[1])]
+		if !ok {
+			return pair
+		}
+		var value string
+		if err := json.Unmarshal([]byte(`"`+m[2]+`"`), &value); err != nil {
+			value = m[2]
+		}
+		redacted, _ := json.Marshal(r.apply(mode, value))
+		return fmt.Sprintf("%q:%s", m[1], redacted)
+	})
+	return urlPattern.ReplaceAllStringFunc(s, URL)
+}
+
+// URL strips the credentials, query string and fragment of raw.
+func URL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return InvalidURL
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+// Labels returns the redacted product, URL and shopper of scan, used to
+// correlate traces with logs.
+func (r *Redactor) Labels(scan *types.ScanRequest) map[string]string {
+	labels := map[string]string{"product": scan.Product}
+	for name, value := range map[string]string{
+		"url":       scan.URL,
+		"shopperID": scan.Identifiers.ShopperId,
+	} {
+		redacted, ok := r.Field(name, value)
+		if ok && redacted != "" && redacted != Dropped {
+			labels[name] = redacted
+		}
+	}
+	return labels
+}
+
+// SetSpanAttributes sets the redacted Labels of scan as attributes of span.
+func (r *Redactor) SetSpanAttributes(span tracing.Span, scan *types.ScanRequest) {
+	for name, value := range r.Labels(scan) {
+		span.SetAttribute(name, value)
+	}
+}
@@ -0,0 +1,268 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AMQP headers carrying the signature of a message body.
+const (
+	SignatureHeader = "x-signature"
+	KeyIDHeader     = "x-signature-key-id"
+)
+
+// Supported signature algorithms.
+const (
+	HMACSHA256 = "hmac-sha256"
+	Ed25519    = "ed25519"
+)
+
+// AnyProduct is the product of keys trusted for every product, e.g. the keys
+// hashserve signs its own retried scans with.
+const AnyProduct = "*"
+
+// Reasons reported when a message is rejected.
+const (
+	ReasonUnsigned   = "unsigned"
+	ReasonUnknownKey = "unknown_key"
+	ReasonExpiredKey = "expired_key"
+	ReasonProduct    = "product"
+	ReasonSignature  = "signature"
+)
+
+var rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "hashserve_signature_rejected_total",
+	Help: "Number of scans rejected because of a missing or invalid signature.",
+}, []string{"reason", "product"})
+
+// Key is a signing or verification key. Binary fields are base64 encoded in JSON.
+type Key struct {
+	ID        string `json:"id"`
+	Product   string `json:"product"`
+	Algorithm string `json:"algorithm"`
+
+	// Shared secret of HMACSHA256 keys.
+	Secret []byte `json:"secret,omitempty"`
+
+	// Ed25519 public key, used to verify.
+	PublicKey []byte `json:"publicKey,omitempty"`
+
+	// Ed25519 private key or seed, only needed by the signing key.
+	PrivateKey []byte `json:"privateKey,omitempty"`
+
+	// Signatures made with the key are rejected after NotAfter, if set.
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+}
+
+// Config is the on-disk representation of a Keyring.
+type Config struct {
+	// Reject unsigned messages, defaults to true. Disabling it only rejects
+	// messages with an invalid signature, which eases rolling out signing.
+	RequireSignatures *bool `json:"requireSignatures,omitempty"`
+
+	// Keys trusted to verify messages. Several keys of the same product are
+	// valid at the same time so that products can rotate keys.
+	Keys []Key `json:"keys"`
+
+	// Key messages published by hashserve are signed with. It is trusted for
+	// every product so that retried scans still verify, and therefore required
+	// while RequireSignatures is enabled. When rotating it, keep the previous
+	// signing key in Keys with product AnyProduct until retried scans drained.
+	Signing *Key `json:"signing,omitempty"`
+}
+
+// Rejection is returned by Verify when a message must not be processed.
+type Rejection struct {
+	Reason string
+	Detail string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("signature %s: %s", r.Reason, r.Detail)
+}
+
+// Keyring verifies and creates message signatures. It is safe for concurrent use.
+type Keyring struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.RWMutex
+	keys    map[string]Key
+	signing *Key
+	require bool
+}
+
+// Load reads the keyring file at path.
+func Load(path string) (*Keyring, error) {
+	k := &Keyring{path: path, now: time.Now}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// New creates a Keyring from cfg that is not backed by a file.
+func New(cfg Config) (*Keyring, error) {
+	k := &Keyring{now: time.Now}
+	if err := k.Set(cfg); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the keyring file. The current keys are kept if the file
+// cannot be read or parsed.
+func (k *Keyring) Reload() error {
+	if k.path == "" {
+		return errors.New("keyring is not backed by a file")
+	}
+	b, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return errors.Wrapf(err, "unable to parse keyring %s", k.path)
+	}
+	return k.Set(cfg)
+}
+
+// Set validates cfg and atomically replaces the current keys with it.
+func (k *Keyring) Set(cfg Config) error {
+	keys := map[string]Key{}
+	add := func(key Key) error {
+		if key.ID == "" || key.Product == "" {
+			return errors.Errorf("key %q must have an ID and a product", key.ID)
+		}
+		if _, ok := keys[key.ID]; ok {
+			return errors.Errorf("duplicate key %q", key.ID)
+		}
+		switch {
+		case key.Algorithm == HMACSHA256 && len(key.Secret) >= 16:
+		case key.Algorithm == Ed25519 && len(key.PublicKey) == ed25519.PublicKeySize:
+		default:
+			return errors.Errorf("key %q has an unsupported algorithm or invalid key material", key.ID)
+		}
+		keys[key.ID] = key
+		return nil
+	}
+	for _, key := range cfg.Keys {
+		if err := add(key); err != nil {
+			return err
+		}
+	}
+
+	var signing *Key
+	if cfg.Signing != nil {
+		s := *cfg.Signing
+		s.Product = AnyProduct
+		if s.Algorithm == Ed25519 {
+			switch len(s.PrivateKey) {
+			case ed25519.SeedSize:
+				s.PrivateKey = ed25519.NewKeyFromSeed(s.PrivateKey)
+			case ed25519.PrivateKeySize:
+			default:
+				return errors.Errorf("signing key %q has an invalid private key", s.ID)
+			}
+			s.PublicKey = ed25519.PrivateKey(s.PrivateKey).Public().(ed25519.PublicKey)
+		}
+		if err := add(s); err != nil {
+			return err
+		}
+		signing = &s
+	}
+
+	require := cfg.RequireSignatures == nil || *cfg.RequireSignatures
+	if require && signing == nil {
+		return errors.New("a signing key is required to re-publish retried scans while signatures are required")
+	}
+	k.mu.Lock()
+	k.keys, k.signing, k.require = keys, signing, require
+	k.mu.Unlock()
+	return nil
+}
+
+// Verify checks the base64 encoded signature of body made with keyID, a key
+// of product or of AnyProduct. Failures are returned as *Rejection.
+func (k *Keyring) Verify(product string, body []byte, keyID, signature string) error {
+	err := k.verify(product, body, keyID, signature)
+	if err != nil {
+		rejected.WithLabelValues(err.Reason, product).Inc()
+		return err
+	}
+	return nil
+}
+
+func (k *Keyring) verify(product string, body []byte, keyID, signature string) *Rejection {
+	k.mu.RLock()
+	key, ok := k.keys[keyID]
+	require := k.require
+	k.mu.RUnlock()
+
+	if keyID == "" && signature == "" {
+		if !require {
+			return nil
+		}
+		return &Rejection{ReasonUnsigned, "message is not signed"}
+	}
+	if !ok {
+		return &Rejection{ReasonUnknownKey, fmt.Sprintf("unknown key %q", keyID)}
+	}
+	if key.NotAfter != nil && k.now().After(*key.NotAfter) {
+		return &Rejection{ReasonExpiredKey, fmt.Sprintf("key %q expired at %s", keyID, key.NotAfter.Format(time.RFC3339))}
+	}
+	if key.Product != AnyProduct && key.Product != product {
+		return &Rejection{ReasonProduct, fmt.Sprintf("key %q may not sign scans of product %q", keyID, product)}
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return &Rejection{ReasonSignature, "signature is not base64 encoded"}
+	}
+	valid := false
+	switch key.Algorithm {
+	case HMACSHA256:
+		valid = hmac.Equal(sig, hmacSHA256(key.Secret, body))
+	case Ed25519:
+		valid = ed25519.Verify(key.PublicKey, body, sig)
+	}
+	if !valid {
+		return &Rejection{ReasonSignature, fmt.Sprintf("invalid signature for key %q", keyID)}
+	}
+	return nil
+}
+
+// Sign returns the ID of the signing key and the base64 encoded signature of
+// body. ok is false if the keyring has no signing key.
+func (k *Keyring) Sign(body []byte) (keyID, signature string, ok bool) {
+	k.mu.RLock()
+	key := k.signing
+	k.mu.RUnlock()
+	if key == nil {
+		return "", "", false
+	}
+	var sig []byte
+	switch key.Algorithm {
+	case HMACSHA256:
+		sig = hmacSHA256(key.Secret, body)
+	case Ed25519:
+		sig = ed25519.Sign(key.PrivateKey, body)
+	}
+	return key.ID, base64.StdEncoding.EncodeToString(sig), true
+}
+
+func hmacSHA256(secret, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,106 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Hour)
+	websites := Config{
+		Keys: []Key{
+			{ID: "websites-old", Product: "websites", Algorithm: HMACSHA256, Secret: []byte("0123456789abcdef"), NotAfter: &expired},
+			{ID: "websites-new", Product: "websites", Algorithm: HMACSHA256, Secret: []byte("fedcba9876543210")},
+			{ID: "hosting", Product: "hosting", Algorithm: Ed25519, PublicKey: pub},
+		},
+		Signing: &Key{ID: "hashserve", Algorithm: Ed25519, PrivateKey: priv.Seed()},
+	}
+	k, err := New(websites)
+	if err != nil {
+		t.Fatalf("Unable to create keyring: %s", err)
+	}
+	body := []byte(`{"url":"https://img.example.com/a.jpg","product":"websites"}`)
+	// sign signs body with the key id of cfg as a product would.
+	sign := func(cfg Config, id string) string {
+		for _, key := range cfg.Keys {
+			if key.ID != id {
+				continue
+			}
+			if key.Algorithm == Ed25519 {
+				key.PrivateKey = priv
+			}
+			s, err := New(Config{Signing: &key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, sig, _ := s.Sign(body)
+			return sig
+		}
+		t.Fatalf("Unknown key %s", id)
+		return ""
+	}
+	_, internal, ok := k.Sign(body)
+	if !ok {
+		t.Fatal("Expected keyring to sign")
+	}
+
+	tests := []struct {
+		name      string
+		product   string
+		keyID     string
+		signature string
+		reason    string
+	}{
+		{"current key", "websites", "websites-new", sign(websites, "websites-new"), ""},
+		{"ed25519 key", "hosting", "hosting", sign(websites, "hosting"), ""},
+		{"hashserve key", "hosting", "hashserve", internal, ""},
+		{"unsigned", "websites", "", "", ReasonUnsigned},
+		{"unknown key", "websites", "other", internal, ReasonUnknownKey},
+		{"rotated out key", "websites", "websites-old", sign(websites, "websites-old"), ReasonExpiredKey},
+		{"impersonation", "hosting", "websites-new", sign(websites, "websites-new"), ReasonProduct},
+		{"tampered", "websites", "websites-new", sign(websites, "websites-old"), ReasonSignature},
+		{"not base64", "websites", "websites-new", "%%%", ReasonSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := k.Verify(tt.product, body, tt.keyID, tt.signature)
+			var r *Rejection
+			switch {
+			case tt.reason == "" && err != nil:
+				t.Errorf("Expected signature to verify. Obtained %s", err)
+			case tt.reason != "" && !errors.As(err, &r):
+				t.Errorf("Expected rejection. Obtained %v", err)
+			case tt.reason != "" && r.Reason != tt.reason:
+				t.Errorf("Expected reason %s. Obtained %s", tt.reason, r.Reason)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	optional := false
+	if _, err := New(Config{RequireSignatures: &optional}); err != nil {
+		t.Errorf("Expected optional signatures without signing key. Obtained %s", err)
+	}
+	k, _ := New(Config{RequireSignatures: &optional})
+	if err := k.Verify("websites", []byte("{}"), "", ""); err != nil {
+		t.Errorf("Expected unsigned message to be accepted. Obtained %s", err)
+	}
+	for name, cfg := range map[string]Config{
+		"no signing key": {},
+		"short secret":   {RequireSignatures: &optional, Keys: []Key{{ID: "a", Product: "p", Algorithm: HMACSHA256, Secret: []byte("short")}}},
+		"duplicate":      {RequireSignatures: &optional, Keys: []Key{{ID: "a", Product: "p", Algorithm: HMACSHA256, Secret: []byte("0123456789abcdef")}, {ID: "a", Product: "p", Algorithm: HMACSHA256, Secret: []byte("0123456789abcdef")}}},
+		"algorithm":      {RequireSignatures: &optional, Keys: []Key{{ID: "a", Product: "p", Algorithm: "rsa"}}},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected error creating keyring with %s", name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package tracing
+
+import (
+	"context"
+
+	"go.elastic.co/apm/module/apmhttp/v2"
+	"go.elastic.co/apm/v2"
+)
+
+// Elastic is a Tracer reporting to Elastic APM. Spans started without a
+// parent span are reported as transactions.
+type Elastic struct {
+	tracer *apm.Tracer
+}
+
+// NewElastic creates a Tracer using the default Elastic APM tracer, configured
+// through the ELASTIC_APM_* environment variables.
+func NewElastic() *Elastic {
+	return &Elastic{}
+}
+
+// NewElasticTracer creates a Tracer using t.
+func NewElasticTracer(t *apm.Tracer) *Elastic {
+	return &Elastic{tracer: t}
+}
+
+type elasticRemoteKey struct{}
+
+func (e *Elastic) apmTracer() *apm.Tracer {
+	if e.tracer != nil {
+		return e.tracer
+	}
+	return apm.DefaultTracer()
+}
+
+func (e *Elastic) Start(ctx context.Context, name string, kind Kind) (context.Context, Span) {
+	if apm.TransactionFromContext(ctx) == nil {
+		var opts apm.TransactionOptions
+		if tc, ok := ctx.Value(elasticRemoteKey{}).(apm.TraceContext); ok {
+			opts.TraceContext = tc
+		}
+		tx := e.apmTracer().StartTransactionOptions(name, "request", opts)
+		return apm.ContextWithTransaction(ctx, tx), &elasticSpan{tx: tx}
+	}
+	span, ctx := apm.StartSpan(ctx, name, string(kind))
+	return ctx, &elasticSpan{span: span}
+}
+
+func (e *Elastic) Inject(ctx context.Context, c Carrier) {
+	var tc apm.TraceContext
+	if span := apm.SpanFromContext(ctx); span != nil {
+		tc = span.TraceContext()
+	} else if tx := apm.TransactionFromContext(ctx); tx != nil {
+		tc = tx.TraceContext()
+	} else {
+		return
+	}
+	traceparent := apmhttp.FormatTraceparentHeader(tc)
+	c.Set(TraceparentHeader, traceparent)
+	c.Set(ElasticTraceparentHeader, traceparent)
+	if state := tc.State.String(); state != "" {
+		c.Set(TracestateHeader, state)
+	}
+}
+
+// Extract reads the W3C header, falling back to the Elastic one.
+func (e *Elastic) Extract(ctx context.Context, c Carrier) context.Context {
+	for _, name := range []string{TraceparentHeader, ElasticTraceparentHeader} {
+		tc, err := apmhttp.ParseTraceparentHeader(c.Get(name))
+		if err != nil {
+			continue
+		}
+		if state := c.Get(TracestateHeader); state != "" {
+			if ts, err := apmhttp.ParseTracestateHeader(state); err == nil {
+				tc.State = ts
+			}
+		}
+		return context.WithValue(ctx, elasticRemoteKey{}, tc)
+	}
+	return ctx
+}
+
+func (e *Elastic) Shutdown(ctx context.Context) error {
+	e.apmTracer().Flush(ctx.Done())
+	return nil
+}
+
+// elasticSpan wraps either a transaction or a span.
+type elasticSpan struct {
+	tx   *apm.Transaction
+	span *apm.Span
+}
+
+func (s *elasticSpan) SetAttribute(key, value string) {
+	if s.tx != nil {
+		s.tx.Context.SetLabel(key, value)
+		return
+	}
+	s.span.Context.SetLabel(key, value)
+}
+
+func (s *elasticSpan) SetOutcome(outcome string) {
+	if s.tx != nil {
+		s.tx.Result = outcome
+		return
+	}
+	s.span.Context.SetLabel("outcome", outcome)
+}
+
+func (s *elasticSpan) End() {
+	if s.tx != nil {
+		s.tx.End()
+		return
+	}
+	s.span.End()
+}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OUTCOME_ATTRIBUTE is the attribute SetOutcome records on OpenTelemetry spans.
+const OUTCOME_ATTRIBUTE = "hashserve.outcome"
+
+// OTel is a Tracer exporting OpenTelemetry spans.
+type OTel struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewOTLP creates a Tracer exporting spans over OTLP/HTTP. The exporter and
+// resource are configured through the standard OTEL_EXPORTER_OTLP_* and
+// OTEL_RESOURCE_ATTRIBUTES environment variables.
+func NewOTLP(ctx context.Context) (*OTel, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String("hashserve")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return NewOTel(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)), nil
+}
+
+// NewOTel creates a Tracer using provider.
+func NewOTel(provider *sdktrace.TracerProvider) *OTel {
+	return &OTel{
+		provider:   provider,
+		tracer:     provider.Tracer("github.com/gdcorp-infosec/hashserve"),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+var otelKinds = map[Kind]trace.SpanKind{
+	KindConsumer: trace.SpanKindConsumer,
+	KindProducer: trace.SpanKindProducer,
+	KindClient:   trace.SpanKindClient,
+	KindInternal: trace.SpanKindInternal,
+}
+
+func (o *OTel) Start(ctx context.Context, name string, kind Kind) (context.Context, Span) {
+	ctx, span := o.tracer.Start(ctx, name, trace.WithSpanKind(otelKinds[kind]))
+	return ctx, otelSpan{span}
+}
+
+func (o *OTel) Inject(ctx context.Context, c Carrier) {
+	o.propagator.Inject(ctx, c)
+	if traceparent := c.Get(TraceparentHeader); traceparent != "" {
+		c.Set(ElasticTraceparentHeader, traceparent)
+	}
+}
+
+// Extract reads the W3C header, falling back to the Elastic one.
+func (o *OTel) Extract(ctx context.Context, c Carrier) context.Context {
+	if c.Get(TraceparentHeader) == "" {
+		c = elasticCarrier{c}
+	}
+	return o.propagator.Extract(ctx, c)
+}
+
+func (o *OTel) Shutdown(ctx context.Context) error {
+	return o.provider.Shutdown(ctx)
+}
+
+// elasticCarrier serves the Elastic traceparent header as the W3C one.
+type elasticCarrier struct {
+	Carrier
+}
+
+func (c elasticCarrier) Get(key string) string {
+	if key == TraceparentHeader {
+		return c.Carrier.Get(ElasticTraceparentHeader)
+	}
+	return c.Carrier.Get(key)
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key, value string) {
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+func (s otelSpan) SetOutcome(outcome string) {
+	s.span.SetAttributes(attribute.String(OUTCOME_ATTRIBUTE, outcome))
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
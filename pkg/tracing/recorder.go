@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RecordedSpan is a finished span kept by a Recorder.
+type RecordedSpan struct {
+	Name       string
+	Kind       Kind
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Attributes map[string]string
+	Outcome    string
+}
+
+// Recorder is a Tracer keeping finished spans in memory, for tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// NewRecorder creates an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+type recorderKey struct{}
+
+// spanContext identifies the current or remote parent span of a context.
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+func (r *Recorder) Start(ctx context.Context, name string, kind Kind) (context.Context, Span) {
+	s := &recordedSpan{
+		recorder: r,
+		RecordedSpan: RecordedSpan{
+			Name:       name,
+			Kind:       kind,
+			SpanID:     randomHex(8),
+			Attributes: map[string]string{},
+		},
+	}
+	if parent, ok := ctx.Value(recorderKey{}).(spanContext); ok {
+		s.TraceID, s.ParentID = parent.traceID, parent.spanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	return context.WithValue(ctx, recorderKey{}, spanContext{s.TraceID, s.SpanID}), s
+}
+
+func (r *Recorder) Inject(ctx context.Context, c Carrier) {
+	if sc, ok := ctx.Value(recorderKey{}).(spanContext); ok {
+		traceparent := fmt.Sprintf("00-%s-%s-01", sc.traceID, sc.spanID)
+		c.Set(TraceparentHeader, traceparent)
+		c.Set(ElasticTraceparentHeader, traceparent)
+	}
+}
+
+// Extract reads the W3C header, falling back to the Elastic one.
+func (r *Recorder) Extract(ctx context.Context, c Carrier) context.Context {
+	for _, name := range []string{TraceparentHeader, ElasticTraceparentHeader} {
+		parts := strings.Split(c.Get(name), "-")
+		if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+			return context.WithValue(ctx, recorderKey{}, spanContext{parts[1], parts[2]})
+		}
+	}
+	return ctx
+}
+
+func (r *Recorder) Shutdown(ctx context.Context) error { return nil }
+
+// Spans returns the finished spans in the order they ended.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+// Span returns the last finished span called name.
+func (r *Recorder) Span(name string) (RecordedSpan, bool) {
+	spans := r.Spans()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name == name {
+			return spans[i], true
+		}
+	}
+	return RecordedSpan{}, false
+}
+
+type recordedSpan struct {
+	RecordedSpan
+	recorder *Recorder
+	mu       sync.Mutex
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *recordedSpan) SetOutcome(outcome string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Outcome = outcome
+}
+
+func (s *recordedSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.recorder.spans = append(s.recorder.spans, s.RecordedSpan)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
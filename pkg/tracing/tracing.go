@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Kind is the role of a span in a trace.
+type Kind string
+
+const (
+	// KindConsumer spans process a consumed message.
+	KindConsumer Kind = "consumer"
+	// KindProducer spans publish a message.
+	KindProducer Kind = "producer"
+	// KindClient spans call another service, e.g. the hasher.
+	KindClient Kind = "client"
+	// KindInternal spans do local work.
+	KindInternal Kind = "internal"
+)
+
+// Trace context headers, the W3C trace context headers and their Elastic APM equivalent.
+const (
+	TraceparentHeader        = "traceparent"
+	TracestateHeader         = "tracestate"
+	ElasticTraceparentHeader = "elastic-apm-traceparent"
+)
+
+// Span is a timed operation of a trace.
+type Span interface {
+	// SetAttribute attaches a key value pair, values must already be redacted.
+	SetAttribute(key, value string)
+
+	// SetOutcome records how the operation ended, e.g. success or deferred.
+	SetOutcome(outcome string)
+
+	// End finishes the span.
+	End()
+}
+
+// Carrier reads and writes trace context headers of a message or request.
+type Carrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// Tracer creates spans and propagates their context. Implementations exist
+// for Elastic APM, OpenTelemetry and an in-memory Recorder for tests.
+type Tracer interface {
+	// Start starts a span that is a child of the current span of ctx, or of
+	// the remote parent extracted into ctx, and returns a context holding it.
+	Start(ctx context.Context, name string, kind Kind) (context.Context, Span)
+
+	// Inject writes the context of the current span of ctx into c.
+	Inject(ctx context.Context, c Carrier)
+
+	// Extract returns a context holding the remote parent read from c, if any.
+	Extract(ctx context.Context, c Carrier) context.Context
+
+	// Shutdown flushes pending spans.
+	Shutdown(ctx context.Context) error
+}
+
+var (
+	mu            sync.RWMutex
+	defaultTracer Tracer = NewElastic()
+)
+
+// Default returns the tracer used by hashserve, Elastic APM unless replaced by SetDefault.
+func Default() Tracer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultTracer
+}
+
+// SetDefault replaces the tracer returned by Default.
+func SetDefault(t Tracer) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultTracer = t
+}
+
+// HeaderCarrier adapts HTTP headers to a Carrier.
+type HeaderCarrier http.Header
+
+func (h HeaderCarrier) Get(key string) string { return http.Header(h).Get(key) }
+
+func (h HeaderCarrier) Set(key, value string) { http.Header(h).Set(key, value) }
+
+func (h HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Nop is a Tracer that records nothing.
+type Nop struct{}
+
+func (Nop) Start(ctx context.Context, name string, kind Kind) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (Nop) Inject(ctx context.Context, c Carrier) {}
+
+func (Nop) Extract(ctx context.Context, c Carrier) context.Context { return ctx }
+
+func (Nop) Shutdown(ctx context.Context) error { return nil }
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key, value string) {}
+
+func (nopSpan) SetOutcome(outcome string) {}
+
+func (nopSpan) End() {}
@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.elastic.co/apm/v2"
+	"go.elastic.co/apm/v2/transport"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	remoteTrace  = "0102030405060708090a0b0c0d0e0f10"
+	remoteParent = "0102030405060708"
+	traceparent  = "00-" + remoteTrace + "-" + remoteParent + "-01"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	ctx := r.Extract(context.Background(), HeaderCarrier(http.Header{"Traceparent": {traceparent}}))
+	ctx, root := r.Start(ctx, "consume", KindConsumer)
+	_, child := r.Start(ctx, "detect", KindInternal)
+	child.SetAttribute("content_type", "image")
+	child.End()
+	root.SetOutcome("success")
+	root.End()
+
+	spans := r.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans. Obtained %+v", spans)
+	}
+	if spans[1].TraceID != remoteTrace || spans[1].ParentID != remoteParent || spans[1].Outcome != "success" {
+		t.Errorf("Expected the root span to continue the remote trace. Obtained %+v", spans[1])
+	}
+	if spans[0].TraceID != remoteTrace || spans[0].ParentID != spans[1].SpanID || spans[0].Attributes["content_type"] != "image" {
+		t.Errorf("Expected a child of the root span. Obtained %+v", spans[0])
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	apmTracer, err := apm.NewTracerOptions(apm.TracerOptions{Transport: transport.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer apmTracer.Close()
+	tracers := map[string]Tracer{
+		"elastic":  NewElasticTracer(apmTracer),
+		"otel":     NewOTel(sdktrace.NewTracerProvider()),
+		"recorder": NewRecorder(),
+	}
+	for name, tracer := range tracers {
+		for _, header := range []string{TraceparentHeader, ElasticTraceparentHeader} {
+			in := http.Header{}
+			in.Set(header, traceparent)
+			ctx := tracer.Extract(context.Background(), HeaderCarrier(in))
+			ctx, span := tracer.Start(ctx, "publish", KindProducer)
+			out := http.Header{}
+			tracer.Inject(ctx, HeaderCarrier(out))
+			span.End()
+
+			for _, h := range []string{TraceparentHeader, ElasticTraceparentHeader} {
+				parts := strings.Split(out.Get(h), "-")
+				if len(parts) != 4 || parts[1] != remoteTrace || parts[2] == remoteParent {
+					t.Errorf("%s from %s: expected %s to continue trace %s in a new span. Obtained %q", name, header, h, remoteTrace, out.Get(h))
+				}
+			}
+		}
+	}
+}
+
+func TestNop(t *testing.T) {
+	ctx := context.Background()
+	out := http.Header{}
+	spanCtx, span := Nop{}.Start(ctx, "consume", KindConsumer)
+	span.SetOutcome("success")
+	span.End()
+	Nop{}.Inject(spanCtx, HeaderCarrier(out))
+	if len(out) != 0 {
+		t.Errorf("Expected no headers to be injected. Obtained %v", out)
+	}
+}
@@ -0,0 +1,212 @@
+package types
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// IdentifierFields are the JSON names of the AccountIdentifiers fields that
+// can be encrypted.
+var IdentifierFields = []string{"shopperID", "containerID", "domain", "GUID", "XID"}
+
+// IdentifierEnvelope describes how the identifier fields listed in Fields were
+// encrypted. Each field is encrypted with AES-GCM under a random data key,
+// which is itself encrypted with the key encryption key KeyID.
+type IdentifierEnvelope struct {
+	KeyID      string   `json:"keyID"`
+	WrappedKey []byte   `json:"wrappedKey"`
+	Fields     []string `json:"fields"`
+}
+
+// IdentifierKeyring holds the key encryption keys of identifier envelopes.
+// Keys other than the current one are only used to decrypt, so that messages
+// in flight during a rotation can still be read.
+type IdentifierKeyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// identifierKeyringFile is the on-disk representation of an IdentifierKeyring.
+type identifierKeyringFile struct {
+	Current string `json:"current"`
+	Keys    []struct {
+		ID  string `json:"id"`
+		Key []byte `json:"key"`
+	} `json:"keys"`
+}
+
+// LoadIdentifierKeyring reads a JSON keyring file of base64 encoded AES keys, e.g.
+// {"current": "2022-06", "keys": [{"id": "2022-06", "key": "..."}]}
+// The keyring is used to encrypt, so current must be set.
+func LoadIdentifierKeyring(path string) (*IdentifierKeyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f identifierKeyringFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("unable to parse identifier keyring %s: %w", path, err)
+	}
+	if f.Current == "" {
+		return nil, fmt.Errorf("identifier keyring %s has no current key", path)
+	}
+	keys := map[string][]byte{}
+	for _, k := range f.Keys {
+		keys[k.ID] = k.Key
+	}
+	return NewIdentifierKeyring(f.Current, keys)
+}
+
+// NewIdentifierKeyring creates a keyring encrypting with the key current.
+// Keys must be 16, 24 or 32 bytes long. current may be empty for a keyring
+// that only decrypts.
+func NewIdentifierKeyring(current string, keys map[string][]byte) (*IdentifierKeyring, error) {
+	k := &IdentifierKeyring{current: current, keys: map[string]cipher.AEAD{}}
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identifier key %q: %w", id, err)
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[current]; current != "" && !ok {
+		return nil, fmt.Errorf("current identifier key %q not found", current)
+	}
+	return k, nil
+}
+
+// Encrypt encrypts the named identifier fields in place and records the
+// envelope needed to decrypt them. Empty fields are left empty.
+func (a *AccountIdentifiers) Encrypt(k *IdentifierKeyring, fields []string) error {
+	if a.Encryption != nil {
+		return errors.New("identifiers are already encrypted")
+	}
+	kek, ok := k.keys[k.current]
+	if !ok {
+		return errors.New("identifier keyring has no current key")
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	dek, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := seal(kek, dataKey, []byte(k.current))
+	if err != nil {
+		return err
+	}
+
+	// Encrypt into a copy so that a failure leaves the identifiers untouched.
+	encrypted := *a
+	envelope := &IdentifierEnvelope{KeyID: k.current, WrappedKey: wrapped}
+	for _, name := range fields {
+		value := encrypted.field(name)
+		if value == nil {
+			return fmt.Errorf("unknown identifier field %q", name)
+		}
+		if *value == "" {
+			continue
+		}
+		ciphertext, err := seal(dek, []byte(*value), []byte(name))
+		if err != nil {
+			return err
+		}
+		*value = base64.StdEncoding.EncodeToString(ciphertext)
+		envelope.Fields = append(envelope.Fields, name)
+	}
+	encrypted.Encryption = envelope
+	*a = encrypted
+	return nil
+}
+
+// Decrypt decrypts identifier fields encrypted by Encrypt in place. It is a
+// no-op for identifiers that are not encrypted.
+func (a *AccountIdentifiers) Decrypt(k *IdentifierKeyring) error {
+	envelope := a.Encryption
+	if envelope == nil {
+		return nil
+	}
+	kek, ok := k.keys[envelope.KeyID]
+	if !ok {
+		return fmt.Errorf("identifier key %q not found", envelope.KeyID)
+	}
+	dataKey, err := open(kek, envelope.WrappedKey, []byte(envelope.KeyID))
+	if err != nil {
+		return fmt.Errorf("unable to unwrap data key: %w", err)
+	}
+	dek, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	// Decrypt into a copy so that a failure leaves the identifiers untouched.
+	decrypted := *a
+	for _, name := range envelope.Fields {
+		value := decrypted.field(name)
+		if value == nil {
+			return fmt.Errorf("unknown identifier field %q", name)
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(*value)
+		if err != nil {
+			return fmt.Errorf("identifier field %q is not base64 encoded", name)
+		}
+		plaintext, err := open(dek, ciphertext, []byte(name))
+		if err != nil {
+			return fmt.Errorf("unable to decrypt identifier field %q: %w", name, err)
+		}
+		*value = string(plaintext)
+	}
+	decrypted.Encryption = nil
+	*a = decrypted
+	return nil
+}
+
+// field returns a pointer to the identifier field with the JSON name, or nil.
+func (a *AccountIdentifiers) field(name string) *string {
+	switch name {
+	case "shopperID":
+		return &a.ShopperId
+	case "containerID":
+		return &a.ContainerId
+	case "domain":
+		return &a.Domain
+	case "GUID":
+		return &a.GUID
+	case "XID":
+		return &a.XID
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext and prepends the random nonce.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,118 @@
+package types
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var identifiers = AccountIdentifiers{
+	ShopperId:   "8675309",
+	ContainerId: "4242",
+	Domain:      "example.com",
+	GUID:        "0f8fad5b-d9cb-469f-a165-70867728950e",
+}
+
+func TestIdentifierEncryptionRoundTrip(t *testing.T) {
+	old, _ := NewIdentifierKeyring("2022-05", map[string][]byte{"2022-05": bytes.Repeat([]byte{1}, 32)})
+	a := identifiers
+	if err := a.Encrypt(old, []string{"shopperID", "domain", "XID"}); err != nil {
+		t.Fatalf("Unable to encrypt: %s", err)
+	}
+	if a.ShopperId == identifiers.ShopperId || a.Domain == identifiers.Domain {
+		t.Fatalf("Expected fields to be encrypted. Obtained %+v", a)
+	}
+	if a.GUID != identifiers.GUID || a.XID != "" {
+		t.Errorf("Expected other and empty fields to be untouched. Obtained %+v", a)
+	}
+
+	// Messages encrypted before a rotation still decrypt after it.
+	rotated, _ := NewIdentifierKeyring("2022-06", map[string][]byte{
+		"2022-05": bytes.Repeat([]byte{1}, 32),
+		"2022-06": bytes.Repeat([]byte{2}, 32),
+	})
+	b, _ := json.Marshal(a)
+	var decoded AccountIdentifiers
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Decrypt(rotated); err != nil {
+		t.Fatalf("Unable to decrypt: %s", err)
+	}
+	if decoded != identifiers {
+		t.Errorf("Expected %+v. Obtained %+v", identifiers, decoded)
+	}
+
+	plain := identifiers
+	if err := plain.Decrypt(rotated); err != nil || plain != identifiers {
+		t.Errorf("Expected decrypting plaintext identifiers to be a no-op. Obtained %+v, %v", plain, err)
+	}
+}
+
+func TestIdentifierDecryptionFailures(t *testing.T) {
+	k, _ := NewIdentifierKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	other, _ := NewIdentifierKeyring("k2", map[string][]byte{"k2": bytes.Repeat([]byte{2}, 32)})
+	encrypt := func() AccountIdentifiers {
+		a := identifiers
+		if err := a.Encrypt(k, []string{"shopperID", "containerID"}); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	tests := map[string]struct {
+		modify  func(a *AccountIdentifiers)
+		keyring *IdentifierKeyring
+	}{
+		"unknown key":    {func(a *AccountIdentifiers) {}, other},
+		"swapped fields": {func(a *AccountIdentifiers) { a.ShopperId, a.ContainerId = a.ContainerId, a.ShopperId }, k},
+		"tampered":       {func(a *AccountIdentifiers) { a.ShopperId = "AAAA" + a.ShopperId[4:] }, k},
+		"wrong key id":   {func(a *AccountIdentifiers) { a.Encryption.KeyID = "k2" }, other},
+	}
+	for name, tt := range tests {
+		a := encrypt()
+		tt.modify(&a)
+		before := a
+		if err := a.Decrypt(tt.keyring); err == nil {
+			t.Errorf("Expected %s to fail decryption", name)
+		}
+		if a != before {
+			t.Errorf("Expected failed decryption of %s to leave identifiers untouched", name)
+		}
+	}
+
+	a := encrypt()
+	if err := a.Encrypt(k, []string{"domain"}); err == nil {
+		t.Error("Expected error encrypting twice")
+	}
+	b := identifiers
+	if err := b.Encrypt(k, []string{"shopperID", "email"}); err == nil || b != identifiers {
+		t.Error("Expected error encrypting an unknown field without touching the identifiers")
+	}
+	if _, err := NewIdentifierKeyring("missing", nil); err == nil {
+		t.Error("Expected error for a missing current key")
+	}
+}
+
+func TestLoadIdentifierKeyring(t *testing.T) {
+	dir := t.TempDir()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	valid := filepath.Join(dir, "valid.json")
+	if err := ioutil.WriteFile(valid, []byte(`{"current": "k1", "keys": [{"id": "k1", "key": "`+key+`"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIdentifierKeyring(valid); err != nil {
+		t.Errorf("Expected the keyring to load. Obtained %v", err)
+	}
+	decryptOnly := filepath.Join(dir, "decrypt-only.json")
+	if err := ioutil.WriteFile(decryptOnly, []byte(`{"keys": [{"id": "k1", "key": "`+key+`"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIdentifierKeyring(decryptOnly); err == nil || !strings.Contains(err.Error(), "no current key") {
+		t.Errorf("Expected an error for a keyring without current key. Obtained %v", err)
+	}
+}
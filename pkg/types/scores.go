@@ -0,0 +1,136 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// LegacyModelName names the model result decoded from the single model
+// {"csam", "pornography", "others"} score object of older hasher versions
+const LegacyModelName = "legacy"
+
+// ModelScores is the result of a single ML model run against an image
+type ModelScores struct {
+	Model     string             `json:"model"`
+	Version   string             `json:"version,omitempty"`
+	Scores    map[string]float64 `json:"scores"`
+	LatencyMs float64            `json:"latencyMs,omitempty"`
+}
+
+// MlScores holds the results of every ML model run against an image.
+// Scores are kept in maps so a legitimate score of 0 is still published.
+type MlScores []ModelScores
+
+// legacyMlScores is the score object returned by older hasher versions
+type legacyMlScores struct {
+	Csam        *float64 `json:"csam"`
+	Pornography *float64 `json:"pornography"`
+	Others      *float64 `json:"others"`
+}
+
+// UnmarshalJSON decodes either a list of model results or the legacy
+// single model score object
+func (s *MlScores) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || bytes.Equal(b, []byte("null")) {
+		*s = nil
+		return nil
+	}
+	if b[0] == '[' {
+		var results []ModelScores
+		if err := json.Unmarshal(b, &results); err != nil {
+			return err
+		}
+		*s = results
+		return nil
+	}
+
+	var legacy legacyMlScores
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return err
+	}
+	scores := map[string]float64{}
+	for label, score := range map[string]*float64{
+		"csam":        legacy.Csam,
+		"pornography": legacy.Pornography,
+		"others":      legacy.Others,
+	} {
+		if score != nil {
+			scores[label] = *score
+		}
+	}
+	if len(scores) == 0 {
+		*s = nil
+		return nil
+	}
+	*s = MlScores{{Model: LegacyModelName, Scores: scores}}
+	return nil
+}
+
+// Validate checks every model result has a name, is reported once and only
+// carries finite scores between 0 and 1
+func (s MlScores) Validate() error {
+	if _, invalid := s.Valid(); len(invalid) > 0 {
+		return invalid[0]
+	}
+	return nil
+}
+
+// Valid returns the model results that pass Validate, and why each of the
+// others was left out. Only the first result of a model is kept.
+func (s MlScores) Valid() (MlScores, []error) {
+	var valid MlScores
+	var invalid []error
+	seen := map[string]bool{}
+	for _, result := range s {
+		key := result.Model + "@" + result.Version
+		err := result.validate()
+		if err == nil && seen[key] {
+			err = fmt.Errorf("duplicate results for model %s", key)
+		}
+		if err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		seen[key] = true
+		valid = append(valid, result)
+	}
+	return valid, invalid
+}
+
+func (r ModelScores) validate() error {
+	if r.Model == "" {
+		return errors.New("missing model name")
+	}
+	for label, score := range r.Scores {
+		if label == "" {
+			return fmt.Errorf("empty label in model %s", r.Model)
+		}
+		if math.IsNaN(score) || score < 0 || score > 1 {
+			return fmt.Errorf("score %v for %s/%s is outside [0, 1]", score, r.Model, label)
+		}
+	}
+	if r.LatencyMs < 0 {
+		return fmt.Errorf("negative latency for model %s", r.Model)
+	}
+	return nil
+}
+
+// Labels returns the scores keyed both by "model/label" and by label alone.
+// When several models report the same label the highest score is used for
+// the label alone key.
+func (s MlScores) Labels() map[string]float64 {
+	labels := map[string]float64{}
+	for _, result := range s {
+		for label, score := range result.Scores {
+			labels[result.Model+"/"+label] = score
+			if current, ok := labels[label]; !ok || score > current {
+				labels[label] = score
+			}
+		}
+	}
+	return labels
+}
@@ -0,0 +1,75 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestImageHashResponseDecodesLegacyScores(t *testing.T) {
+	body := `{"statusCode": 1, "statusMessage": "success", "scores": {"csam": 0.25, "others": 0}}`
+	var resp ImageHashResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.MlScores) != 1 || resp.MlScores[0].Model != LegacyModelName {
+		t.Fatalf("Expected a single legacy model result. Obtained %+v", resp.MlScores)
+	}
+	scores := resp.MlScores[0].Scores
+	if scores["csam"] != 0.25 {
+		t.Errorf("Expected csam score 0.25. Obtained %v", scores["csam"])
+	}
+	if _, ok := scores["others"]; !ok {
+		t.Error("Expected explicit zero score for others to be kept")
+	}
+	if _, ok := scores["pornography"]; ok {
+		t.Error("Expected absent pornography score to stay absent")
+	}
+}
+
+func TestMlScoresRoundTripKeepsZeroValues(t *testing.T) {
+	body := `[{"model": "thorn", "version": "2", "scores": {"csam": 0}, "latencyMs": 12.5}, {"model": "nsfw", "scores": {"pornography": 0.5}}]`
+	var scores MlScores
+	if err := json.Unmarshal([]byte(body), &scores); err != nil {
+		t.Fatal(err)
+	}
+	if err := scores.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(ImageFingerprintRequest{MlScores: scores})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"scores":{"csam":0}`) {
+		t.Errorf("Expected zero csam score in published JSON. Obtained %s", out)
+	}
+	labels := scores.Labels()
+	if labels["thorn/csam"] != 0 || labels["pornography"] != 0.5 {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+}
+
+func TestMlScoresValidate(t *testing.T) {
+	testCases := map[string]MlScores{
+		"missing model":   {{Scores: map[string]float64{"csam": 0.1}}},
+		"out of range":    {{Model: "thorn", Scores: map[string]float64{"csam": 1.1}}},
+		"duplicate model": {{Model: "thorn"}, {Model: "thorn"}},
+	}
+	for name, scores := range testCases {
+		if err := scores.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+}
+
+func TestMlScoresValid(t *testing.T) {
+	scores := MlScores{
+		{Model: "thorn", Scores: map[string]float64{"csam": 0.2}},
+		{Model: "nsfw", Scores: map[string]float64{"pornography": 1.5}},
+		{Model: "thorn", Scores: map[string]float64{"csam": 0.9}},
+	}
+	valid, invalid := scores.Valid()
+	if len(valid) != 1 || valid[0].Scores["csam"] != 0.2 || len(invalid) != 2 {
+		t.Errorf("Expected the first thorn result kept and 2 results left out. Obtained %+v %v", valid, invalid)
+	}
+}
@@ -12,6 +12,9 @@ type AccountIdentifiers struct {
 	Domain      string `json:"domain"`
 	GUID        string `json:"GUID"`
 	XID         string `json:"XID"`
+
+	// Set when fields were encrypted, see Decrypt
+	Encryption *IdentifierEnvelope `json:"encryption,omitempty"`
 }
 
 type Fingerprints struct {
@@ -28,6 +31,14 @@ type ImageFingerprintRequest struct {
 	Source      string             `json:"source"`
 	MlScores    MlScores           `json:"scores"`
 	Identifiers AccountIdentifiers `json:"accountIdentifiers"`
+	Matches     []PhotoDNAMatch    `json:"matches,omitempty"`
+}
+
+// PhotoDNAMatch is a reference image whose PhotoDNA hash is within the
+// near-duplicate threshold of the fingerprinted image
+type PhotoDNAMatch struct {
+	ReferenceID string  `json:"referenceID"`
+	Distance    float64 `json:"distance"`
 }
 
 //VideoFingerPrintRequest structure
@@ -49,6 +60,7 @@ type ScanRequest struct {
 	Cert        string             `json:"cert,omitempty"`
 	RetryCount  int                `json:"retryCount"`
 	PublishTime string             `json:"publishTime,omitempty"`
+	AssetID     string             `json:"assetID,omitempty"`
 }
 
 // HashRequest represents the full request made by hashserve to Hasher microservice
@@ -63,10 +75,11 @@ type Hashes struct {
 	SHA1 string `json:"SHA1,omitempty"`
 }
 
-type MlScores struct {
-	Csam        float64 `json:"csam,omitempty"`
-	Pornography float64 `json:"pornography,omitempty"`
-	Others      float64 `json:"others,omitempty"`
+// EscalationRequest is published in addition to the regular fingerprints when
+// the ML scores of an image exceed the escalation thresholds of its product
+type EscalationRequest struct {
+	Fingerprints []ImageFingerprintRequest `json:"fingerprints"`
+	Reason       string                    `json:"reason"`
 }
 
 // ImageHashResponse represents the full response received from Hasher microservice
@@ -97,6 +110,21 @@ func (hr *HashRequest) ValidateRequiredFields() error {
 	return nil
 }
 
+// ValidateRequiredFields validates a scan request before it is published to hashserve.
+func (sr *ScanRequest) ValidateRequiredFields() error {
+	u, err := url.ParseRequestURI(sr.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid URL")
+	}
+	if sr.Product == "" {
+		return errors.New("missing product")
+	}
+	if sr.RetryCount < 0 {
+		return errors.New("negative retry count")
+	}
+	return nil
+}
+
 // function to validate the fields before publishing the message to the thornworker queue.
 func (tr *ImageFingerprintRequest) ValidateRequiredFields() error {
 	if tr.Path == "" {
@@ -0,0 +1,422 @@
+package urlpolicy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons reported when a URL violates the policy.
+const (
+	ReasonURL      = "url"
+	ReasonScheme   = "scheme"
+	ReasonUserinfo = "userinfo"
+	ReasonPort     = "port"
+	ReasonHost     = "host"
+	ReasonAddress  = "address"
+	ReasonRebind   = "rebind"
+)
+
+var rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "hashserve_url_policy_rejected_total",
+	Help: "Number of scans rejected because their URL violated the URL policy.",
+}, []string{"reason"})
+
+// Ranges that are never fetched unless explicitly allowed, in addition to the
+// loopback, private, link-local, multicast and unspecified ranges known to net.IP.
+var forbiddenNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "This" network
+	"100.64.0.0/10", // Carrier grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // Benchmarking
+	"240.0.0.0/4",   // Reserved
+	"64:ff9b::/96",  // NAT64, may embed any of the above
+)
+
+// Rules is the on-disk representation of the URL policy. Empty fields fall
+// back to the defaults of DefaultRules.
+type Rules struct {
+	// Allowed URL schemes e.g. https
+	Schemes []string `json:"schemes"`
+
+	// Allowed ports. When empty only the default port of each scheme is allowed.
+	Ports []int `json:"ports"`
+
+	// Host names or glob patterns scans may point at, any host when empty.
+	AllowedHosts []string `json:"allowedHosts"`
+
+	// Host names or glob patterns scans may never point at, e.g. localhost.
+	DeniedHosts []string `json:"deniedHosts"`
+
+	// CIDR ranges exempt from the resolved address checks, e.g. an internal CDN.
+	AllowedCIDRs []string `json:"allowedCIDRs"`
+}
+
+// DefaultRules allows http and https on their default ports to any public address.
+func DefaultRules() Rules {
+	return Rules{
+		Schemes:     []string{"http", "https"},
+		DeniedHosts: []string{"localhost", "*.localhost", "*.internal", "*.local"},
+	}
+}
+
+// Violation is returned by Check when a URL violates the policy.
+type Violation struct {
+	Reason string
+	Detail string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("url policy %s: %s", v.Reason, v.Detail)
+}
+
+// Resolver looks up the addresses of a host, it is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Policy decides whether the hasher may fetch a scan URL. It is safe for concurrent use.
+//
+// Check vets the addresses a host resolves to when a scan is picked up and
+// Confirm resolves the host again right before the hasher is called, refusing
+// answers that were not vetted. A host changing its answers (DNS rebinding)
+// is therefore refused unless it changes them within the instant between
+// Confirm and the hasher's own lookup. Redirects are followed by the hasher
+// and must be restricted by its egress policy.
+type Policy struct {
+	resolver Resolver
+
+	mu    sync.RWMutex
+	rules *compiled
+}
+
+// compiled is an immutable, lookup friendly form of Rules.
+type compiled struct {
+	schemes      map[string]struct{}
+	ports        map[int]struct{}
+	allowedHosts []string
+	deniedHosts  []string
+	allowedNets  []*net.IPNet
+}
+
+// Load reads the policy file at path, a JSON encoded Rules object.
+func Load(path string) (*Policy, error) {
+	rules, err := ReadRules(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(rules, net.DefaultResolver)
+}
+
+// ReadRules reads the policy file at path without validating its rules. Fields
+// missing from the file are those of DefaultRules.
+func ReadRules(path string) (Rules, error) {
+	rules := DefaultRules()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return rules, errors.Wrapf(err, "unable to parse URL policy %s", path)
+	}
+	return rules, nil
+}
+
+// New validates rules and creates a Policy resolving hosts with resolver.
+func New(rules Rules, resolver Resolver) (*Policy, error) {
+	p := &Policy{resolver: resolver}
+	if err := p.Set(rules); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Set validates rules and atomically replaces the current rules with them.
+func (p *Policy) Set(rules Rules) error {
+	c, err := compile(rules)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.rules = c
+	p.mu.Unlock()
+	return nil
+}
+
+// Validate reports the first invalid port, host pattern or CIDR of the rules.
+func (r Rules) Validate() error {
+	_, err := compile(r)
+	return err
+}
+
+func (p *Policy) current() *compiled {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules
+}
+
+func compile(rules Rules) (*compiled, error) {
+	defaults := DefaultRules()
+	if len(rules.Schemes) == 0 {
+		rules.Schemes = defaults.Schemes
+	}
+	c := &compiled{
+		schemes: map[string]struct{}{},
+		ports:   map[int]struct{}{},
+	}
+	for _, s := range rules.Schemes {
+		c.schemes[strings.ToLower(s)] = struct{}{}
+	}
+	for _, port := range rules.Ports {
+		if port < 1 || port > 65535 {
+			return nil, errors.Errorf("invalid port %d", port)
+		}
+		c.ports[port] = struct{}{}
+	}
+	var err error
+	if c.allowedHosts, err = compileHosts(rules.AllowedHosts); err != nil {
+		return nil, err
+	}
+	if c.deniedHosts, err = compileHosts(rules.DeniedHosts); err != nil {
+		return nil, err
+	}
+	for _, cidr := range rules.AllowedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Errorf("invalid CIDR %q", cidr)
+		}
+		c.allowedNets = append(c.allowedNets, n)
+	}
+	return c, nil
+}
+
+// Check returns a *Violation if rawURL may not be fetched by the hasher. Other
+// errors mean the host could not be resolved and the check may be retried.
+// The addresses vetted are returned for Confirm, they are empty when the URL
+// host is an address itself.
+func (p *Policy) Check(ctx context.Context, rawURL string) ([]net.IP, error) {
+	vetted, err := p.check(ctx, rawURL)
+	count(err)
+	return vetted, err
+}
+
+// Confirm resolves the host of a URL that passed Check again and returns a
+// *Violation if any answer is not among the vetted addresses or no longer
+// allowed. It is called right before the hasher fetches the URL. Other errors
+// mean the host could not be resolved and the check may be retried.
+func (p *Policy) Confirm(ctx context.Context, rawURL string, vetted []net.IP) error {
+	err := p.confirm(ctx, rawURL, vetted)
+	count(err)
+	return err
+}
+
+func count(err error) {
+	var v *Violation
+	if errors.As(err, &v) {
+		rejected.WithLabelValues(v.Reason).Inc()
+	}
+}
+
+func (p *Policy) check(ctx context.Context, rawURL string) ([]net.IP, error) {
+	rules := p.current()
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() {
+		return nil, &Violation{ReasonURL, "not an absolute URL"}
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if _, ok := rules.schemes[scheme]; !ok {
+		return nil, &Violation{ReasonScheme, fmt.Sprintf("scheme %q is not allowed", scheme)}
+	}
+	if u.Host == "" {
+		return nil, &Violation{ReasonURL, "URL has no host"}
+	}
+	if u.User != nil {
+		return nil, &Violation{ReasonUserinfo, "URL contains credentials"}
+	}
+	if err := rules.checkPort(scheme, u.Port()); err != nil {
+		return nil, err
+	}
+
+	host := hostname(u)
+	if ip := net.ParseIP(host); ip != nil {
+		return nil, rules.checkIP(ip)
+	}
+	if looksNumeric(host) {
+		// Forms like 2130706433 or 0x7f.1 are resolved to addresses by some
+		// HTTP clients but are never legitimate host names.
+		return nil, &Violation{ReasonHost, fmt.Sprintf("host %q is a non canonical address", host)}
+	}
+	if matchAny(rules.deniedHosts, host) {
+		return nil, &Violation{ReasonHost, fmt.Sprintf("host %q is denied", host)}
+	}
+	if len(rules.allowedHosts) > 0 && !matchAny(rules.allowedHosts, host) {
+		return nil, &Violation{ReasonHost, fmt.Sprintf("host %q is not allowed", host)}
+	}
+	return p.resolve(ctx, rules, host)
+}
+
+func (p *Policy) confirm(ctx context.Context, rawURL string, vetted []net.IP) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() {
+		return &Violation{ReasonURL, "not an absolute URL"}
+	}
+	host := hostname(u)
+	if net.ParseIP(host) != nil {
+		// Addresses cannot change, Check already vetted it.
+		return nil
+	}
+	addrs, err := p.resolve(ctx, p.current(), host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range addrs {
+		if !contains(vetted, ip) {
+			return &Violation{ReasonRebind, fmt.Sprintf("host %q now resolves to %s", host, ip)}
+		}
+	}
+	return nil
+}
+
+// resolve looks up host and checks every answer, as the hasher may connect to
+// any of them.
+func (p *Policy) resolve(ctx context.Context, rules *compiled, host string) ([]net.IP, error) {
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to resolve %s", host)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no addresses found for %s", host)
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		if err := rules.checkIP(addr.IP); err != nil {
+			return nil, err
+		}
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func hostname(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+func contains(ips []net.IP, ip net.IP) bool {
+	for _, vetted := range ips {
+		if vetted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compiled) checkPort(scheme, port string) error {
+	if port == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return &Violation{ReasonPort, fmt.Sprintf("invalid port %q", port)}
+	}
+	if len(c.ports) == 0 {
+		if (scheme == "http" && n == 80) || (scheme == "https" && n == 443) {
+			return nil
+		}
+		return &Violation{ReasonPort, fmt.Sprintf("port %d is not allowed", n)}
+	}
+	if _, ok := c.ports[n]; !ok {
+		return &Violation{ReasonPort, fmt.Sprintf("port %d is not allowed", n)}
+	}
+	return nil
+}
+
+func (c *compiled) checkIP(ip net.IP) error {
+	for _, n := range c.allowedNets {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	if !isPublic(ip) {
+		return &Violation{ReasonAddress, fmt.Sprintf("address %s is not public", ip)}
+	}
+	return nil
+}
+
+// isPublic reports whether ip is a globally routable unicast address.
+func isPublic(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range forbiddenNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// looksNumeric reports whether host only consists of dot separated decimal,
+// octal or hexadecimal numbers.
+func looksNumeric(host string) bool {
+	for _, part := range strings.Split(host, ".") {
+		base := 10
+		if strings.HasPrefix(part, "0x") {
+			part, base = part[2:], 16
+		}
+		if part == "" {
+			return false
+		}
+		if _, err := strconv.ParseUint(part, base, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func compileHosts(patterns []string) ([]string, error) {
+	var hosts []string
+	for _, h := range patterns {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if _, err := path.Match(h, ""); err != nil || h == "" {
+			return nil, errors.Errorf("invalid host pattern %q", h)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+func matchAny(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}